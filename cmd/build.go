@@ -9,12 +9,13 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"strings"
 	"time"
 )
 
 var (
 	terminateInstanceID, terminateRegion, listRegions string
-	aospBuildID, aospTag                              string
+	aospBuildID, aospTag, buildDevice                 string
 	forceBuild, forceChromiumBuild                    bool
 	defaultExecuteLambdaTimeout                       = time.Second * 200
 	defaultTerminateInstanceTimeout                   = time.Second * 10
@@ -30,6 +31,7 @@ func buildInit() {
 
 	buildCmd.AddCommand(buildStartCmd)
 	buildStartCmd.Flags().StringVar(&name, "name", "", "name of stack")
+	buildStartCmd.Flags().StringVar(&buildDevice, "device", "", "device to build. required if stack has more than one device.")
 	buildStartCmd.Flags().BoolVar(&forceBuild, "force-build", false, "force build even if there are no changes in component versions")
 	buildStartCmd.Flags().BoolVar(&forceChromiumBuild, "force-chromium-build", false, "force chromium build even if not required")
 	buildStartCmd.Flags().StringVar(&aospBuildID, "aosp-build-id", "", "advanced option - specify the specific the AOSP build id (e.g. RQ1A.210205.004)")
@@ -64,6 +66,13 @@ var buildStartCmd = &cobra.Command{
 		if viper.GetString("region") == "" && region == "" {
 			return fmt.Errorf("must provide stack region")
 		}
+		configuredDevices := getDevices()
+		if buildDevice == "" && len(configuredDevices) > 1 {
+			return fmt.Errorf("must provide device to build as stack has multiple devices: %v", strings.Join(configuredDevices, ", "))
+		}
+		if buildDevice != "" && len(configuredDevices) > 0 && !contains(configuredDevices, buildDevice) {
+			return fmt.Errorf("device %v is not configured for stack: %v", buildDevice, strings.Join(configuredDevices, ", "))
+		}
 		return nil
 	},
 	Run: func(cmd *cobra.Command, args []string) {
@@ -79,11 +88,13 @@ var buildStartCmd = &cobra.Command{
 			ForceChromiumBuild bool   `json:"force-chromium-build"`
 			AOSPBuildID        string `json:"aosp-build-id"`
 			AOSPTag            string `json:"aosp-tag"`
+			Device             string `json:"device,omitempty"`
 		}{
 			ForceBuild:         forceBuild,
 			ForceChromiumBuild: forceChromiumBuild,
 			AOSPBuildID:        aospBuildID,
 			AOSPTag:            aospTag,
+			Device:             buildDevice,
 		})
 		if err != nil {
 			log.Fatalf("failed to create payload for lambda function: %v", err)
@@ -169,3 +180,12 @@ var buildListCmd = &cobra.Command{
 		}
 	},
 }
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
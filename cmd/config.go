@@ -23,13 +23,16 @@ var configCmd = &cobra.Command{
 	Use:   "config",
 	Short: "setup config file for rattlesnakeos-stack",
 	Run: func(cmd *cobra.Command, args []string) {
-		color.Cyan(fmt.Sprintln("Device is the device codename (e.g. sunfish). Supported devices:", supportedDevices.GetSupportedDevicesOutput()))
+		color.Cyan(fmt.Sprintln("Device is the device codename (e.g. sunfish). Multiple devices can be specified as a comma "+
+			"separated list (e.g. redfin,barbet). Supported devices:", supportedDevices.GetSupportedDevicesOutput()))
 		validate := func(input string) error {
 			if len(input) < 1 {
 				return errors.New("Device name is too short")
 			}
-			if !supportedDevices.IsSupportedDevice(input) {
-				return errors.New("invalid device")
+			for _, d := range strings.Split(input, ",") {
+				if !supportedDevices.IsSupportedDevice(strings.TrimSpace(d)) {
+					return fmt.Errorf("invalid device %v", d)
+				}
 			}
 			return nil
 		}
@@ -44,8 +47,9 @@ var configCmd = &cobra.Command{
 		}
 		viper.Set("device", result)
 
-		defaultName := fmt.Sprintf("rattlesnakeos-%v-%v", result, randomString(10))
-		if viper.GetString("name") != "" {
+		defaultName := fmt.Sprintf("rattlesnakeos-%v-%v", strings.Join(getDevices(), "-"), randomString(10))
+		// a new stack profile shouldn't default to the name of the shared top level stack
+		if viper.GetString("name") != "" && (stackProfile == "" || viper.IsSet(stackProfileKey()+".name")) {
 			defaultName = viper.GetString("name")
 		}
 		color.Cyan(fmt.Sprintln("Stack name is used as an identifier for all the AWS components that get deployed. THIS NAME MUST BE UNIQUE OR DEPLOYMENT WILL FAIL."))
@@ -128,7 +132,7 @@ var configCmd = &cobra.Command{
 		}
 		viper.Set("ssh-key", result)
 
-		err = viper.WriteConfigAs(cfgFile)
+		err = writeConfig(cfgFile)
 		if err != nil {
 			log.WithError(err).Fatalf("failed to write config file %s", cfgFile)
 		}
@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"github.com/dan-v/rattlesnakeos-stack/internal/cloudaws"
+	"github.com/dan-v/rattlesnakeos-stack/internal/devices"
+	"github.com/dan-v/rattlesnakeos-stack/internal/events"
 	"github.com/dan-v/rattlesnakeos-stack/internal/stack"
 	"github.com/dan-v/rattlesnakeos-stack/internal/templates"
 	"github.com/dan-v/rattlesnakeos-stack/internal/terraform"
@@ -22,15 +24,25 @@ import (
 
 const (
 	minimumChromiumVersion = 86
+	outputFormatText       = "text"
+	outputFormatJSON       = "json"
 )
 
 var (
 	name, region, email, device, sshKey, maxPrice, skipPrice, schedule, cloud string
 	instanceType, instanceRegions, chromiumVersion, releasesURL               string
-	saveConfig, dryRun, chromiumBuildDisabled                                 bool
+	saveConfig, dryRun, planOnly, autoApprove, chromiumBuildDisabled          bool
+	adopt, showDiff                                                           bool
+	outputFormat                                                              string
 	coreConfigRepo, customConfigRepo                                          string
 	coreConfigRepoBranch, customConfigRepoBranch                              string
-	outputDir                                                                 string
+	outputDir, templatesDir                                                   string
+	localDir, localReleaseURL, localNotifyWebhook                             string
+	storageEndpoint, storagePublicURL, storageProfile, storageCredentials     string
+	storagePathStyle                                                          bool
+	terraformBinary, terraformMirrorURL, terraformPublicKeyFile               string
+	terraformPluginDir, terraformPluginCacheDir                               string
+	stateBackend, stateBucket, stateKeyPrefix, stateRegion, stateEndpoint     string
 	instanceDebugDelayTermination                                             bool
 	// TODO: apv workaround - remove once alternative is built
 	apvRemote, apvBranch, apvRevision                                         string
@@ -50,7 +62,7 @@ func deployInit() {
 	_ = viper.BindPFlag("region", flags.Lookup("region"))
 
 	flags.StringVarP(&device, "device", "d", "",
-		"device you want to build for (e.g. crosshatch)")
+		"device you want to build for (e.g. crosshatch). multiple devices can be specified as a comma separated list (e.g. redfin,barbet).")
 	_ = viper.BindPFlag("device", flags.Lookup("device"))
 
 	flags.StringVarP(&email, "email", "e", "",
@@ -104,15 +116,105 @@ func deployInit() {
 	flags.StringVar(&releasesURL, "releases-url", fmt.Sprintf(templates.DefaultReleasesURLTemplate, aospVersion), "url that is used to check versions of aosp/chromium and whether build is required.")
 	_ = viper.BindPFlag("releases-url", flags.Lookup("releases-url"))
 
-	flags.StringVar(&cloud, "cloud", "aws", "cloud (aws only right now)")
+	flags.StringVar(&cloud, "cloud", templates.CloudAWS,
+		"where to build. 'aws' builds on ec2 spot instances, 'local' renders a build bundle to run on your own linux machine instead of deploying with terraform.")
 	_ = viper.BindPFlag("cloud", flags.Lookup("cloud"))
 
+	flags.StringVar(&localDir, "local-dir", "",
+		"directory on the build machine for keys, release artifacts, logs and notifications of a local cloud stack. defaults to a directory named after the stack in the home directory.")
+	_ = viper.BindPFlag("local-dir", flags.Lookup("local-dir"))
+
+	flags.StringVar(&localReleaseURL, "local-release-url", "",
+		"url that the release directory in local-dir is served at, used by devices to check for OTA updates of a local cloud stack.")
+	_ = viper.BindPFlag("local-release-url", flags.Lookup("local-release-url"))
+
+	flags.StringVar(&localNotifyWebhook, "local-notify-webhook", "",
+		"url that build notifications of a local cloud stack are posted to as JSON. notifications are always written to a log in local-dir.")
+	_ = viper.BindPFlag("local-notify-webhook", flags.Lookup("local-notify-webhook"))
+
 	flags.StringVar(&outputDir, "output-dir", "", "where to generate all files used for the deployment")
 	_ = viper.BindPFlag("output-dir", flags.Lookup("output-dir"))
 
+	flags.StringVar(&terraformBinary, "terraform-binary", "",
+		fmt.Sprintf("use a preinstalled terraform binary instead of downloading terraform %v", terraform.Version))
+	_ = viper.BindPFlag("terraform-binary", flags.Lookup("terraform-binary"))
+
+	flags.StringVar(&terraformMirrorURL, "terraform-mirror-url", "",
+		"download terraform from a mirror of https://releases.hashicorp.com/terraform instead. downloads are still verified against HashiCorp's signature.")
+	_ = viper.BindPFlag("terraform-mirror-url", flags.Lookup("terraform-mirror-url"))
+
+	flags.StringVar(&terraformPublicKeyFile, "terraform-public-key-file", "",
+		"verify terraform downloads with this armored public key instead of the HashiCorp key built into this version, e.g. once HashiCorp has extended the expiry of its key.")
+	_ = viper.BindPFlag("terraform-public-key-file", flags.Lookup("terraform-public-key-file"))
+
+	flags.StringVar(&terraformPluginDir, "terraform-plugin-dir", "",
+		"install terraform providers from this local directory instead of the terraform registry (e.g. created with 'terraform providers mirror').")
+	_ = viper.BindPFlag("terraform-plugin-dir", flags.Lookup("terraform-plugin-dir"))
+
+	flags.StringVar(&terraformPluginCacheDir, "terraform-plugin-cache-dir", "",
+		"directory to cache downloaded terraform providers in, so they only need to be downloaded once.")
+	_ = viper.BindPFlag("terraform-plugin-cache-dir", flags.Lookup("terraform-plugin-cache-dir"))
+
+	flags.StringVar(&stateBackend, "state-backend", terraform.BackendS3,
+		"where to store terraform state. 's3' stores it in an S3 bucket (by default the bucket named after the stack), 'local' "+
+			"stores it in the output directory and is only meant for experiments.")
+	_ = viper.BindPFlag("state-backend", flags.Lookup("state-backend"))
+
+	flags.StringVar(&stateBucket, "state-bucket", "",
+		"S3 bucket to store terraform state in, which can be shared by multiple stacks. defaults to the bucket named after the stack.")
+	_ = viper.BindPFlag("state-bucket", flags.Lookup("state-bucket"))
+
+	flags.StringVar(&stateKeyPrefix, "state-key-prefix", "",
+		"prefix for the terraform state key in the state bucket. defaults to the stack name if a shared state bucket is used.")
+	_ = viper.BindPFlag("state-key-prefix", flags.Lookup("state-key-prefix"))
+
+	flags.StringVar(&stateRegion, "state-region", "", "region of the state bucket. defaults to the stack region.")
+	_ = viper.BindPFlag("state-region", flags.Lookup("state-region"))
+
+	flags.StringVar(&stateEndpoint, "state-endpoint", "",
+		"url of an S3 compatible service (e.g. MinIO) to store terraform state in instead of AWS S3. the state bucket must already exist.")
+	_ = viper.BindPFlag("state-endpoint", flags.Lookup("state-endpoint"))
+
+	flags.StringVar(&storageEndpoint, "storage-endpoint", "",
+		"url of an S3 compatible service (e.g. MinIO) to store the keys, logs and release buckets in instead of AWS S3. setup creates the buckets there.")
+	_ = viper.BindPFlag("storage-endpoint", flags.Lookup("storage-endpoint"))
+
+	flags.BoolVar(&storagePathStyle, "storage-path-style", false,
+		"address buckets at the storage endpoint as <endpoint>/<bucket> instead of <bucket>.<endpoint host>.")
+	_ = viper.BindPFlag("storage-path-style", flags.Lookup("storage-path-style"))
+
+	flags.StringVar(&storagePublicURL, "storage-public-url", "",
+		"url that devices download OTA updates from if the release bucket isn't served publicly by the storage endpoint (e.g. a CDN).")
+	_ = viper.BindPFlag("storage-public-url", flags.Lookup("storage-public-url"))
+
+	flags.StringVar(&storageProfile, "storage-profile", "",
+		"aws shared config profile with the credentials for the storage endpoint. defaults to the default credentials.")
+	_ = viper.BindPFlag("storage-profile", flags.Lookup("storage-profile"))
+
+	flags.StringVar(&storageCredentials, "storage-credentials-parameter", "",
+		"name of an SSM SecureString parameter in the stack region with the storage endpoint credentials as <access key id>:<secret access key>, used by build instances and the lambda function.")
+	_ = viper.BindPFlag("storage-credentials-parameter", flags.Lookup("storage-credentials-parameter"))
+
+	flags.StringVar(&templatesDir, "templates-dir", "",
+		"directory with any of build.sh, generated_vars_and_funcs.sh, lambda.py, terraform.tf and local_build.sh to use instead of the built in templates.")
+	_ = viper.BindPFlag("templates-dir", flags.Lookup("templates-dir"))
+
 	flags.BoolVar(&saveConfig, "save-config", false, "allows you to save all passed CLI flags to config file")
 
-	flags.BoolVar(&dryRun, "dry-run", false, "only generate the output files, but do not deploy with terraform.")
+	flags.BoolVar(&dryRun, "dry-run", false, "only generate and check the output files, but do not deploy with terraform.")
+
+	flags.BoolVar(&planOnly, "plan", false, "only show the terraform plan of changes that would be made, but do not apply them.")
+
+	flags.BoolVar(&showDiff, "diff", false,
+		"only show a diff of the rendered files against the files of the last deploy, but do not deploy with terraform.")
+
+	flags.BoolVar(&autoApprove, "auto-approve", false, "apply the terraform plan without prompting for confirmation.")
+
+	flags.BoolVar(&adopt, "adopt", false,
+		"import existing resources named after the stack into terraform state before planning. use this to recover a stack whose terraform state was lost.")
+
+	flags.StringVarP(&outputFormat, "output", "o", outputFormatText,
+		"format of deployment progress. 'json' prints one JSON event per line and requires --auto-approve or --plan.")
 
 	flags.BoolVar(&instanceDebugDelayTermination, "instance-debug-delay-termination", false, "delay instance shutdown/termination if there are active SSH sessions")
 	_ = viper.BindPFlag("instance-debug-delay-termination", flags.Lookup("instance-debug-delay-termination"))
@@ -135,17 +237,20 @@ var deployCmd = &cobra.Command{
 		if viper.GetString("name") == "" {
 			return fmt.Errorf("must provide a stack name")
 		}
-		if viper.GetString("region") == "" {
-			return fmt.Errorf("must provide a region")
-		}
-		if viper.GetString("email") == "" {
-			return errors.New("must specify email")
-		}
-		if viper.GetString("ssh-key") == "" {
-			return fmt.Errorf("must provide ssh key name")
-		}
-		if viper.GetString("device") == "" {
-			return errors.New("must specify device type")
+		switch viper.GetString("cloud") {
+		case templates.CloudAWS:
+			if err := validateAWSArgs(); err != nil {
+				return err
+			}
+		case templates.CloudLocal:
+			if planOnly || showDiff || adopt {
+				return errors.New("--plan, --diff and --adopt can't be used with the local cloud as it isn't deployed with terraform")
+			}
+			if !getStorage().IsAWS() {
+				return errors.New("storage-endpoint can't be used with the local cloud, which keeps releases in local-dir")
+			}
+		default:
+			return fmt.Errorf("invalid cloud '%v' - must be '%v' or '%v'", viper.GetString("cloud"), templates.CloudAWS, templates.CloudLocal)
 		}
 		if viper.GetString("chromium-version") != "" {
 			chromiumVersionSplit := strings.Split(viper.GetString("chromium-version"), ".")
@@ -160,8 +265,11 @@ var deployCmd = &cobra.Command{
 				return fmt.Errorf("pinned chromium-version must have major version of at least %v", minimumChromiumVersion)
 			}
 		}
-		if !supportedDevices.IsSupportedDevice(viper.GetString("device")) {
-			return fmt.Errorf("must specify a supported device: %v", strings.Join(supportedDevices.GetDeviceCodeNames(), ", "))
+		if err := validateDevices(); err != nil {
+			return err
+		}
+		if outputFormat != outputFormatText && outputFormat != outputFormatJSON {
+			return fmt.Errorf("invalid output format '%v' - must be '%v' or '%v'", outputFormat, outputFormatText, outputFormatJSON)
 		}
 		// TODO: apv workaround - remove once alternative is built
 		if viper.Get("apv-remote") == "" {
@@ -211,18 +319,9 @@ var deployCmd = &cobra.Command{
 		if err != nil {
 			log.Fatalf("unable to marshal config to YAML: %v", err)
 		}
-		log.Println("Current settings:")
-		fmt.Println(string(bs))
-
-		if !dryRun {
-			prompt := promptui.Prompt{
-				Label:     "Do you want to continue ",
-				IsConfirm: true,
-			}
-			_, err = prompt.Run()
-			if err != nil {
-				log.Fatalf("exiting: %v", err)
-			}
+		if outputFormat == outputFormatText {
+			log.Println("Current settings:")
+			fmt.Println(string(bs))
 		}
 
 		configuredOutputDir, err := getOutputDir()
@@ -231,96 +330,359 @@ var deployCmd = &cobra.Command{
 		}
 		log.Infof("all generated files will be placed in %v", configuredOutputDir)
 
-		templateConfig := &templates.Config{
-			Version:                       stackVersion,
-			Name:                          viper.GetString("name"),
-			Region:                        viper.GetString("region"),
-			Device:                        viper.GetString("device"),
-			DeviceDetails:                 supportedDevices.GetDeviceDetails(viper.GetString("device")),
-			Email:                         viper.GetString("email"),
-			InstanceType:                  viper.GetString("instance-type"),
-			InstanceRegions:               viper.GetString("instance-regions"),
-			SkipPrice:                     viper.GetString("skip-price"),
-			MaxPrice:                      viper.GetString("max-price"),
-			SSHKey:                        viper.GetString("ssh-key"),
-			Schedule:                      viper.GetString("schedule"),
-			ChromiumBuildDisabled:         viper.GetBool("chromium-build-disabled"),
-			ChromiumVersion:               viper.GetString("chromium-version"),
-			CoreConfigRepo:                viper.GetString("core-config-repo"),
-			CoreConfigRepoBranch:          viper.GetString("core-config-repo-branch"),
-			CustomConfigRepo:              viper.GetString("custom-config-repo"),
-			CustomConfigRepoBranch:        viper.GetString("custom-config-repo-branch"),
-			ReleasesURL:                   viper.GetString("releases-url"),
-			Cloud:                         viper.GetString("cloud"),
-			InstanceDebugDelayTermination: viper.GetBool("instance-debug-delay-termination"),
-			ApvRemote:                     viper.GetString("apv-remote"),
-			ApvBranch:                     viper.GetString("apv-branch"),
-			ApvRevision:                   viper.GetString("apv-revision"),
-		}
-
-		templateRenderer, err := templates.New(templateConfig, templatesFiles, configuredOutputDir)
+		templateConfig := getTemplateConfig()
+
+		templateFiles, err := getTemplateFiles()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		templateRenderer, err := templates.New(templateConfig, templateFiles, configuredOutputDir)
 		if err != nil {
 			log.Fatalf("failed to create template client: %v", err)
 		}
 
 		if saveConfig {
 			log.Printf("Saved settings to config file %v.", configFileFullPath)
-			err := viper.WriteConfigAs(configFileFullPath)
+			err := writeConfig(configFileFullPath)
 			if err != nil {
 				log.Fatalf("Failed to write config file %v", configFileFullPath)
 			}
 		}
 
-		if dryRun {
-			log.Infof("rendering all templates to '%v'", configuredOutputDir)
-			err = templateRenderer.RenderAll()
-			if err != nil {
+		eventSink := getEventSink()
+		if dryRun || viper.GetString("cloud") == templates.CloudLocal {
+			// rendering only needs the template renderer, so no cloud or terraform clients are created
+			renderStack := stack.New(viper.GetString("name"), templateRenderer, nil, nil, nil, nil, nil, eventSink)
+			if err := renderStack.Render(); err != nil {
 				log.Fatal(err)
 			}
+		}
+		if dryRun {
 			log.Info("skipping deployment as skip deploy option was specified")
 			return
 		}
-		if viper.GetString("cloud") != "aws" {
-			log.Fatal("'aws' is only supported option for cloud at the moment")
+		if viper.GetString("cloud") == templates.CloudLocal {
+			log.Infof("copy %v and %v to your build machine and run %v [device] to start a build",
+				templates.BuildScriptFilePath(configuredOutputDir), templates.LocalBuildScriptFilePath(configuredOutputDir),
+				filepath.Base(templates.LocalBuildScriptFilePath(configuredOutputDir)))
+			return
 		}
 
-		awsSetupClient, err := cloudaws.NewSetupClient(
-			viper.GetString("name"),
-			viper.GetString("region"),
-			configFileFullPath,
-		)
-		if err != nil {
-			log.Fatalf("failed to create aws setup client: %v", err)
+		if showDiff {
+			// diffing only needs the rendered files and the files of the last deploy, so terraform isn't set up
+			artifactClient, err := cloudaws.NewArtifactClient(viper.GetString("name"), viper.GetString("region"))
+			if err != nil {
+				log.Fatalf("failed to create aws artifact client: %v", err)
+			}
+			diffStack := stack.New(viper.GetString("name"), templateRenderer, nil, nil, nil, nil, artifactClient, eventSink)
+
+			diffCtx, diffCancel := context.WithTimeout(context.Background(), stack.DefaultInfoTimeout)
+			defer diffCancel()
+
+			// every changed file is emitted as a diff event
+			diffs, err := diffStack.Diff(diffCtx)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if len(diffs) == 0 {
+				log.Infof("rendered files of stack %v are the same as the last deploy", viper.GetString("name"))
+			}
+			return
 		}
 
-		awsSubscribeClient, err := cloudaws.NewSubscribeClient(
-			viper.GetString("name"),
-			viper.GetString("region"),
-			viper.GetString("email"),
-		)
+		s, err := newAWSStack(viper.GetString("name"), viper.GetString("region"), viper.GetString("email"),
+			templateRenderer, configuredOutputDir, configFileFullPath, eventSink)
 		if err != nil {
-			log.Fatalf("failed to create aws subscribe client: %v", err)
+			log.Fatal(err)
 		}
 
-		terraformClient, err := terraform.New(configuredOutputDir)
-		if err != nil {
-			log.Fatalf("failed to create terraform client: %v", err)
+		if adopt {
+			adoptClient, err := newAWSAdoptClient(viper.GetString("name"), viper.GetString("region"))
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			adoptCtx, adoptCancel := context.WithTimeout(context.Background(), stack.DefaultDeployTimeout)
+			defer adoptCancel()
+
+			if err := s.Adopt(adoptCtx, adoptClient); err != nil {
+				log.Fatal(err)
+			}
 		}
 
-		s := stack.New(viper.GetString("name"), templateRenderer, awsSetupClient, awsSubscribeClient, terraformClient)
-		if err != nil {
-			log.Fatal(err)
+		if planOnly {
+			planCtx, planCancel := context.WithTimeout(context.Background(), stack.DefaultDeployTimeout)
+			defer planCancel()
+
+			if err := s.Plan(planCtx); err != nil {
+				log.Fatal(err)
+			}
+			log.Info("skipping deployment as plan option was specified")
+			return
+		}
+
+		var approve func() error
+		if !autoApprove {
+			approve = approveChanges
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), stack.DefaultDeployTimeout)
+		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
 
-		if err := s.Deploy(ctx); err != nil {
+		if err := s.Deploy(ctx, stack.DefaultDeployTimeout, approve); err != nil {
 			log.Fatal(err)
 		}
 	},
 }
 
+// approveChanges prompts for confirmation of the planned changes, giving up after stack.DefaultApproveTimeout
+func approveChanges() error {
+	ctx, cancel := context.WithTimeout(context.Background(), stack.DefaultApproveTimeout)
+	defer cancel()
+
+	result := make(chan error, 1)
+	go func() {
+		prompt := promptui.Prompt{
+			Label:     "Do you want to apply these changes ",
+			IsConfirm: true,
+		}
+		_, err := prompt.Run()
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		if err != nil {
+			return fmt.Errorf("exiting: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("changes weren't approved within %v: %w", stack.DefaultApproveTimeout, ctx.Err())
+	}
+}
+
+// validateAWSArgs checks the deploy arguments that are only required for the aws cloud
+func validateAWSArgs() error {
+	if viper.GetString("region") == "" {
+		return fmt.Errorf("must provide a region")
+	}
+	if viper.GetString("email") == "" {
+		return errors.New("must specify email")
+	}
+	if viper.GetString("ssh-key") == "" {
+		return fmt.Errorf("must provide ssh key name")
+	}
+	if err := getStateBackend().Validate(); err != nil {
+		return err
+	}
+	if err := getStorage().Validate(); err != nil {
+		return err
+	}
+	if outputFormat == outputFormatJSON && !autoApprove && !planOnly && !dryRun && !showDiff {
+		return errors.New("json output can't prompt for confirmation - must also specify --auto-approve or --plan")
+	}
+	return nil
+}
+
+// newAWSStack creates all the aws and terraform clients required for a stack and returns an initialized Stack
+func newAWSStack(name, region, email string, templateRenderer stack.TemplateRenderer, outputDir, configFile string,
+	eventSink events.Sink) (*stack.Stack, error) {
+	awsSetupClient, err := cloudaws.NewSetupClient(name, region, configFile, getStateBackend(), getStorage())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create aws setup client: %w", err)
+	}
+
+	awsSubscribeClient, err := cloudaws.NewSubscribeClient(name, region, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create aws subscribe client: %w", err)
+	}
+
+	terraformClient, err := terraform.New(outputDir, getTerraformOptions(), events.NewOutputWriter(eventSink, "terraform"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create terraform client: %w", err)
+	}
+
+	awsLockClient, err := cloudaws.NewLockClient(name, getStateBackend(), outputDir, lockHolder())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create aws lock client: %w", err)
+	}
+
+	awsArtifactClient, err := cloudaws.NewArtifactClient(name, region)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create aws artifact client: %w", err)
+	}
+
+	return stack.New(name, templateRenderer, awsSetupClient, awsSubscribeClient, terraformClient, awsLockClient,
+		awsArtifactClient, eventSink), nil
+}
+
+// newAWSAdoptClient returns a client that finds the existing resources of a stack, including the build schedule
+// resources of each device if a schedule is configured
+func newAWSAdoptClient(name, region string) (*cloudaws.AdoptClient, error) {
+	var scheduledDevices []string
+	if viper.GetString("schedule") != "" {
+		scheduledDevices = getDevices()
+	}
+	adoptClient, err := cloudaws.NewAdoptClient(name, region, scheduledDevices, getStorage())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create aws adopt client: %w", err)
+	}
+	return adoptClient, nil
+}
+
+// getEventSink returns the sink for stack progress events based on the output format
+func getEventSink() events.Sink {
+	if outputFormat == outputFormatJSON {
+		return events.NewJSONSink(os.Stdout)
+	}
+	return events.NewLogSink(os.Stderr)
+}
+
+// getTerraformOptions returns where terraform and its providers are installed from. Only deploy has flags for these,
+// other commands use the values from the config file.
+func getTerraformOptions() *terraform.Options {
+	return &terraform.Options{
+		BinaryFile:     viper.GetString("terraform-binary"),
+		MirrorURL:      viper.GetString("terraform-mirror-url"),
+		PublicKeyFile:  viper.GetString("terraform-public-key-file"),
+		PluginDir:      viper.GetString("terraform-plugin-dir"),
+		PluginCacheDir: viper.GetString("terraform-plugin-cache-dir"),
+	}
+}
+
+// getTemplateFiles returns the built in templates with any overrides from the templates directory applied. Only
+// deploy has a flag for this, other commands use the value from the config file.
+func getTemplateFiles() (*templates.TemplateFiles, error) {
+	if viper.GetString("templates-dir") == "" {
+		return templatesFiles, nil
+	}
+	return templates.WithOverrides(templatesFiles, viper.GetString("templates-dir"))
+}
+
+// getStateBackend returns where terraform state is stored. Only deploy has flags for these, other commands use the
+// values from the config file.
+func getStateBackend() *terraform.Backend {
+	return newStateBackend(viper.GetString("state-backend"), viper.GetString("state-bucket"),
+		viper.GetString("state-key-prefix"), viper.GetString("state-region"), viper.GetString("state-endpoint"))
+}
+
+// getStorage returns where the keys, logs and release buckets are stored. Only deploy has flags for these, other
+// commands use the values from the config file.
+func getStorage() *cloudaws.Storage {
+	return &cloudaws.Storage{
+		Endpoint:             viper.GetString("storage-endpoint"),
+		PathStyle:            viper.GetBool("storage-path-style"),
+		PublicBaseURL:        viper.GetString("storage-public-url"),
+		Profile:              viper.GetString("storage-profile"),
+		CredentialsParameter: viper.GetString("storage-credentials-parameter"),
+	}
+}
+
+// newStateBackend returns a terraform state backend with defaults filled in for the current stack. State is stored in
+// the bucket named after the stack by default, and state in a shared bucket is stored under the stack name unless
+// another prefix is given.
+func newStateBackend(backendType, bucket, keyPrefix, stateRegion, endpoint string) *terraform.Backend {
+	if backendType == "" {
+		backendType = terraform.BackendS3
+	}
+	if backendType == terraform.BackendLocal {
+		return &terraform.Backend{Type: backendType}
+	}
+
+	stackName := viper.GetString("name")
+	if bucket == "" {
+		bucket = stackName
+	}
+	if keyPrefix == "" && bucket != stackName {
+		keyPrefix = stackName
+	}
+	if stateRegion == "" {
+		stateRegion = viper.GetString("region")
+	}
+	return &terraform.Backend{
+		Type:      backendType,
+		Bucket:    bucket,
+		KeyPrefix: keyPrefix,
+		Region:    stateRegion,
+		Endpoint:  endpoint,
+	}
+}
+
+func getTemplateConfig() *templates.Config {
+	return &templates.Config{
+		Version:                       stackVersion,
+		Name:                          viper.GetString("name"),
+		Region:                        viper.GetString("region"),
+		Devices:                       getDeviceDetails(),
+		Email:                         viper.GetString("email"),
+		InstanceType:                  viper.GetString("instance-type"),
+		InstanceRegions:               viper.GetString("instance-regions"),
+		SkipPrice:                     viper.GetString("skip-price"),
+		MaxPrice:                      viper.GetString("max-price"),
+		SSHKey:                        viper.GetString("ssh-key"),
+		Schedule:                      viper.GetString("schedule"),
+		ChromiumBuildDisabled:         viper.GetBool("chromium-build-disabled"),
+		ChromiumVersion:               viper.GetString("chromium-version"),
+		CoreConfigRepo:                viper.GetString("core-config-repo"),
+		CoreConfigRepoBranch:          viper.GetString("core-config-repo-branch"),
+		CustomConfigRepo:              viper.GetString("custom-config-repo"),
+		CustomConfigRepoBranch:        viper.GetString("custom-config-repo-branch"),
+		ReleasesURL:                   viper.GetString("releases-url"),
+		Cloud:                         viper.GetString("cloud"),
+		LocalDir:                      viper.GetString("local-dir"),
+		LocalReleaseURL:               viper.GetString("local-release-url"),
+		LocalNotifyWebhook:            viper.GetString("local-notify-webhook"),
+		StateBackend:                  getStateBackend(),
+		Storage:                       *getStorage(),
+		InstanceDebugDelayTermination: viper.GetBool("instance-debug-delay-termination"),
+		ApvRemote:                     viper.GetString("apv-remote"),
+		ApvBranch:                     viper.GetString("apv-branch"),
+		ApvRevision:                   viper.GetString("apv-revision"),
+	}
+}
+
+// getDevices returns the device code names from the comma separated device config value
+func getDevices() []string {
+	var configuredDevices []string
+	for _, d := range strings.Split(viper.GetString("device"), ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			configuredDevices = append(configuredDevices, d)
+		}
+	}
+	return configuredDevices
+}
+
+// getDeviceDetails returns the details of the configured devices. Unsupported devices are skipped, as commands that
+// don't need device details (e.g. remove) don't validate them.
+func getDeviceDetails() []*devices.Device {
+	var deviceDetails []*devices.Device
+	for _, d := range getDevices() {
+		if details := supportedDevices.GetDeviceDetails(d); details != nil {
+			deviceDetails = append(deviceDetails, details)
+		}
+	}
+	return deviceDetails
+}
+
+func validateDevices() error {
+	configuredDevices := getDevices()
+	if len(configuredDevices) == 0 {
+		return errors.New("must specify device type")
+	}
+	seen := map[string]bool{}
+	for _, d := range configuredDevices {
+		if !supportedDevices.IsSupportedDevice(d) {
+			return fmt.Errorf("must specify a supported device: %v", strings.Join(supportedDevices.GetDeviceCodeNames(), ", "))
+		}
+		if seen[d] {
+			return fmt.Errorf("device %v is specified more than once", d)
+		}
+		seen[d] = true
+	}
+	return nil
+}
+
 func getOutputDir() (string, error) {
 	configuredOutputDir := viper.GetString("output-dir")
 	if configuredOutputDir == "" {
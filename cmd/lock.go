@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/dan-v/rattlesnakeos-stack/internal/cloudaws"
+	"github.com/manifoldco/promptui"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"os"
+	"os/user"
+	"time"
+)
+
+func lockInit() {
+	rootCmd.AddCommand(lockCmd)
+
+	lockCmd.AddCommand(lockForceUnlockCmd)
+	lockForceUnlockCmd.Flags().StringVarP(&name, "name", "n", "", "name of stack")
+	lockForceUnlockCmd.Flags().StringVarP(&region, "region", "r", "", "region where stack was deployed to (e.g. us-west-2)")
+}
+
+var lockCmd = &cobra.Command{
+	Use:   "lock",
+	Short: "manage the lock that prevents concurrent changes to a stack",
+}
+
+var lockForceUnlockCmd = &cobra.Command{
+	Use:   "force-unlock",
+	Short: "remove a stale stack lock left behind by an interrupted deploy or remove",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if viper.GetString("name") == "" && name == "" {
+			return fmt.Errorf("must provide a stack name")
+		}
+		if viper.GetString("region") == "" && region == "" {
+			return fmt.Errorf("must provide a region")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if name == "" {
+			name = viper.GetString("name")
+		}
+		if region == "" {
+			region = viper.GetString("region")
+		}
+		viper.Set("name", name)
+		viper.Set("region", region)
+
+		configuredOutputDir, err := getOutputDir()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		lockClient, err := cloudaws.NewLockClient(name, getStateBackend(), configuredOutputDir, lockHolder())
+		if err != nil {
+			log.Fatalf("failed to create lock client: %v", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		lockInfo, err := lockClient.GetLock(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if lockInfo == nil {
+			log.Infof("stack %v is not locked", name)
+			return
+		}
+
+		log.Printf("stack %v is locked by %v for %v since %v", name, lockInfo.Holder, lockInfo.Operation,
+			lockInfo.Since.Format(time.RFC3339))
+		prompt := promptui.Prompt{
+			Label:     "only remove the lock if you are sure no deploy or remove is still running. do you want to continue ",
+			IsConfirm: true,
+		}
+		_, err = prompt.Run()
+		if err != nil {
+			log.Fatalf("exiting: %v", err)
+		}
+
+		if err := lockClient.ForceUnlock(ctx); err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("removed lock for stack %v", name)
+	},
+}
+
+// lockHolder returns a description of who is running the cli to record in the stack lock
+func lockHolder() string {
+	username := "unknown"
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%v@%v", username, hostname)
+}
@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/dan-v/rattlesnakeos-stack/internal/cloudaws"
+	"github.com/dan-v/rattlesnakeos-stack/internal/migrate"
+	"github.com/dan-v/rattlesnakeos-stack/internal/templates"
+	"github.com/fatih/color"
+	"github.com/manifoldco/promptui"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	migrateFromName, migrateFromRegion string
+	migrateRemoveOld                   bool
+	migrateAllowMissingKeys            bool
+	migrateTimeout                     time.Duration
+)
+
+func migrateInit() {
+	rootCmd.AddCommand(migrateCmd)
+
+	migrateCmd.Flags().StringVar(&migrateFromName, "from-name", "", "name of the existing stack to migrate from")
+	migrateCmd.Flags().StringVar(&migrateFromRegion, "from-region", "",
+		"region of the existing stack to migrate from (default is the region of the new stack)")
+	migrateCmd.Flags().StringVarP(&name, "name", "n", "",
+		"name of the new stack (default is name from config file). note: this must be a valid/unique S3 bucket name.")
+	migrateCmd.Flags().StringVarP(&region, "region", "r", "", "region of the new stack (default is region from config file)")
+	migrateCmd.Flags().BoolVar(&migrateRemoveOld, "remove-old", false,
+		"remove the existing stack after keys have been copied and verified")
+	migrateCmd.Flags().BoolVar(&migrateAllowMissingKeys, "allow-missing-keys", false,
+		"don't fail if a device of the existing stack is missing one of its signing keys. devices using a missing key "+
+			"won't accept updates from the new stack.")
+	migrateCmd.Flags().DurationVar(&migrateTimeout, "timeout", migrate.DefaultMigrateTimeout,
+		"how long to wait for migration to finish. release buckets with a lot of build artifacts can take a while to copy.")
+}
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "deploy a new stack with a different name or region that keeps the signing keys of an existing stack",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if migrateFromName == "" {
+			return fmt.Errorf("must provide name of existing stack with --from-name")
+		}
+		if name != "" {
+			viper.Set("name", name)
+		}
+		if region != "" {
+			viper.Set("region", region)
+		}
+		if migrateFromRegion == "" {
+			migrateFromRegion = viper.GetString("region")
+		}
+		if migrateFromName == viper.GetString("name") {
+			return fmt.Errorf("new stack must have a different name than %v as bucket names are globally unique", migrateFromName)
+		}
+		if !getStorage().IsAWS() {
+			return fmt.Errorf("migrate only supports stacks that store keys and releases in AWS S3, not a storage endpoint")
+		}
+		return deployCmd.Args(cmd, args)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		toName := viper.GetString("name")
+		toRegion := viper.GetString("region")
+
+		log.Println("details of migration:")
+		fmt.Println("Existing stack:", migrateFromName, "in", migrateFromRegion)
+		fmt.Println("New stack:", toName, "in", toRegion)
+		fmt.Println("")
+		if migrateRemoveOld {
+			color.Red("the existing stack %v and all of its data will be removed once keys have been copied and verified. "+
+				"devices will only receive updates from the new stack after installing a build from it.", migrateFromName)
+		}
+		prompt := promptui.Prompt{
+			Label:     fmt.Sprintf("do you want to migrate stack %v to %v ", migrateFromName, toName),
+			IsConfirm: true,
+		}
+		_, err := prompt.Run()
+		if err != nil {
+			log.Fatalf("exiting: %v", err)
+		}
+
+		configFileFullPath, err := filepath.Abs(cfgFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		eventSink := getEventSink()
+
+		newOutputDir, err := getOutputDir()
+		if err != nil {
+			log.Fatal(err)
+		}
+		templateFiles, err := getTemplateFiles()
+		if err != nil {
+			log.Fatal(err)
+		}
+		newTemplateRenderer, err := templates.New(getTemplateConfig(), templateFiles, newOutputDir)
+		if err != nil {
+			log.Fatalf("failed to create template client: %v", err)
+		}
+		newStack, err := newAWSStack(toName, toRegion, viper.GetString("email"), newTemplateRenderer, newOutputDir,
+			configFileFullPath, eventSink)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		oldOutputDir, err := getMigrateFromOutputDir(newOutputDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		oldTemplateConfig := getTemplateConfig()
+		oldTemplateConfig.Name = migrateFromName
+		oldTemplateConfig.Region = migrateFromRegion
+		oldTemplateConfig.AllowKeysDestroy = true
+		oldTemplateRenderer, err := templates.New(oldTemplateConfig, templateFiles, oldOutputDir)
+		if err != nil {
+			log.Fatalf("failed to create template client: %v", err)
+		}
+		oldStack, err := newAWSStack(migrateFromName, migrateFromRegion, viper.GetString("email"), oldTemplateRenderer,
+			oldOutputDir, configFileFullPath, eventSink)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		migrateClient, err := cloudaws.NewMigrateClient(migrateFromName, migrateFromRegion, toName, toRegion,
+			migrateAllowMissingKeys)
+		if err != nil {
+			log.Fatalf("failed to create aws migrate client: %v", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), migrateTimeout)
+		defer cancel()
+
+		m := migrate.New(migrateFromName, toName, newStack, oldStack, migrateClient, migrateRemoveOld)
+		if err := m.Run(ctx); err != nil {
+			log.Fatalf("failed to migrate stack %v to %v: %v", migrateFromName, toName, err)
+		}
+
+		log.Infof("make sure name and region in config file %v are set to %v and %v. devices keep checking the "+
+			"existing stack for updates until they install a build from the new stack - start one with "+
+			"'rattlesnakeos-stack build start --force-build' and install it with adb sideload. the signing keys are "+
+			"the same, so no data wipe is required.", configFileFullPath, toName, toRegion)
+	},
+}
+
+// getMigrateFromOutputDir returns where to generate files for the existing stack, keeping them separate from the
+// files of the new stack
+func getMigrateFromOutputDir(newOutputDir string) (string, error) {
+	dir := fmt.Sprintf("output_%v", migrateFromName)
+	if viper.GetString("output-dir") != "" {
+		dir = filepath.Join(newOutputDir, fmt.Sprintf("migrate_from_%v", migrateFromName))
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
@@ -3,12 +3,19 @@ package cmd
 import (
 	"context"
 	"fmt"
-	"github.com/dan-v/rattlesnakeos-stack/internal/terraform"
+	"github.com/dan-v/rattlesnakeos-stack/internal/stack"
+	"github.com/dan-v/rattlesnakeos-stack/internal/templates"
 	"github.com/fatih/color"
 	"github.com/manifoldco/promptui"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"path/filepath"
+	"time"
+)
+
+var (
+	removeTimeout time.Duration
 )
 
 func removeInit() {
@@ -19,6 +26,9 @@ func removeInit() {
 
 	removeCmd.Flags().StringVarP(&region, "region", "r", "",
 		"region where stack was deployed to (e.g. us-west-2)")
+
+	removeCmd.Flags().DurationVar(&removeTimeout, "timeout", stack.DefaultRemoveTimeout,
+		"how long to wait for removal to finish. buckets with a lot of build artifacts can take a while to delete.")
 }
 
 var removeCmd = &cobra.Command{
@@ -28,6 +38,9 @@ var removeCmd = &cobra.Command{
 		if viper.GetString("name") == "" && name == "" {
 			return fmt.Errorf("must provide a stack name")
 		}
+		if viper.GetString("cloud") == templates.CloudLocal {
+			return fmt.Errorf("local cloud stacks have no cloud infrastructure to remove - delete the local dir on the build machine instead")
+		}
 		if viper.GetString("region") == "" && region == "" {
 			return fmt.Errorf("must provide a region")
 		}
@@ -40,6 +53,8 @@ var removeCmd = &cobra.Command{
 		if region == "" {
 			region = viper.GetString("region")
 		}
+		viper.Set("name", name)
+		viper.Set("region", region)
 
 		log.Println("details of stack to be deleted:")
 		fmt.Println("Stack name:", name)
@@ -49,7 +64,7 @@ var removeCmd = &cobra.Command{
 		color.Red("this is a destructive action! all S3 buckets will be removed and all data will be destroyed. " +
 			"make sure to backup anything you might want to keep!")
 		prompt := promptui.Prompt{
-			Label:     fmt.Sprintf("this will remove all AWS infrastructure for stack %v. do you want to continue ", viper.GetString("name")),
+			Label:     fmt.Sprintf("this will remove all AWS infrastructure for stack %v. do you want to continue ", name),
 			IsConfirm: true,
 		}
 		_, err := prompt.Run()
@@ -57,22 +72,39 @@ var removeCmd = &cobra.Command{
 			log.Fatalf("Exiting %v", err)
 		}
 
+		configFileFullPath, err := filepath.Abs(cfgFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
 		configuredOutputDir, err := getOutputDir()
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		terraformClient, err := terraform.New(configuredOutputDir)
+		templateFiles, err := getTemplateFiles()
 		if err != nil {
-			log.Fatalf("failed to create terraform client: %v", err)
+			log.Fatal(err)
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), terraform.DefaultTerraformDestroyTimeout)
-		defer cancel()
+		templateConfig := getTemplateConfig()
+		templateConfig.AllowKeysDestroy = true
+		templateRenderer, err := templates.New(templateConfig, templateFiles, configuredOutputDir)
+		if err != nil {
+			log.Fatalf("failed to create template client: %v", err)
+		}
 
-		_, err = terraformClient.Destroy(ctx)
+		s, err := newAWSStack(name, region, viper.GetString("email"), templateRenderer, configuredOutputDir,
+			configFileFullPath, getEventSink())
 		if err != nil {
-			log.Fatalf("failed to run terraform destroy: %v", err)
+			log.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), removeTimeout)
+		defer cancel()
+
+		if err := s.Remove(ctx); err != nil {
+			log.Fatalf("failed to remove stack %v: %v", name, err)
 		}
 	},
 }
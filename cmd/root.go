@@ -5,6 +5,7 @@ import (
 	"github.com/dan-v/rattlesnakeos-stack/internal/devices"
 	"github.com/dan-v/rattlesnakeos-stack/internal/templates"
 	"os"
+	"strings"
 
 	homedir "github.com/mitchellh/go-homedir"
 	log "github.com/sirupsen/logrus"
@@ -14,6 +15,8 @@ import (
 
 var (
 	cfgFile                   string
+	stackProfile              string
+	stackProfileFound         bool
 	defaultConfigFileBase     = ".rattlesnakeos"
 	defaultConfigFileFormat   = "toml"
 	defaultConfigFile         = fmt.Sprintf("%v.%v", defaultConfigFileBase, defaultConfigFileFormat)
@@ -34,12 +37,20 @@ func Execute(_supportedDevices *devices.SupportedDevices, _aospVersion, _stackVe
 	// initialize cobra
 	cobra.OnInitialize(initConfig)
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config-file", "", fmt.Sprintf("config file (default location to look for config is $HOME/%s)", defaultConfigFile))
+	rootCmd.PersistentFlags().StringVar(&stackProfile, "stack", "", "name of stack profile to use from a [stacks.<name>] section "+
+		"of the config file. values in the profile override the shared values at the top of the config file.")
 
 	// init sub commands
 	buildInit()
 	configInit()
 	deployInit()
+	lockInit()
+	migrateInit()
 	removeInit()
+	stackInit()
+	stateInit()
+	statusInit()
+	upgradeInit()
 	versionInit()
 
 	// execute root
@@ -79,10 +90,77 @@ func initConfig() {
 	if viper.ConfigFileUsed() != "" {
 		log.Printf("using config file: %v\n", viper.ConfigFileUsed())
 	}
+
+	if stackProfile != "" {
+		profile := viper.GetStringMap(stackProfileKey())
+		if len(profile) > 0 {
+			stackProfileFound = true
+			if err := viper.MergeConfigMap(profile); err != nil {
+				log.Fatalf("failed to load stack profile %v: %v", stackProfile, err)
+			}
+			log.Printf("using stack profile: %v\n", stackProfile)
+		}
+	}
+}
+
+// checkStackProfile ensures a selected stack profile exists and has its own name, so that a missing or incomplete
+// profile can't silently fall back to the shared top level stack. The config command is allowed to create new profiles.
+func checkStackProfile(cmd *cobra.Command, args []string) error {
+	if stackProfile == "" || cmd.Name() == "config" {
+		return nil
+	}
+	if strings.Contains(stackProfile, ".") {
+		return fmt.Errorf("stack profile name %v must not contain '.'", stackProfile)
+	}
+	if !stackProfileFound {
+		configFile := viper.ConfigFileUsed()
+		if configFile == "" {
+			return fmt.Errorf("stack profile %v not found - no config file was found at %v", stackProfile, cfgFile)
+		}
+		return fmt.Errorf("stack profile %v not found in config file %v", stackProfile, configFile)
+	}
+	if !viper.IsSet(stackProfileKey() + ".name") {
+		return fmt.Errorf("stack profile %v must set its own name", stackProfile)
+	}
+	return nil
+}
+
+// writeConfig writes current settings to the config file. If a stack profile is selected, settings that differ from
+// the shared top level values (or are already set in the profile) are written to the profile section instead.
+func writeConfig(filename string) error {
+	if stackProfile == "" {
+		return viper.WriteConfigAs(filename)
+	}
+
+	fileConfig := viper.New()
+	fileConfig.SetConfigFile(filename)
+	fileConfig.SetConfigType(defaultConfigFileFormat)
+	if err := fileConfig.ReadInConfig(); err != nil {
+		if _, statErr := os.Stat(filename); statErr == nil {
+			return err
+		}
+	}
+
+	for _, key := range viper.AllKeys() {
+		if strings.HasPrefix(key, "stacks.") {
+			continue
+		}
+		profileKey := fmt.Sprintf("%v.%v", stackProfileKey(), key)
+		value := viper.Get(key)
+		if fileConfig.IsSet(profileKey) || fmt.Sprint(fileConfig.Get(key)) != fmt.Sprint(value) {
+			fileConfig.Set(profileKey, value)
+		}
+	}
+	return fileConfig.WriteConfigAs(filename)
+}
+
+func stackProfileKey() string {
+	return fmt.Sprintf("stacks.%v", stackProfile)
 }
 
 var rootCmd = &cobra.Command{
 	Use: "rattlesnakeos-stack",
 	Short: "a cross platform tool that provisions all of the cloud infrastructure required to build your own privacy " +
 		"focused Android OS on a continuous basis with OTA updates.",
+	PersistentPreRunE: checkStackProfile,
 }
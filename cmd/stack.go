@@ -0,0 +1,287 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dan-v/rattlesnakeos-stack/internal/stack"
+	"github.com/dan-v/rattlesnakeos-stack/internal/templates"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	// driftExitCode is the exit code of stack drift if drift is found, matching terraform plan -detailed-exitcode
+	driftExitCode = 2
+)
+
+var (
+	stackOutputFormat string
+	resourceAddress   string
+)
+
+func stackInit() {
+	rootCmd.AddCommand(stackCmd)
+
+	stackCmd.AddCommand(stackInfoCmd)
+	stackInfoCmd.Flags().StringVarP(&name, "name", "n", "", "name of stack")
+	stackInfoCmd.Flags().StringVarP(&region, "region", "r", "", "region where stack was deployed to (e.g. us-west-2)")
+	stackInfoCmd.Flags().StringVarP(&stackOutputFormat, "output", "o", outputFormatText, "format of stack info. 'text' or 'json'.")
+
+	stackCmd.AddCommand(stackResourcesCmd)
+	stackResourcesCmd.Flags().StringVarP(&name, "name", "n", "", "name of stack")
+	stackResourcesCmd.Flags().StringVarP(&region, "region", "r", "", "region where stack was deployed to (e.g. us-west-2)")
+	stackResourcesCmd.Flags().StringVarP(&stackOutputFormat, "output", "o", outputFormatText, "format of resources. 'text' or 'json'.")
+	stackResourcesCmd.Flags().StringVar(&resourceAddress, "address", "",
+		"only show the terraform resource with this address (e.g. aws_sns_topic.rattlesnake), with all of its attributes")
+
+	stackCmd.AddCommand(stackDriftCmd)
+	stackDriftCmd.Flags().StringVarP(&name, "name", "n", "", "name of stack")
+	stackDriftCmd.Flags().StringVarP(&region, "region", "r", "", "region where stack was deployed to (e.g. us-west-2)")
+	stackDriftCmd.Flags().StringVarP(&stackOutputFormat, "output", "o", outputFormatText, "format of drift report. 'text' or 'json'.")
+}
+
+var stackCmd = &cobra.Command{
+	Use:   "stack",
+	Short: "commands to inspect a deployed stack",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return errors.New("Need to specify a subcommand")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {},
+}
+
+var stackInfoCmd = &cobra.Command{
+	Use:   "info",
+	Short: "show the buckets, lambda function, notification topic and other resources of a deployed stack",
+	Args:  stackArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		info, err := getStackInfo(name, region)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if stackOutputFormat == outputFormatJSON {
+			printJSON(info)
+			return
+		}
+		printStackInfo(info)
+	},
+}
+
+var stackResourcesCmd = &cobra.Command{
+	Use:   "resources",
+	Short: "list every cloud resource that belongs to a deployed stack",
+	Args:  stackArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		s, err := newStackFromConfig(name, region)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), stack.DefaultInfoTimeout)
+		defer cancel()
+
+		var resources []*stack.Resource
+		if resourceAddress != "" {
+			resource, err := s.Resource(ctx, resourceAddress)
+			if err != nil {
+				log.Fatal(err)
+			}
+			resources = append(resources, resource)
+		} else {
+			resources, err = s.Resources(ctx)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		for _, resource := range resources {
+			if resource.Region == "" {
+				resource.Region = region
+			}
+		}
+
+		if stackOutputFormat == outputFormatJSON {
+			printJSON(resources)
+			return
+		}
+		for _, resource := range resources {
+			printResource(resource)
+		}
+	},
+}
+
+var stackDriftCmd = &cobra.Command{
+	Use:   "drift",
+	Short: "check whether a deployed stack differs from what deploy would create",
+	Long: "check whether a deployed stack differs from what deploy would create, e.g. because of changes made in the " +
+		"aws console that the next deploy would revert. exits with code 0 if there is no drift, 1 on error and " +
+		"2 if drift is found, so it can be used as a scheduled check.",
+	Args: stackArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		s, err := newStackFromConfig(name, region)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), stack.DefaultDeployTimeout)
+		defer cancel()
+
+		drift, err := s.Drift(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if stackOutputFormat == outputFormatJSON {
+			if drift == nil {
+				drift = []*stack.Drift{}
+			}
+			printJSON(drift)
+		} else {
+			printDrift(drift)
+		}
+		if len(drift) > 0 {
+			os.Exit(driftExitCode)
+		}
+	},
+}
+
+// stackArgs validates the flags shared by stack subcommands and falls back to the config file for name and region
+func stackArgs(cmd *cobra.Command, args []string) error {
+	if viper.GetString("name") == "" && name == "" {
+		return fmt.Errorf("must provide a stack name")
+	}
+	if viper.GetString("region") == "" && region == "" {
+		return fmt.Errorf("must provide a region")
+	}
+	if stackOutputFormat != outputFormatText && stackOutputFormat != outputFormatJSON {
+		return fmt.Errorf("invalid output format '%v' - must be '%v' or '%v'", stackOutputFormat, outputFormatText, outputFormatJSON)
+	}
+	if name == "" {
+		name = viper.GetString("name")
+	}
+	if region == "" {
+		region = viper.GetString("region")
+	}
+	return nil
+}
+
+// getStackInfo returns details of the resources deployed for a stack from its terraform outputs, so commands don't
+// need to know how resources are named
+func getStackInfo(stackName, stackRegion string) (*stack.Info, error) {
+	s, err := newStackFromConfig(stackName, stackRegion)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), stack.DefaultInfoTimeout)
+	defer cancel()
+
+	return s.Info(ctx)
+}
+
+// newStackFromConfig returns a Stack for inspecting an already deployed stack, using the config file for everything
+// other than name and region
+func newStackFromConfig(stackName, stackRegion string) (*stack.Stack, error) {
+	viper.Set("name", stackName)
+	viper.Set("region", stackRegion)
+
+	configFileFullPath, err := filepath.Abs(cfgFile)
+	if err != nil {
+		return nil, err
+	}
+
+	configuredOutputDir, err := getOutputDir()
+	if err != nil {
+		return nil, err
+	}
+
+	templateFiles, err := getTemplateFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	templateRenderer, err := templates.New(getTemplateConfig(), templateFiles, configuredOutputDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create template client: %w", err)
+	}
+
+	return newAWSStack(stackName, stackRegion, viper.GetString("email"), templateRenderer, configuredOutputDir,
+		configFileFullPath, getEventSink())
+}
+
+func printJSON(v interface{}) {
+	output, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(output))
+}
+
+func printStackInfo(info *stack.Info) {
+	fmt.Printf("Stack %v:\n", name)
+	fmt.Println("  keys bucket:", info.KeysBucket)
+	fmt.Println("  encrypted keys bucket:", info.KeysEncryptedBucket)
+	fmt.Println("  logs bucket:", info.LogsBucket)
+	fmt.Println("  release bucket:", info.ReleaseBucket)
+	fmt.Println("  script bucket:", info.ScriptBucket)
+	fmt.Println("  build instance profile:", info.EC2InstanceProfile)
+	fmt.Println("  lambda function:", info.LambdaFunctionARN)
+	fmt.Println("  notification topic:", info.SNSTopicARN)
+	fmt.Println("  OTA base url:", info.OTABaseURL)
+
+	if len(info.ScheduleRules) == 0 {
+		fmt.Println("  build schedule: disabled")
+		return
+	}
+	var scheduledDevices []string
+	for d := range info.ScheduleRules {
+		scheduledDevices = append(scheduledDevices, d)
+	}
+	sort.Strings(scheduledDevices)
+	for _, d := range scheduledDevices {
+		fmt.Printf("  build schedule rule for %v: %v\n", d, info.ScheduleRules[d])
+	}
+}
+
+func printResource(resource *stack.Resource) {
+	fmt.Printf("%v (managed by %v):\n", resource.Address, resource.ManagedBy)
+	fmt.Println("  type:", resource.Type)
+	fmt.Println("  id:", resource.ID)
+	fmt.Println("  region:", resource.Region)
+
+	var keys []string
+	for key := range resource.Attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Printf("  %v: %v\n", key, resource.Attributes[key])
+	}
+	fmt.Println("")
+}
+
+func printDrift(drift []*stack.Drift) {
+	if len(drift) == 0 {
+		log.Infof("no drift found for stack %v", name)
+		return
+	}
+
+	log.Warnf("found %v differences between stack %v and its rendered templates:", len(drift), name)
+	for _, d := range drift {
+		if d.Attribute == "" {
+			fmt.Printf("%v: %v\n", d.Address, d.Action)
+			continue
+		}
+		fmt.Printf("%v: %v %v\n", d.Address, d.Action, d.Attribute)
+		fmt.Println("  expected:", d.Expected)
+		fmt.Println("  actual:  ", d.Actual)
+	}
+}
@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/dan-v/rattlesnakeos-stack/internal/stack"
+	"github.com/dan-v/rattlesnakeos-stack/internal/templates"
+	"github.com/dan-v/rattlesnakeos-stack/internal/terraform"
+	"github.com/manifoldco/promptui"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	fromStateBackend, fromStateBucket, fromStateKeyPrefix, fromStateRegion, fromStateEndpoint string
+)
+
+func stateInit() {
+	rootCmd.AddCommand(stateCmd)
+
+	stateCmd.AddCommand(stateMigrateCmd)
+	flags := stateMigrateCmd.Flags()
+	flags.StringVarP(&name, "name", "n", "", "name of stack")
+	flags.StringVarP(&region, "region", "r", "", "region where stack was deployed to (e.g. us-west-2)")
+	flags.StringVar(&fromStateBackend, "from-state-backend", terraform.BackendS3, "backend the state is currently stored in. 's3' or 'local'.")
+	flags.StringVar(&fromStateBucket, "from-state-bucket", "", "bucket the state is currently stored in. defaults to the bucket named after the stack.")
+	flags.StringVar(&fromStateKeyPrefix, "from-state-key-prefix", "",
+		"prefix of the current state key. defaults to the stack name if a shared state bucket is used.")
+	flags.StringVar(&fromStateRegion, "from-state-region", "", "region of the current state bucket. defaults to the stack region.")
+	flags.StringVar(&fromStateEndpoint, "from-state-endpoint", "", "url of the S3 compatible service the state is currently stored in.")
+	flags.BoolVar(&autoApprove, "auto-approve", false, "migrate without prompting for confirmation.")
+}
+
+var stateCmd = &cobra.Command{
+	Use:   "state",
+	Short: "manage where the terraform state of a stack is stored",
+}
+
+var stateMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "move the terraform state of a stack to the state backend in the config file",
+	Long: "move the terraform state of a stack to the state backend in the config file. the --from-state flags describe " +
+		"where the state is stored now, and default to the bucket named after the stack. state in the old backend is " +
+		"left in place and existing state in the new backend is never overwritten.",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if viper.GetString("name") == "" && name == "" {
+			return fmt.Errorf("must provide a stack name")
+		}
+		if viper.GetString("region") == "" && region == "" {
+			return fmt.Errorf("must provide a region")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if name == "" {
+			name = viper.GetString("name")
+		}
+		if region == "" {
+			region = viper.GetString("region")
+		}
+		viper.Set("name", name)
+		viper.Set("region", region)
+
+		from := newStateBackend(fromStateBackend, fromStateBucket, fromStateKeyPrefix, fromStateRegion, fromStateEndpoint)
+		to := getStateBackend()
+		for _, backend := range []*terraform.Backend{from, to} {
+			if err := backend.Validate(); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if *from == *to {
+			log.Fatalf("state is already stored in %v - update the state settings in the config file to migrate it", to)
+		}
+
+		log.Infof("migrating terraform state of stack %v from %v to %v", name, from, to)
+		if !autoApprove {
+			prompt := promptui.Prompt{
+				Label:     "Do you want to migrate the state ",
+				IsConfirm: true,
+			}
+			if _, err := prompt.Run(); err != nil {
+				log.Fatalf("exiting: %v", err)
+			}
+		}
+
+		configuredOutputDir, err := getOutputDir()
+		if err != nil {
+			log.Fatal(err)
+		}
+		sourceConfig := getTemplateConfig()
+		sourceConfig.StateBackend = from
+		templateFiles, err := getTemplateFiles()
+		if err != nil {
+			log.Fatal(err)
+		}
+		sourceRenderer, err := templates.New(sourceConfig, templateFiles, configuredOutputDir)
+		if err != nil {
+			log.Fatalf("failed to create template client: %v", err)
+		}
+
+		s, err := newStackFromConfig(name, region)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), stack.DefaultDeployTimeout)
+		defer cancel()
+
+		if err := s.MigrateState(ctx, sourceRenderer); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/dan-v/rattlesnakeos-stack/internal/cloudaws"
+	"github.com/dan-v/rattlesnakeos-stack/internal/status"
+	"github.com/fatih/color"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"time"
+)
+
+var (
+	statusDevice string
+)
+
+func statusInit() {
+	rootCmd.AddCommand(statusCmd)
+
+	statusCmd.Flags().StringVarP(&name, "name", "n", "", "name of stack")
+	statusCmd.Flags().StringVarP(&region, "region", "r", "", "region where stack was deployed to (e.g. us-west-2)")
+	statusCmd.Flags().StringVarP(&statusDevice, "device", "d", "", "only show status for this device (default is all configured devices)")
+}
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "show build freshness of deployed stack compared to latest available versions",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if viper.GetString("name") == "" && name == "" {
+			return fmt.Errorf("must provide a stack name")
+		}
+		if viper.GetString("region") == "" && region == "" {
+			return fmt.Errorf("must provide a region")
+		}
+		if statusDevice == "" && len(getDevices()) == 0 {
+			return fmt.Errorf("must provide a device")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if name == "" {
+			name = viper.GetString("name")
+		}
+		if region == "" {
+			region = viper.GetString("region")
+		}
+		stackDevices := getDevices()
+		statusDevices := stackDevices
+		if statusDevice != "" {
+			statusDevices = []string{statusDevice}
+		}
+
+		metadataClient, err := cloudaws.NewReleaseMetadataClient(name, region, getStorage())
+		if err != nil {
+			log.Fatalf("failed to create aws release metadata client: %v", err)
+		}
+
+		statusClient := status.New(metadataClient, viper.GetString("releases-url"), stackVersion,
+			viper.GetString("chromium-version"), viper.GetBool("chromium-build-disabled"), stackDevices)
+
+		ctx, cancel := context.WithTimeout(context.Background(), status.DefaultStatusTimeout)
+		defer cancel()
+
+		latest, err := statusClient.GetLatest(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for _, d := range statusDevices {
+			deviceStatus, err := statusClient.GetDeviceStatus(ctx, latest, d)
+			if err != nil {
+				log.Fatalf("failed to get status for device %v: %v", d, err)
+			}
+			printDeviceStatus(deviceStatus)
+		}
+	},
+}
+
+func printDeviceStatus(deviceStatus *status.DeviceStatus) {
+	fmt.Printf("Stack %v device %v:\n", name, deviceStatus.Device)
+	if deviceStatus.LastOTAPublished.IsZero() {
+		fmt.Println("  last OTA published: never")
+	} else {
+		fmt.Printf("  last OTA published: %v (%v ago)\n", deviceStatus.LastOTAPublished.Format(time.RFC3339),
+			time.Since(deviceStatus.LastOTAPublished).Round(time.Hour))
+	}
+
+	for _, component := range deviceStatus.Components {
+		current := component.Current
+		if current == "" {
+			current = "none"
+		}
+		line := fmt.Sprintf("  %v: %v (latest: %v)", component.Name, current, component.Latest)
+		if component.Behind {
+			color.Yellow("%v - BEHIND", line)
+		} else {
+			fmt.Println(line)
+		}
+	}
+
+	if deviceStatus.BelowMinimumStackVersion {
+		color.Red("  deployed stack version is below the minimum required version - builds will be cancelled until the stack is updated")
+	}
+	if deviceStatus.UpToDate() {
+		color.Green("  up to date")
+	}
+	fmt.Println("")
+}
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/dan-v/rattlesnakeos-stack/internal/templates"
+	"github.com/dan-v/rattlesnakeos-stack/internal/upgrade"
+	"github.com/manifoldco/promptui"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func upgradeInit() {
+	rootCmd.AddCommand(upgradeCmd)
+}
+
+var upgradeCmd = &cobra.Command{
+	Use:   "upgrade",
+	Short: "upgrade the cli to the latest release",
+	Run: func(cmd *cobra.Command, args []string) {
+		executablePath, err := os.Executable()
+		if err != nil {
+			log.Fatalf("failed to determine path of cli: %v", err)
+		}
+		executablePath, err = filepath.EvalSymlinks(executablePath)
+		if err != nil {
+			log.Fatalf("failed to determine path of cli: %v", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), upgrade.DefaultUpgradeTimeout)
+		defer cancel()
+
+		upgradeClient := upgrade.New(templates.DefaultRattlesnakeOSStackReleaseURL, stackVersion)
+		release, err := upgradeClient.Latest(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !upgradeClient.UpdateAvailable(release) {
+			log.Infof("cli version %v is already up to date", strings.TrimSpace(stackVersion))
+			return
+		}
+
+		prompt := promptui.Prompt{
+			Label:     fmt.Sprintf("Do you want to upgrade %v from version %v to %v ", executablePath, strings.TrimSpace(stackVersion), release.Version()),
+			IsConfirm: true,
+		}
+		_, err = prompt.Run()
+		if err != nil {
+			log.Fatalf("exiting: %v", err)
+		}
+
+		log.Infof("downloading version %v and checking its integrity", release.Version())
+		if err := upgradeClient.Upgrade(ctx, release, executablePath); err != nil {
+			log.Fatalf("failed to upgrade cli: %v", err)
+		}
+		log.Infof("upgraded cli to version %v. make sure to run deploy again to update your stack.", release.Version())
+	},
+}
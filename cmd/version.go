@@ -1,18 +1,47 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"github.com/dan-v/rattlesnakeos-stack/internal/templates"
+	"github.com/dan-v/rattlesnakeos-stack/internal/upgrade"
+	"github.com/fatih/color"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"strings"
+)
+
+var (
+	versionCheck bool
 )
 
 func versionInit() {
 	rootCmd.AddCommand(versionCmd)
+
+	versionCmd.Flags().BoolVar(&versionCheck, "check", false, "check if a newer version of the cli is available")
 }
 
 var versionCmd = &cobra.Command{
 	Use:   "version",
 	Short: "print the cli version",
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println(stackVersion)
+		fmt.Println(strings.TrimSpace(stackVersion))
+		if !versionCheck {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), upgrade.DefaultCheckTimeout)
+		defer cancel()
+
+		upgradeClient := upgrade.New(templates.DefaultRattlesnakeOSStackReleaseURL, stackVersion)
+		release, err := upgradeClient.Latest(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !upgradeClient.UpdateAvailable(release) {
+			color.Green("cli is up to date")
+			return
+		}
+		color.Yellow("version %v is available (%v). run 'rattlesnakeos-stack upgrade' to install it.", release.Version(), release.HTMLURL)
 	},
 }
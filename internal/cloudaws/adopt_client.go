@@ -0,0 +1,273 @@
+package cloudaws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/smithy-go"
+	"github.com/dan-v/rattlesnakeos-stack/internal/stack"
+	"strings"
+)
+
+const (
+	buildScriptKey = "build.sh"
+)
+
+// stackRoles are the IAM roles in the terraform template, along with their inline policies
+var stackRoles = []struct {
+	suffix        string
+	roleAddress   string
+	policyAddress string
+}{
+	{suffix: "ec2", roleAddress: "aws_iam_role.rattlesnake_ec2_role", policyAddress: "aws_iam_role_policy.rattlesnake_ec2_policy"},
+	{suffix: "lambda", roleAddress: "aws_iam_role.rattlesnake_lambda_role", policyAddress: "aws_iam_role_policy.rattlesnake_lambda_policy"},
+}
+
+// stackBuckets are the S3 buckets in the terraform template. The configuration resources of each bucket use the same
+// resource name as the bucket. Buckets in storage are left out of the template if an S3 compatible service is used.
+var stackBuckets = []struct {
+	suffix            string
+	resourceName      string
+	ownershipControls bool
+	inStorage         bool
+}{
+	{suffix: "keys", resourceName: "rattlesnake_s3_keys", inStorage: true},
+	{suffix: "keys-encrypted", resourceName: "rattlesnake_s3_keys_enc"},
+	{suffix: "logs", resourceName: "rattlesnake_s3_logs", inStorage: true},
+	{suffix: "release", resourceName: "rattlesnake_s3_release", ownershipControls: true, inStorage: true},
+	{suffix: "script", resourceName: "rattlesnake_s3_script"},
+}
+
+// AdoptClient finds the existing resources of a stack, named the way the terraform template names them, so they can be
+// imported into terraform state
+type AdoptClient struct {
+	awsConfig        aws.Config
+	name             string
+	region           string
+	scheduledDevices []string
+	storage          *Storage
+}
+
+// NewAdoptClient returns an initialized AdoptClient. scheduledDevices are the devices that have a build schedule.
+func NewAdoptClient(name, region string, scheduledDevices []string, storage *Storage) (*AdoptClient, error) {
+	cfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load default aws config: %w", err)
+	}
+
+	return &AdoptClient{
+		awsConfig:        cfg,
+		name:             name,
+		region:           region,
+		scheduledDevices: scheduledDevices,
+		storage:          storage,
+	}, nil
+}
+
+// Adoptable returns the terraform address and import id of every resource in the terraform template that exists
+func (c *AdoptClient) Adoptable(ctx context.Context) ([]*stack.Resource, error) {
+	var resources []*stack.Resource
+	for _, find := range []func(ctx context.Context) ([]*stack.Resource, error){
+		c.iamResources,
+		c.s3Resources,
+		c.snsResources,
+		c.lambdaResources,
+	} {
+		found, err := find(ctx)
+		if err != nil {
+			return nil, err
+		}
+		resources = append(resources, found...)
+	}
+	return resources, nil
+}
+
+func (c *AdoptClient) iamResources(ctx context.Context) ([]*stack.Resource, error) {
+	var resources []*stack.Resource
+	iamClient := iam.NewFromConfig(c.awsConfig)
+	for _, role := range stackRoles {
+		roleName := fmt.Sprintf("%v-%v", c.name, role.suffix)
+		_, err := iamClient.GetRole(ctx, &iam.GetRoleInput{RoleName: aws.String(roleName)})
+		if err != nil {
+			if isAPIErrorCode(err, "NoSuchEntity") {
+				continue
+			}
+			return nil, fmt.Errorf("failed to get iam role %v: %w", roleName, err)
+		}
+		resources = append(resources, adoptable(role.roleAddress, roleName))
+
+		policyName := fmt.Sprintf("%v-policy", roleName)
+		_, err = iamClient.GetRolePolicy(ctx, &iam.GetRolePolicyInput{
+			RoleName:   aws.String(roleName),
+			PolicyName: aws.String(policyName),
+		})
+		if err != nil {
+			if isAPIErrorCode(err, "NoSuchEntity") {
+				continue
+			}
+			return nil, fmt.Errorf("failed to get iam role policy %v: %w", policyName, err)
+		}
+		resources = append(resources, adoptable(role.policyAddress, fmt.Sprintf("%v:%v", roleName, policyName)))
+	}
+
+	profileName := fmt.Sprintf("%v-ec2", c.name)
+	_, err := iamClient.GetInstanceProfile(ctx, &iam.GetInstanceProfileInput{InstanceProfileName: aws.String(profileName)})
+	if err != nil {
+		if isAPIErrorCode(err, "NoSuchEntity") {
+			return resources, nil
+		}
+		return nil, fmt.Errorf("failed to get iam instance profile %v: %w", profileName, err)
+	}
+	return append(resources, adoptable("aws_iam_instance_profile.rattlesnake_ec2_role", profileName)), nil
+}
+
+func (c *AdoptClient) s3Resources(ctx context.Context) ([]*stack.Resource, error) {
+	var resources []*stack.Resource
+	s3Client := s3.NewFromConfig(c.awsConfig)
+	for _, bucket := range stackBuckets {
+		if bucket.inStorage && !c.storage.IsAWS() {
+			continue
+		}
+		bucketName := fmt.Sprintf("%v-%v", c.name, bucket.suffix)
+		_, err := s3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucketName)})
+		if err != nil {
+			if isAPIErrorCode(err, "NotFound") {
+				continue
+			}
+			return nil, fmt.Errorf("unknown S3 error for bucket %v: %w", bucketName, err)
+		}
+		resources = append(resources, adoptable("aws_s3_bucket."+bucket.resourceName, bucketName))
+
+		_, err = s3Client.GetBucketEncryption(ctx, &s3.GetBucketEncryptionInput{Bucket: aws.String(bucketName)})
+		if err == nil {
+			resources = append(resources, adoptable("aws_s3_bucket_server_side_encryption_configuration."+bucket.resourceName, bucketName))
+		} else if !isAPIErrorCode(err, "ServerSideEncryptionConfigurationNotFoundError") {
+			return nil, fmt.Errorf("failed to get encryption of bucket %v: %w", bucketName, err)
+		}
+
+		_, err = s3Client.GetPublicAccessBlock(ctx, &s3.GetPublicAccessBlockInput{Bucket: aws.String(bucketName)})
+		if err == nil {
+			resources = append(resources, adoptable("aws_s3_bucket_public_access_block."+bucket.resourceName, bucketName))
+		} else if !isAPIErrorCode(err, "NoSuchPublicAccessBlockConfiguration") {
+			return nil, fmt.Errorf("failed to get public access block of bucket %v: %w", bucketName, err)
+		}
+
+		if bucket.ownershipControls {
+			_, err = s3Client.GetBucketOwnershipControls(ctx, &s3.GetBucketOwnershipControlsInput{Bucket: aws.String(bucketName)})
+			if err == nil {
+				resources = append(resources, adoptable("aws_s3_bucket_ownership_controls."+bucket.resourceName, bucketName))
+			} else if !isAPIErrorCode(err, "OwnershipControlsNotFoundError") {
+				return nil, fmt.Errorf("failed to get ownership controls of bucket %v: %w", bucketName, err)
+			}
+		}
+	}
+
+	scriptBucket := fmt.Sprintf("%v-script", c.name)
+	_, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(scriptBucket), Key: aws.String(buildScriptKey)})
+	if err != nil {
+		if isAPIErrorCode(err, "NotFound", "NoSuchBucket") {
+			return resources, nil
+		}
+		return nil, fmt.Errorf("failed to get %v from bucket %v: %w", buildScriptKey, scriptBucket, err)
+	}
+	return append(resources, adoptable("aws_s3_object.rattlesnake_s3_script_file", fmt.Sprintf("%v/%v", scriptBucket, buildScriptKey))), nil
+}
+
+func (c *AdoptClient) snsResources(ctx context.Context) ([]*stack.Resource, error) {
+	snsClient := sns.NewFromConfig(c.awsConfig)
+	paginator := sns.NewListTopicsPaginator(snsClient, &sns.ListTopicsInput{})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list sns topics: %w", err)
+		}
+		for _, topic := range page.Topics {
+			if c.name == strings.Split(*topic.TopicArn, ":")[5] {
+				return []*stack.Resource{adoptable("aws_sns_topic.rattlesnake", *topic.TopicArn)}, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// lambdaResources returns the lambda function and, for scheduled devices, its build schedule resources. There is no
+// direct check for the schedule rules and targets, so they are adopted if the permission allowing the rule to invoke
+// the function exists, as all three are created together.
+func (c *AdoptClient) lambdaResources(ctx context.Context) ([]*stack.Resource, error) {
+	lambdaClient := lambda.NewFromConfig(c.awsConfig)
+	_, err := lambdaClient.GetFunction(ctx, &lambda.GetFunctionInput{FunctionName: aws.String(c.name)})
+	if err != nil {
+		if isAPIErrorCode(err, "ResourceNotFoundException") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get lambda function %v: %w", c.name, err)
+	}
+	resources := []*stack.Resource{adoptable("aws_lambda_function.rattlesnake_lambda_build", c.name)}
+
+	if len(c.scheduledDevices) == 0 {
+		return resources, nil
+	}
+	output, err := lambdaClient.GetPolicy(ctx, &lambda.GetPolicyInput{FunctionName: aws.String(c.name)})
+	if err != nil {
+		if isAPIErrorCode(err, "ResourceNotFoundException") {
+			return resources, nil
+		}
+		return nil, fmt.Errorf("failed to get policy of lambda function %v: %w", c.name, err)
+	}
+	policy := struct {
+		Statement []struct {
+			Sid string
+		}
+	}{}
+	if err := json.Unmarshal([]byte(aws.ToString(output.Policy)), &policy); err != nil {
+		return nil, fmt.Errorf("failed to parse policy of lambda function %v: %w", c.name, err)
+	}
+	statements := map[string]bool{}
+	for _, statement := range policy.Statement {
+		statements[statement.Sid] = true
+	}
+
+	for _, device := range c.scheduledDevices {
+		statementID := fmt.Sprintf("AllowExecutionFromCloudWatch-%v", device)
+		if !statements[statementID] {
+			continue
+		}
+		ruleName := fmt.Sprintf("%v-build-schedule-%v", c.name, device)
+		resources = append(resources,
+			adoptable("aws_cloudwatch_event_rule.build_schedule_"+device, ruleName),
+			adoptable("aws_cloudwatch_event_target.check_build_schedule_"+device, fmt.Sprintf("%v/%v-%v", ruleName, c.name, device)),
+			adoptable("aws_lambda_permission.allow_cloudwatch_to_call_build_schedule_"+device, fmt.Sprintf("%v/%v", c.name, statementID)),
+		)
+	}
+	return resources, nil
+}
+
+func adoptable(address, id string) *stack.Resource {
+	return &stack.Resource{
+		Address:   address,
+		Type:      strings.SplitN(address, ".", 2)[0],
+		ID:        id,
+		ManagedBy: stack.ManagedByTerraform,
+	}
+}
+
+// isAPIErrorCode returns whether err is an aws api error with one of codes
+func isAPIErrorCode(err error, codes ...string) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	for _, code := range codes {
+		if apiErr.ErrorCode() == code {
+			return true
+		}
+	}
+	return false
+}
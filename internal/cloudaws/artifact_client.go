@@ -0,0 +1,125 @@
+package cloudaws
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+const (
+	deployedArtifactsPrefix = "deployed/"
+)
+
+// ArtifactClient keeps the rendered files of the last successful deploy in the stack bucket, next to the config backup
+type ArtifactClient struct {
+	awsConfig aws.Config
+	name      string
+}
+
+// NewArtifactClient returns an initialized ArtifactClient
+func NewArtifactClient(name, region string) (*ArtifactClient, error) {
+	cfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load default aws config: %w", err)
+	}
+
+	return &ArtifactClient{
+		awsConfig: cfg,
+		name:      name,
+	}, nil
+}
+
+// Save replaces the stored artifacts with artifacts
+func (c *ArtifactClient) Save(ctx context.Context, artifacts map[string][]byte) error {
+	s3Client := s3.NewFromConfig(c.awsConfig)
+
+	existing, err := c.keys(ctx, s3Client)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for name := range artifacts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		key := deployedArtifactsPrefix + name
+		_, err := s3Client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:               aws.String(c.name),
+			Key:                  aws.String(key),
+			Body:                 bytes.NewReader(artifacts[name]),
+			ContentLength:        int64(len(artifacts[name])),
+			ContentType:          aws.String("text/plain"),
+			ServerSideEncryption: s3types.ServerSideEncryptionAes256,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to save %v to bucket %v: %w", key, c.name, err)
+		}
+	}
+
+	for _, key := range existing {
+		if _, ok := artifacts[strings.TrimPrefix(key, deployedArtifactsPrefix)]; ok {
+			continue
+		}
+		_, err := s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(c.name), Key: aws.String(key)})
+		if err != nil {
+			return fmt.Errorf("failed to delete %v from bucket %v: %w", key, c.name, err)
+		}
+	}
+	return nil
+}
+
+// Last returns the artifacts of the last successful deploy, or no artifacts if the stack hasn't been deployed yet
+func (c *ArtifactClient) Last(ctx context.Context) (map[string][]byte, error) {
+	s3Client := s3.NewFromConfig(c.awsConfig)
+
+	keys, err := c.keys(ctx, s3Client)
+	if err != nil {
+		return nil, err
+	}
+
+	artifacts := map[string][]byte{}
+	for _, key := range keys {
+		output, err := s3Client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(c.name), Key: aws.String(key)})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get %v from bucket %v: %w", key, c.name, err)
+		}
+		contents, err := ioutil.ReadAll(output.Body)
+		_ = output.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %v from bucket %v: %w", key, c.name, err)
+		}
+		artifacts[strings.TrimPrefix(key, deployedArtifactsPrefix)] = contents
+	}
+	return artifacts, nil
+}
+
+// keys returns the keys of the stored artifacts
+func (c *ArtifactClient) keys(ctx context.Context, s3Client *s3.Client) ([]string, error) {
+	var keys []string
+	paginator := s3.NewListObjectsV2Paginator(s3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(c.name),
+		Prefix: aws.String(deployedArtifactsPrefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			if isAPIErrorCode(err, "NoSuchBucket") {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("failed to list artifacts in bucket %v: %w", c.name, err)
+		}
+		for _, object := range page.Contents {
+			keys = append(keys, aws.ToString(object.Key))
+		}
+	}
+	return keys, nil
+}
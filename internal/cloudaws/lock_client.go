@@ -0,0 +1,354 @@
+package cloudaws
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/dan-v/rattlesnakeos-stack/internal/terraform"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+const (
+	stackLockKey = "stack.lock"
+)
+
+var (
+	// ErrStackLocked is returned if the stack lock is already held
+	ErrStackLocked = errors.New("stack is locked")
+	// errLockExists is returned by a lockStore if the lock was created by someone else
+	errLockExists = errors.New("lock already exists")
+	// errLockChanged is returned by a lockStore if the lock was replaced since it was read
+	errLockChanged = errors.New("lock changed since it was read")
+)
+
+// LockInfo describes the holder of a stack lock
+type LockInfo struct {
+	// ID uniquely identifies the lock so that a holder only ever releases its own lock
+	ID string `json:"id"`
+	// Holder is who acquired the lock (e.g. user@hostname)
+	Holder string `json:"holder"`
+	// Operation is what the holder is doing with the stack (e.g. deploy)
+	Operation string `json:"operation"`
+	// Since is when the lock was acquired
+	Since time.Time `json:"since"`
+}
+
+// lockStore reads and writes the lock object of a stack
+type lockStore interface {
+	// prepare ensures the lock can be created
+	prepare(ctx context.Context) error
+	// get returns the lock and a version that changes whenever it is replaced, or nil if there is no lock
+	get(ctx context.Context) ([]byte, string, error)
+	// create stores a new lock, or returns errLockExists if there already is one
+	create(ctx context.Context, body []byte) error
+	// delete removes the lock, or returns errLockChanged if version isn't empty and no longer matches the lock
+	delete(ctx context.Context, version string) error
+	// String describes where the lock is stored
+	String() string
+}
+
+// LockClient prevents concurrent changes to a stack using a lock object next to its terraform state, so everyone
+// sharing the state sees the same lock
+type LockClient struct {
+	name   string
+	store  lockStore
+	holder string
+	lockID string
+}
+
+// NewLockClient returns an initialized LockClient for the stack with terraform state in stateBackend. The lock of the
+// local backend is a file in rootDir. The holder is recorded in the lock so others can see who has it.
+func NewLockClient(name string, stateBackend *terraform.Backend, rootDir, holder string) (*LockClient, error) {
+	if stateBackend.Type == terraform.BackendLocal {
+		return &LockClient{
+			name:   name,
+			store:  &fileLockStore{file: filepath.Join(rootDir, stackLockKey)},
+			holder: holder,
+		}, nil
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(stateBackend.Region))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load default aws config: %w", err)
+	}
+	s3Client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		// the same addressing as the terraform s3 backend
+		if stateBackend.Endpoint != "" {
+			o.EndpointResolver = s3.EndpointResolverFromURL(stateBackend.Endpoint)
+			o.UsePathStyle = true
+		}
+	})
+
+	return &LockClient{
+		name: name,
+		store: &s3LockStore{
+			s3Client:     s3Client,
+			bucket:       stateBackend.Bucket,
+			key:          path.Join(path.Dir(stateBackend.Key()), stackLockKey),
+			region:       stateBackend.Region,
+			createBucket: stateBackend.IsAWS(),
+		},
+		holder: holder,
+	}, nil
+}
+
+// Lock acquires the stack lock for operation. It creates the state bucket in AWS if it doesn't exist yet, as a new
+// stack needs it for terraform anyway, and returns ErrStackLocked if someone else holds the lock.
+func (c *LockClient) Lock(ctx context.Context, operation string) error {
+	if err := c.store.prepare(ctx); err != nil {
+		return err
+	}
+
+	existing, err := c.GetLock(ctx)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return c.lockedError(existing)
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Errorf("failed to generate lock id: %w", err)
+	}
+	lockInfo := &LockInfo{
+		ID:        hex.EncodeToString(id),
+		Holder:    c.holder,
+		Operation: operation,
+		Since:     time.Now().UTC(),
+	}
+	body, err := json.Marshal(lockInfo)
+	if err != nil {
+		return err
+	}
+
+	if err := c.store.create(ctx, body); err != nil {
+		if errors.Is(err, errLockExists) {
+			existing, getErr := c.GetLock(ctx)
+			if getErr == nil && existing != nil {
+				return c.lockedError(existing)
+			}
+			return fmt.Errorf("stack %v: %w", c.name, ErrStackLocked)
+		}
+		return err
+	}
+
+	c.lockID = lockInfo.ID
+	return nil
+}
+
+// Unlock releases the stack lock if it is still held by this client. The lock is only deleted if it wasn't replaced
+// after it was read, so a lock that was force unlocked and taken by someone else is left alone. A missing lock or
+// bucket is not an error, as removing a stack deletes the bucket holding the lock.
+func (c *LockClient) Unlock(ctx context.Context) error {
+	if c.lockID == "" {
+		return nil
+	}
+
+	existing, version, err := c.getLock(ctx)
+	if err != nil {
+		return err
+	}
+	if existing == nil || existing.ID != c.lockID {
+		c.lockID = ""
+		return nil
+	}
+
+	if err := c.store.delete(ctx, version); err != nil && !errors.Is(err, errLockChanged) {
+		return err
+	}
+	c.lockID = ""
+	return nil
+}
+
+// ForceUnlock releases the stack lock regardless of who holds it
+func (c *LockClient) ForceUnlock(ctx context.Context) error {
+	return c.store.delete(ctx, "")
+}
+
+// GetLock returns the current stack lock or nil if the stack isn't locked
+func (c *LockClient) GetLock(ctx context.Context) (*LockInfo, error) {
+	lockInfo, _, err := c.getLock(ctx)
+	return lockInfo, err
+}
+
+func (c *LockClient) getLock(ctx context.Context) (*LockInfo, string, error) {
+	body, version, err := c.store.get(ctx)
+	if err != nil || body == nil {
+		return nil, "", err
+	}
+	lockInfo := &LockInfo{}
+	if err := json.Unmarshal(body, lockInfo); err != nil {
+		return nil, "", fmt.Errorf("failed to parse lock %v: %w", c.store, err)
+	}
+	return lockInfo, version, nil
+}
+
+func (c *LockClient) lockedError(lockInfo *LockInfo) error {
+	return fmt.Errorf("stack %v is locked by %v for %v since %v. if this lock is stale, remove it with "+
+		"'rattlesnakeos-stack lock force-unlock': %w", c.name, lockInfo.Holder, lockInfo.Operation,
+		lockInfo.Since.Format(time.RFC3339), ErrStackLocked)
+}
+
+// s3LockStore keeps the lock in the bucket that holds terraform state, with the etag of the lock as its version
+type s3LockStore struct {
+	s3Client     *s3.Client
+	bucket       string
+	key          string
+	region       string
+	createBucket bool
+}
+
+func (s *s3LockStore) prepare(ctx context.Context) error {
+	if !s.createBucket {
+		return nil
+	}
+	return createBucketIfMissing(ctx, s.s3Client, s.bucket, s.region)
+}
+
+func (s *s3LockStore) get(ctx context.Context) ([]byte, string, error) {
+	output, err := s.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key),
+	})
+	if err != nil {
+		var noSuchKey *s3types.NoSuchKey
+		var noSuchBucket *s3types.NoSuchBucket
+		if errors.As(err, &noSuchKey) || errors.As(err, &noSuchBucket) {
+			return nil, "", nil
+		}
+		return nil, "", fmt.Errorf("failed to get lock %v: %w", s, err)
+	}
+	defer func() {
+		_ = output.Body.Close()
+	}()
+
+	body, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read lock %v: %w", s, err)
+	}
+	return body, aws.ToString(output.ETag), nil
+}
+
+func (s *s3LockStore) create(ctx context.Context, body []byte) error {
+	// if-none-match makes the put fail if another holder created the lock since it was checked
+	_, err := s.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(s.key),
+		Body:                 bytes.NewReader(body),
+		ContentLength:        int64(len(body)),
+		ContentType:          aws.String("application/json"),
+		ServerSideEncryption: s3types.ServerSideEncryptionAes256,
+	}, s3.WithAPIOptions(smithyhttp.AddHeaderValue("If-None-Match", "*")))
+	if err != nil {
+		if isPreconditionFailed(err) {
+			return errLockExists
+		}
+		return fmt.Errorf("failed to create lock %v: %w", s, err)
+	}
+	return nil
+}
+
+func (s *s3LockStore) delete(ctx context.Context, version string) error {
+	var optFns []func(*s3.Options)
+	if version != "" {
+		// if-match makes the delete fail if the lock was replaced since it was read
+		optFns = append(optFns, s3.WithAPIOptions(smithyhttp.AddHeaderValue("If-Match", version)))
+	}
+	_, err := s.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key),
+	}, optFns...)
+	if err != nil {
+		var noSuchBucket *s3types.NoSuchBucket
+		if errors.As(err, &noSuchBucket) {
+			return nil
+		}
+		if isPreconditionFailed(err) {
+			return errLockChanged
+		}
+		return fmt.Errorf("failed to delete lock %v: %w", s, err)
+	}
+	return nil
+}
+
+func (s *s3LockStore) String() string {
+	return fmt.Sprintf("s3://%v/%v", s.bucket, s.key)
+}
+
+// fileLockStore keeps the lock in a file next to local terraform state, with a hash of the lock as its version
+type fileLockStore struct {
+	file string
+}
+
+func (s *fileLockStore) prepare(ctx context.Context) error {
+	return os.MkdirAll(filepath.Dir(s.file), 0700)
+}
+
+func (s *fileLockStore) get(ctx context.Context) ([]byte, string, error) {
+	body, err := ioutil.ReadFile(s.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, "", nil
+		}
+		return nil, "", fmt.Errorf("failed to read lock %v: %w", s, err)
+	}
+	hash := sha256.Sum256(body)
+	return body, hex.EncodeToString(hash[:]), nil
+}
+
+func (s *fileLockStore) create(ctx context.Context, body []byte) error {
+	file, err := os.OpenFile(s.file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			return errLockExists
+		}
+		return fmt.Errorf("failed to create lock %v: %w", s, err)
+	}
+	if _, err := file.Write(body); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to write lock %v: %w", s, err)
+	}
+	return file.Close()
+}
+
+func (s *fileLockStore) delete(ctx context.Context, version string) error {
+	if version != "" {
+		_, current, err := s.get(ctx)
+		if err != nil {
+			return err
+		}
+		if current != version {
+			return errLockChanged
+		}
+	}
+	if err := os.Remove(s.file); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete lock %v: %w", s, err)
+	}
+	return nil
+}
+
+func (s *fileLockStore) String() string {
+	return s.file
+}
+
+// isPreconditionFailed returns whether err is from a conditional request whose condition didn't match
+func isPreconditionFailed(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && (apiErr.ErrorCode() == "PreconditionFailed" || apiErr.ErrorCode() == "ConditionalRequestConflict")
+}
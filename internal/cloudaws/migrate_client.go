@@ -0,0 +1,328 @@
+package cloudaws
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	allUsersGroupURI = "http://acs.amazonaws.com/groups/global/AllUsers"
+	// maxCopyObjectSize is the largest object that can be copied with a single CopyObject request
+	maxCopyObjectSize = 5 * 1024 * 1024 * 1024
+	// minCopyPartSize is the smallest part size for copying larger objects. Parts get bigger for very large objects,
+	// as an upload can have at most maxCopyParts parts.
+	minCopyPartSize = 512 * 1024 * 1024
+	maxCopyParts    = 10000
+)
+
+var (
+	// ErrKeyMismatch is returned if a signing key differs between the old and new stack after copying
+	ErrKeyMismatch = errors.New("signing key mismatch")
+	// ErrNoKeys is returned if the old stack doesn't have any signing keys to migrate
+	ErrNoKeys = errors.New("no signing keys found")
+	// ErrMissingKey is returned if a device in the old stack is missing one of its signing keys
+	ErrMissingKey = errors.New("signing key missing")
+)
+
+// verifiedKeyFiles are the files in each device directory of the keys bucket that must match after migrating. The
+// avb key is used to verify boot and the releasekey signs OTA updates, so a mismatch would stop devices from
+// accepting updates from the new stack.
+var verifiedKeyFiles = []string{"avb.pem", "avb_pkmd.bin", "releasekey.pk8", "releasekey.x509.pem"}
+
+// MigrateClient copies signing keys and release metadata from one stack to another
+type MigrateClient struct {
+	fromS3Client     *s3.Client
+	toS3Client       *s3.Client
+	fromName         string
+	toName           string
+	allowMissingKeys bool
+}
+
+// NewMigrateClient returns an initialized MigrateClient that copies from stack fromName in fromRegion to stack
+// toName in toRegion. Verifying keys fails if a device in the old stack is missing one of its signing keys, unless
+// allowMissingKeys is true.
+func NewMigrateClient(fromName, fromRegion, toName, toRegion string, allowMissingKeys bool) (*MigrateClient, error) {
+	fromCfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(fromRegion))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load default aws config: %w", err)
+	}
+	toCfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(toRegion))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load default aws config: %w", err)
+	}
+
+	return &MigrateClient{
+		fromS3Client:     s3.NewFromConfig(fromCfg),
+		toS3Client:       s3.NewFromConfig(toCfg),
+		fromName:         fromName,
+		toName:           toName,
+		allowMissingKeys: allowMissingKeys,
+	}, nil
+}
+
+// CheckKeys ensures the old stack has signing keys to migrate
+func (c *MigrateClient) CheckKeys(ctx context.Context) error {
+	objects, err := c.listObjects(ctx, c.fromS3Client, fmt.Sprintf("%v-keys", c.fromName))
+	if err != nil {
+		return err
+	}
+	if len(objects) == 0 {
+		return fmt.Errorf("bucket %v-keys: %w", c.fromName, ErrNoKeys)
+	}
+	return nil
+}
+
+// CopyKeys copies all signing keys from the old stack keys bucket to the new stack keys bucket
+func (c *MigrateClient) CopyKeys(ctx context.Context) error {
+	return c.copyBucket(ctx, fmt.Sprintf("%v-keys", c.fromName), fmt.Sprintf("%v-keys", c.toName), false)
+}
+
+// CopyRelease copies release metadata and build artifacts from the old stack release bucket to the new stack release
+// bucket. Objects that are publicly readable in the old bucket (e.g. OTA updates) are publicly readable in the new one.
+func (c *MigrateClient) CopyRelease(ctx context.Context) error {
+	return c.copyBucket(ctx, fmt.Sprintf("%v-release", c.fromName), fmt.Sprintf("%v-release", c.toName), true)
+}
+
+// VerifyKeys compares the avb key and releasekey of every device between the old and new stack keys buckets. A
+// device in the old stack that is missing one of them is an error, unless the client allows missing keys.
+func (c *MigrateClient) VerifyKeys(ctx context.Context) error {
+	fromBucket := fmt.Sprintf("%v-keys", c.fromName)
+	toBucket := fmt.Sprintf("%v-keys", c.toName)
+
+	objects, err := c.listObjects(ctx, c.fromS3Client, fromBucket)
+	if err != nil {
+		return err
+	}
+	deviceSet := map[string]bool{}
+	for _, object := range objects {
+		if dir := path.Dir(aws.ToString(object.Key)); dir != "." {
+			deviceSet[dir] = true
+		}
+	}
+	if len(deviceSet) == 0 {
+		return fmt.Errorf("bucket %v: %w", fromBucket, ErrNoKeys)
+	}
+	var deviceDirs []string
+	for dir := range deviceSet {
+		deviceDirs = append(deviceDirs, dir)
+	}
+	sort.Strings(deviceDirs)
+
+	for _, dir := range deviceDirs {
+		for _, file := range verifiedKeyFiles {
+			key := path.Join(dir, file)
+			from, err := c.getObject(ctx, c.fromS3Client, fromBucket, key)
+			if err != nil {
+				return err
+			}
+			to, err := c.getObject(ctx, c.toS3Client, toBucket, key)
+			if err != nil {
+				return err
+			}
+			if from == nil {
+				if c.allowMissingKeys {
+					log.Warnf("%v is missing from bucket %v - skipping it as missing keys are allowed", key, fromBucket)
+					continue
+				}
+				return fmt.Errorf("%v in bucket %v: %w", key, fromBucket, ErrMissingKey)
+			}
+			if to == nil || !bytes.Equal(from, to) {
+				return fmt.Errorf("%v differs between bucket %v and %v: %w", key, fromBucket, toBucket, ErrKeyMismatch)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *MigrateClient) copyBucket(ctx context.Context, fromBucket, toBucket string, preservePublicRead bool) error {
+	objects, err := c.listObjects(ctx, c.fromS3Client, fromBucket)
+	if err != nil {
+		return err
+	}
+
+	for _, object := range objects {
+		key := aws.ToString(object.Key)
+		// no acl is private, which is also the only option for buckets that have acls disabled
+		var acl s3types.ObjectCannedACL
+		if preservePublicRead {
+			public, err := c.isPublicRead(ctx, fromBucket, key)
+			if err != nil {
+				return err
+			}
+			if public {
+				acl = s3types.ObjectCannedACLPublicRead
+			}
+		}
+
+		if object.Size > maxCopyObjectSize {
+			err = c.copyLargeObject(ctx, fromBucket, toBucket, key, object.Size, acl)
+		} else {
+			_, err = c.toS3Client.CopyObject(ctx, &s3.CopyObjectInput{
+				Bucket:               aws.String(toBucket),
+				Key:                  aws.String(key),
+				CopySource:           aws.String(copySource(fromBucket, key)),
+				ACL:                  acl,
+				ServerSideEncryption: s3types.ServerSideEncryptionAes256,
+			})
+		}
+		if err != nil {
+			return fmt.Errorf("failed to copy %v from bucket %v to %v: %w", key, fromBucket, toBucket, err)
+		}
+	}
+	return nil
+}
+
+// copyLargeObject copies an object that is too large for CopyObject in parts with a multipart upload. Unlike
+// CopyObject, a multipart upload doesn't copy the content type and metadata, so they are copied explicitly.
+func (c *MigrateClient) copyLargeObject(ctx context.Context, fromBucket, toBucket, key string, size int64, acl s3types.ObjectCannedACL) error {
+	head, err := c.fromS3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(fromBucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get details of %v in bucket %v: %w", key, fromBucket, err)
+	}
+
+	upload, err := c.toS3Client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:               aws.String(toBucket),
+		Key:                  aws.String(key),
+		ACL:                  acl,
+		ContentType:          head.ContentType,
+		Metadata:             head.Metadata,
+		ServerSideEncryption: s3types.ServerSideEncryptionAes256,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start multipart upload: %w", err)
+	}
+
+	parts, err := c.copyParts(ctx, fromBucket, toBucket, key, size, upload.UploadId)
+	if err == nil {
+		_, err = c.toS3Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(toBucket),
+			Key:             aws.String(key),
+			UploadId:        upload.UploadId,
+			MultipartUpload: &s3types.CompletedMultipartUpload{Parts: parts},
+		})
+	}
+	if err != nil {
+		// parts of an upload that is never completed are stored until it is aborted
+		_, abortErr := c.toS3Client.AbortMultipartUpload(context.Background(), &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(toBucket),
+			Key:      aws.String(key),
+			UploadId: upload.UploadId,
+		})
+		if abortErr != nil {
+			log.Warnf("failed to abort multipart upload of %v to bucket %v: %v", key, toBucket, abortErr)
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *MigrateClient) copyParts(ctx context.Context, fromBucket, toBucket, key string, size int64, uploadID *string) ([]s3types.CompletedPart, error) {
+	partSize := int64(minCopyPartSize)
+	if size > partSize*maxCopyParts {
+		partSize = (size + maxCopyParts - 1) / maxCopyParts
+	}
+
+	var parts []s3types.CompletedPart
+	for start, partNumber := int64(0), int32(1); start < size; start, partNumber = start+partSize, partNumber+1 {
+		end := start + partSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		output, err := c.toS3Client.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+			Bucket:          aws.String(toBucket),
+			Key:             aws.String(key),
+			UploadId:        uploadID,
+			PartNumber:      partNumber,
+			CopySource:      aws.String(copySource(fromBucket, key)),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%v-%v", start, end)),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to copy part %v: %w", partNumber, err)
+		}
+		parts = append(parts, s3types.CompletedPart{ETag: output.CopyPartResult.ETag, PartNumber: partNumber})
+	}
+	return parts, nil
+}
+
+func (c *MigrateClient) isPublicRead(ctx context.Context, bucket, key string) (bool, error) {
+	output, err := c.fromS3Client.GetObjectAcl(ctx, &s3.GetObjectAclInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to get acl of %v in bucket %v: %w", key, bucket, err)
+	}
+	for _, grant := range output.Grants {
+		if grant.Grantee != nil && aws.ToString(grant.Grantee.URI) == allUsersGroupURI &&
+			(grant.Permission == s3types.PermissionRead || grant.Permission == s3types.PermissionFullControl) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (c *MigrateClient) listObjects(ctx context.Context, s3Client *s3.Client, bucket string) ([]s3types.Object, error) {
+	var objects []s3types.Object
+	paginator := s3.NewListObjectsV2Paginator(s3Client, &s3.ListObjectsV2Input{Bucket: aws.String(bucket)})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects in bucket %v: %w", bucket, err)
+		}
+		objects = append(objects, page.Contents...)
+	}
+	return objects, nil
+}
+
+// getObject returns the contents of key in bucket or nil if it doesn't exist
+func (c *MigrateClient) getObject(ctx context.Context, s3Client *s3.Client, bucket, key string) ([]byte, error) {
+	output, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var noSuchKey *s3types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get %v from bucket %v: %w", key, bucket, err)
+	}
+	defer func() {
+		_ = output.Body.Close()
+	}()
+
+	body, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %v from bucket %v: %w", key, bucket, err)
+	}
+	return body, nil
+}
+
+// copySource returns the copy source of key in bucket
+func copySource(bucket, key string) string {
+	return url.PathEscape(bucket) + "/" + escapeKey(key)
+}
+
+// escapeKey url encodes each part of an object key for use in a copy source
+func escapeKey(key string) string {
+	parts := strings.Split(key, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
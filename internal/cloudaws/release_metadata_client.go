@@ -0,0 +1,56 @@
+package cloudaws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"io/ioutil"
+	"strings"
+)
+
+// ReleaseMetadataClient provides read access to the metadata that builds write to the release bucket
+type ReleaseMetadataClient struct {
+	s3Client *s3.Client
+	bucket   string
+}
+
+// NewReleaseMetadataClient returns an initialized ReleaseMetadataClient for the release bucket in storage
+func NewReleaseMetadataClient(name, region string, storage *Storage) (*ReleaseMetadataClient, error) {
+	s3Client, err := storage.newS3Client(context.Background(), region)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ReleaseMetadataClient{
+		s3Client: s3Client,
+		bucket:   fmt.Sprintf("%v-release", name),
+	}, nil
+}
+
+// GetMetadata returns the metadata value stored at key in the release bucket. If the key doesn't exist, an empty
+// value is returned with no error.
+func (c *ReleaseMetadataClient) GetMetadata(ctx context.Context, key string) (string, error) {
+	output, err := c.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var noSuchKey *s3types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to get metadata %v from bucket %v: %w", key, c.bucket, err)
+	}
+	defer func() {
+		_ = output.Body.Close()
+	}()
+
+	value, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read metadata %v from bucket %v: %w", key, c.bucket, err)
+	}
+	return strings.TrimSpace(string(value)), nil
+}
@@ -3,15 +3,22 @@ package cloudaws
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	cloudwatchlogstypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
 	"github.com/aws/aws-sdk-go-v2/service/iam"
 	iamtypes "github.com/aws/aws-sdk-go-v2/service/iam/types"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/dan-v/rattlesnakeos-stack/internal/stack"
+	"github.com/dan-v/rattlesnakeos-stack/internal/terraform"
+	log "github.com/sirupsen/logrus"
 	"net/http"
+	"net/url"
 	"os"
 	"time"
 )
@@ -21,30 +28,59 @@ const (
 	DefaultInstanceRegions = "us-west-2,us-west-1,us-east-2"
 )
 
+// serviceLinkedRoles are the service linked roles created by setup
+var serviceLinkedRoles = []struct {
+	service  string
+	roleName string
+}{
+	{service: "spot.amazonaws.com", roleName: "AWSServiceRoleForEC2Spot"},
+	{service: "spotfleet.amazonaws.com", roleName: "AWSServiceRoleForEC2SpotFleet"},
+}
+
+const (
+	legacyTerraformStateBackupKey = "terraform.state.0.11-backup"
+)
+
 // SetupClient provides non Terraform cloud specific setup
 type SetupClient struct {
-	awsConfig  aws.Config
-	name       string
-	region     string
-	configFile string
+	awsConfig    aws.Config
+	name         string
+	region       string
+	configFile   string
+	stateBackend *terraform.Backend
+	storage      *Storage
 }
 
-// NewSetupClient returns an initialized SetupClient
-func NewSetupClient(name, region, configFile string) (*SetupClient, error) {
+// NewSetupClient returns an initialized SetupClient. The bucket named after the stack is always used for config
+// backups, while terraform state and the stack lock are stored in stateBackend. If storage is an S3 compatible service,
+// setup also creates the keys, logs and release buckets there, as terraform only manages AWS S3 buckets.
+func NewSetupClient(name, region, configFile string, stateBackend *terraform.Backend, storage *Storage) (*SetupClient, error) {
 	cfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(region))
 	if err != nil {
 		return nil, fmt.Errorf("failed to load default aws config: %w", err)
 	}
 
-	if err := checkS3Access(cfg); err != nil {
+	if err := checkS3Access(s3.NewFromConfig(cfg)); err != nil {
 		return nil, err
 	}
 
+	if !storage.IsAWS() {
+		storageS3Client, err := storage.newS3Client(context.Background(), region)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkS3Access(storageS3Client); err != nil {
+			return nil, fmt.Errorf("storage endpoint %v: %w", storage.Endpoint, err)
+		}
+	}
+
 	return &SetupClient{
-		awsConfig:  cfg,
-		name:       name,
-		region:     region,
-		configFile: configFile,
+		awsConfig:    cfg,
+		name:         name,
+		region:       region,
+		configFile:   configFile,
+		stateBackend: stateBackend,
+		storage:      storage,
 	}, nil
 }
 
@@ -53,6 +89,12 @@ func (c *SetupClient) Setup(ctx context.Context) error {
 	if err := c.s3BucketSetup(ctx); err != nil {
 		return err
 	}
+	if err := c.stateBucketSetup(ctx); err != nil {
+		return err
+	}
+	if err := c.storageBucketsSetup(ctx); err != nil {
+		return err
+	}
 	if err := c.backupConfigFile(ctx); err != nil {
 		return err
 	}
@@ -62,9 +104,212 @@ func (c *SetupClient) Setup(ctx context.Context) error {
 	return nil
 }
 
-func (c *SetupClient) s3BucketSetup(ctx context.Context) error {
+// BackupState keeps an untouched copy of terraform state that would be changed in place by the next terraform run. It
+// doesn't create anything else, so it is safe to run before changes are approved.
+func (c *SetupClient) BackupState(ctx context.Context) error {
+	return c.backupLegacyTerraformState(ctx)
+}
+
+// Teardown removes all the non Terraform cloud specific resources created by Setup or by running the stack
+func (c *SetupClient) Teardown(ctx context.Context) error {
+	if err := c.lambdaLogGroupTeardown(ctx); err != nil {
+		return err
+	}
+	if err := c.s3BucketTeardown(ctx); err != nil {
+		return err
+	}
+	if err := c.stateTeardown(ctx); err != nil {
+		return err
+	}
+	if err := c.storageBucketsTeardown(ctx); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ExcludedResources returns the terraform addresses of the buckets that are left out of terraform config because they
+// are kept in a storage endpoint. A stack that used to keep them in AWS S3 still has them in state.
+func (c *SetupClient) ExcludedResources() []string {
+	if c.storage.IsAWS() {
+		return nil
+	}
+	return storageBucketAddresses
+}
+
+// Resources returns the resources created by Setup that still exist. Service linked roles are shared by everything
+// in the account, so they are never removed by Teardown.
+func (c *SetupClient) Resources(ctx context.Context) ([]*stack.Resource, error) {
+	var resources []*stack.Resource
+
 	s3Client := s3.NewFromConfig(c.awsConfig)
 	_, err := s3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: &c.name})
+	if err == nil {
+		purpose := "config backup"
+		if c.usesStackBucketForState() {
+			purpose = "terraform state, stack lock and config backup"
+		}
+		resources = append(resources, &stack.Resource{
+			Address:   fmt.Sprintf("setup.aws_s3_bucket.%v", c.name),
+			Type:      "aws_s3_bucket",
+			ID:        c.name,
+			Region:    c.region,
+			ManagedBy: stack.ManagedBySetup,
+			Attributes: map[string]string{
+				"bucket":  c.name,
+				"purpose": purpose,
+			},
+		})
+	} else {
+		var notFound *s3types.NotFound
+		if !errors.As(err, &notFound) {
+			return nil, fmt.Errorf("unknown S3 error: %w", err)
+		}
+	}
+
+	if !c.storage.IsAWS() {
+		storageS3Client, err := c.storage.newS3Client(ctx, c.region)
+		if err != nil {
+			return nil, err
+		}
+		for _, bucket := range storageBuckets(c.name) {
+			_, err := storageS3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucket)})
+			if err != nil {
+				var notFound *s3types.NotFound
+				if errors.As(err, &notFound) {
+					continue
+				}
+				return nil, fmt.Errorf("unknown S3 error for bucket %v at %v: %w", bucket, c.storage.Endpoint, err)
+			}
+			resources = append(resources, &stack.Resource{
+				Address:   fmt.Sprintf("setup.aws_s3_bucket.%v", bucket),
+				Type:      "aws_s3_bucket",
+				ID:        bucket,
+				Region:    c.region,
+				ManagedBy: stack.ManagedBySetup,
+				Attributes: map[string]string{
+					"bucket":   bucket,
+					"endpoint": c.storage.Endpoint,
+				},
+			})
+		}
+	}
+
+	iamClient := iam.NewFromConfig(c.awsConfig)
+	for _, role := range serviceLinkedRoles {
+		roleName := role.roleName
+		output, err := iamClient.GetRole(ctx, &iam.GetRoleInput{RoleName: aws.String(roleName)})
+		if err != nil {
+			var noSuchEntity *iamtypes.NoSuchEntityException
+			if errors.As(err, &noSuchEntity) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to get service linked role %v: %w", roleName, err)
+		}
+		resources = append(resources, &stack.Resource{
+			Address:   fmt.Sprintf("setup.aws_iam_service_linked_role.%v", roleName),
+			Type:      "aws_iam_service_linked_role",
+			ID:        roleName,
+			Region:    stack.RegionGlobal,
+			ManagedBy: stack.ManagedBySetup,
+			Attributes: map[string]string{
+				"arn":          aws.ToString(output.Role.Arn),
+				"name":         roleName,
+				"service_name": role.service,
+			},
+		})
+	}
+	return resources, nil
+}
+
+func (c *SetupClient) s3BucketSetup(ctx context.Context) error {
+	return createBucketIfMissing(ctx, s3.NewFromConfig(c.awsConfig), c.name, c.region)
+}
+
+// stateBucketSetup creates a shared state bucket in AWS if it's missing. Buckets of S3 compatible services have to be
+// created beforehand.
+func (c *SetupClient) stateBucketSetup(ctx context.Context) error {
+	if !c.stateBackend.IsAWS() || c.stateBackend.Bucket == c.name {
+		return nil
+	}
+	return createBucketIfMissing(ctx, c.stateS3Client(), c.stateBackend.Bucket, c.stateBackend.Region)
+}
+
+// stateTeardown removes the state object of the stack from a shared state bucket in AWS, leaving the bucket for
+// other stacks
+func (c *SetupClient) stateTeardown(ctx context.Context) error {
+	if !c.stateBackend.IsAWS() || c.stateBackend.Bucket == c.name {
+		return nil
+	}
+	_, err := c.stateS3Client().DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(c.stateBackend.Bucket),
+		Key:    aws.String(c.stateBackend.Key()),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete terraform state %v: %w", c.stateBackend, err)
+	}
+	return nil
+}
+
+// storageBucketsSetup creates the keys, logs and release buckets in an S3 compatible service if they're missing, and
+// makes the release bucket publicly readable so devices can download OTA updates from it
+func (c *SetupClient) storageBucketsSetup(ctx context.Context) error {
+	if c.storage.IsAWS() {
+		return nil
+	}
+	storageS3Client, err := c.storage.newS3Client(ctx, c.region)
+	if err != nil {
+		return err
+	}
+	for _, bucket := range storageBuckets(c.name) {
+		if err := createBucketIfMissing(ctx, storageS3Client, bucket, ""); err != nil {
+			return err
+		}
+	}
+
+	releaseBucket := fmt.Sprintf("%v-release", c.name)
+	_, err = storageS3Client.PutBucketPolicy(ctx, &s3.PutBucketPolicyInput{
+		Bucket: aws.String(releaseBucket),
+		Policy: aws.String(fmt.Sprintf(releaseBucketPolicy, releaseBucket)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to make bucket %v at %v publicly readable: %w", releaseBucket, c.storage.Endpoint, err)
+	}
+	return nil
+}
+
+// storageBucketsTeardown removes the keys, logs and release buckets from an S3 compatible service
+func (c *SetupClient) storageBucketsTeardown(ctx context.Context) error {
+	if c.storage.IsAWS() {
+		return nil
+	}
+	storageS3Client, err := c.storage.newS3Client(ctx, c.region)
+	if err != nil {
+		return err
+	}
+	for _, bucket := range storageBuckets(c.name) {
+		if err := deleteBucket(ctx, storageS3Client, bucket); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *SetupClient) stateS3Client() *s3.Client {
+	return s3.NewFromConfig(c.awsConfig, func(o *s3.Options) {
+		o.Region = c.stateBackend.Region
+	})
+}
+
+// usesStackBucketForState returns whether terraform state is stored in the default location in the bucket named
+// after the stack
+func (c *SetupClient) usesStackBucketForState() bool {
+	return c.stateBackend.IsAWS() && c.stateBackend.Bucket == c.name && c.stateBackend.Key() == terraform.StateKey
+}
+
+// createBucketIfMissing creates bucket in region if it doesn't already exist. An empty region creates the bucket in
+// the default location, which S3 compatible services expect.
+func createBucketIfMissing(ctx context.Context, s3Client *s3.Client, bucket, region string) error {
+	_, err := s3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: &bucket})
 	if err != nil {
 		var notFound *s3types.NotFound
 		if !errors.As(err, &notFound) {
@@ -72,22 +317,85 @@ func (c *SetupClient) s3BucketSetup(ctx context.Context) error {
 		}
 
 		bucketInput := &s3.CreateBucketInput{
-			Bucket: &c.name,
+			Bucket: &bucket,
 		}
-		if c.region != "us-east-1" {
+		if region != "" && region != "us-east-1" {
 			bucketInput.CreateBucketConfiguration = &s3types.CreateBucketConfiguration{
-				LocationConstraint: s3types.BucketLocationConstraint(c.region),
+				LocationConstraint: s3types.BucketLocationConstraint(region),
 			}
 		}
 
 		output, err := s3Client.CreateBucket(ctx, bucketInput)
 		if err != nil {
-			return fmt.Errorf("failed to create bucket %v - note that this bucket name must be globally unique: output:%v err:%w", c.name, output, err)
+			return fmt.Errorf("failed to create bucket %v - note that this bucket name must be globally unique: output:%v err:%w", bucket, output, err)
 		}
 	}
 	return nil
 }
 
+func (c *SetupClient) s3BucketTeardown(ctx context.Context) error {
+	return deleteBucket(ctx, s3.NewFromConfig(c.awsConfig), c.name)
+}
+
+// deleteBucket deletes all objects in bucket and then the bucket itself, if it exists
+func deleteBucket(ctx context.Context, s3Client *s3.Client, bucket string) error {
+	_, err := s3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: &bucket})
+	if err != nil {
+		var notFound *s3types.NotFound
+		if errors.As(err, &notFound) {
+			return nil
+		}
+		return fmt.Errorf("unknown S3 error: %w", err)
+	}
+
+	paginator := s3.NewListObjectsV2Paginator(s3Client, &s3.ListObjectsV2Input{Bucket: &bucket})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list objects in bucket %v: %w", bucket, err)
+		}
+		if len(page.Contents) == 0 {
+			continue
+		}
+
+		var objects []s3types.ObjectIdentifier
+		for _, object := range page.Contents {
+			objects = append(objects, s3types.ObjectIdentifier{Key: object.Key})
+		}
+		output, err := s3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: &bucket,
+			Delete: &s3types.Delete{Objects: objects, Quiet: true},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete objects in bucket %v: %w", bucket, err)
+		}
+		if len(output.Errors) > 0 {
+			return fmt.Errorf("failed to delete %v objects in bucket %v: first error: %v", len(output.Errors), bucket,
+				aws.ToString(output.Errors[0].Message))
+		}
+	}
+
+	_, err = s3Client.DeleteBucket(ctx, &s3.DeleteBucketInput{Bucket: &bucket})
+	if err != nil {
+		return fmt.Errorf("failed to delete bucket %v: %w", bucket, err)
+	}
+	return nil
+}
+
+func (c *SetupClient) lambdaLogGroupTeardown(ctx context.Context) error {
+	logsClient := cloudwatchlogs.NewFromConfig(c.awsConfig)
+	logGroupName := fmt.Sprintf("/aws/lambda/%v", c.name)
+	_, err := logsClient.DeleteLogGroup(ctx, &cloudwatchlogs.DeleteLogGroupInput{LogGroupName: aws.String(logGroupName)})
+	if err != nil {
+		var notFound *cloudwatchlogstypes.ResourceNotFoundException
+		if errors.As(err, &notFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to delete log group %v: %w", logGroupName, err)
+	}
+	return nil
+}
+
 func (c *SetupClient) backupConfigFile(ctx context.Context) error {
 	s3Client := s3.NewFromConfig(c.awsConfig)
 
@@ -108,7 +416,6 @@ func (c *SetupClient) backupConfigFile(ctx context.Context) error {
 	_, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
 		Bucket:               aws.String(c.name),
 		Key:                  aws.String("stack-config.toml"),
-		ACL:                  s3types.ObjectCannedACLPrivate,
 		Body:                 bytes.NewReader(buffer),
 		ContentLength:        size,
 		ContentType:          aws.String(http.DetectContentType(buffer)),
@@ -118,6 +425,63 @@ func (c *SetupClient) backupConfigFile(ctx context.Context) error {
 	return err
 }
 
+// backupLegacyTerraformState keeps an untouched copy of state written by Terraform 0.11 next to it, as the first run
+// of a newer Terraform version migrates it in place
+func (c *SetupClient) backupLegacyTerraformState(ctx context.Context) error {
+	if !c.usesStackBucketForState() {
+		return nil
+	}
+	s3Client := s3.NewFromConfig(c.awsConfig)
+
+	output, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.name),
+		Key:    aws.String(terraform.StateKey),
+	})
+	if err != nil {
+		var noSuchKey *s3types.NoSuchKey
+		var noSuchBucket *s3types.NoSuchBucket
+		if errors.As(err, &noSuchKey) || errors.As(err, &noSuchBucket) {
+			return nil
+		}
+		return fmt.Errorf("failed to read terraform state: %w", err)
+	}
+	defer output.Body.Close()
+
+	state := struct {
+		Version int `json:"version"`
+	}{}
+	if err := json.NewDecoder(output.Body).Decode(&state); err != nil {
+		return fmt.Errorf("failed to parse terraform state: %w", err)
+	}
+	if state.Version >= 4 {
+		return nil
+	}
+
+	_, err = s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(c.name),
+		Key:    aws.String(legacyTerraformStateBackupKey),
+	})
+	if err == nil {
+		return nil
+	}
+	var notFound *s3types.NotFound
+	if !errors.As(err, &notFound) {
+		return fmt.Errorf("failed to check for terraform state backup: %w", err)
+	}
+
+	_, err = s3Client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:               aws.String(c.name),
+		Key:                  aws.String(legacyTerraformStateBackupKey),
+		CopySource:           aws.String(url.PathEscape(c.name) + "/" + terraform.StateKey),
+		ServerSideEncryption: s3types.ServerSideEncryptionAes256,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to backup terraform state: %w", err)
+	}
+	log.Infof("Backed up terraform 0.11 state to s3://%v/%v before migrating it", c.name, legacyTerraformStateBackupKey)
+	return nil
+}
+
 func (c *SetupClient) serviceLinkedRolesSetup(ctx context.Context) error {
 	iamClient := iam.NewFromConfig(c.awsConfig)
 
@@ -144,11 +508,10 @@ func (c *SetupClient) serviceLinkedRolesSetup(ctx context.Context) error {
 	return nil
 }
 
-func checkS3Access(cfg aws.Config) error {
+func checkS3Access(s3Client *s3.Client) error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
 
-	s3Client := s3.NewFromConfig(cfg)
 	_, err := s3Client.ListBuckets(ctx, &s3.ListBucketsInput{})
 	if err != nil {
 		return fmt.Errorf("unable to list S3 buckets - make sure you have valid admin AWS credentials: %w", err)
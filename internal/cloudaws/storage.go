@@ -0,0 +1,140 @@
+package cloudaws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"net/url"
+	"strings"
+)
+
+var (
+	// ErrInvalidStorage is returned if the storage of a stack is misconfigured
+	ErrInvalidStorage = errors.New("invalid storage")
+)
+
+// storageBucketSuffixes are the buckets of a stack that are kept in Storage
+var storageBucketSuffixes = []string{"keys", "logs", "release"}
+
+// releaseBucketPolicy lets anyone read the objects of the release bucket of a storage endpoint, as OTA updates are
+// uploaded there without object ACLs
+const releaseBucketPolicy = `{
+  "Version": "2012-10-17",
+  "Statement": [
+    {
+      "Effect": "Allow",
+      "Principal": {"AWS": ["*"]},
+      "Action": ["s3:GetObject"],
+      "Resource": ["arn:aws:s3:::%v/*"]
+    }
+  ]
+}`
+
+// storageBucketAddresses are the terraform addresses of the buckets that are kept in Storage when it is AWS S3
+var storageBucketAddresses = []string{
+	"aws_s3_bucket.rattlesnake_s3_keys",
+	"aws_s3_bucket.rattlesnake_s3_logs",
+	"aws_s3_bucket.rattlesnake_s3_release",
+}
+
+// Storage is where the keys, logs and release buckets of a stack are stored. The zero value stores them in AWS S3,
+// while setting Endpoint stores them in an S3 compatible service such as MinIO.
+type Storage struct {
+	// Endpoint is the url of an S3 compatible service to use instead of AWS S3
+	Endpoint string
+	// PathStyle addresses buckets as <endpoint>/<bucket> instead of <bucket>.<endpoint host>
+	PathStyle bool
+	// PublicBaseURL is the url the release bucket is served at for OTA updates, if it isn't served by Endpoint
+	PublicBaseURL string
+	// Profile is the shared config profile with the credentials for Endpoint, or empty to use the default credentials
+	Profile string
+	// CredentialsParameter is the name of an SSM SecureString parameter in the stack region that holds the
+	// credentials for Endpoint as <access key id>:<secret access key>, which is read by build instances and the lambda
+	// function
+	CredentialsParameter string
+}
+
+// IsAWS returns whether the buckets are stored in AWS S3, rather than an S3 compatible service
+func (s Storage) IsAWS() bool {
+	return s.Endpoint == ""
+}
+
+// Validate returns an error if an S3 compatible service is missing required settings
+func (s Storage) Validate() error {
+	if s.IsAWS() {
+		return nil
+	}
+	if err := validateStorageURL(s.Endpoint); err != nil {
+		return fmt.Errorf("%w: storage endpoint %v", err, s.Endpoint)
+	}
+	if s.PublicBaseURL != "" {
+		if err := validateStorageURL(s.PublicBaseURL); err != nil {
+			return fmt.Errorf("%w: storage public url %v", err, s.PublicBaseURL)
+		}
+	}
+	if s.CredentialsParameter == "" {
+		return fmt.Errorf("%w: storage endpoint requires a credentials parameter for build instances", ErrInvalidStorage)
+	}
+	return nil
+}
+
+// ReleaseURL returns the url that devices download OTA updates of stack name from
+func (s Storage) ReleaseURL(name string) string {
+	bucket := fmt.Sprintf("%v-release", name)
+	if s.PublicBaseURL != "" {
+		return strings.TrimSuffix(s.PublicBaseURL, "/")
+	}
+	if s.IsAWS() {
+		return fmt.Sprintf("https://%v.s3.amazonaws.com", bucket)
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(s.Endpoint, "/"))
+	if err != nil {
+		return ""
+	}
+	if s.PathStyle {
+		endpoint.Path += "/" + bucket
+	} else {
+		endpoint.Host = bucket + "." + endpoint.Host
+	}
+	return endpoint.String()
+}
+
+// newS3Client returns a client for the buckets in storage
+func (s Storage) newS3Client(ctx context.Context, region string) (*s3.Client, error) {
+	loadOptions := []func(*config.LoadOptions) error{config.WithRegion(region)}
+	if s.Profile != "" {
+		loadOptions = append(loadOptions, config.WithSharedConfigProfile(s.Profile))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, loadOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load aws config for storage: %w", err)
+	}
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if !s.IsAWS() {
+			o.EndpointResolver = s3.EndpointResolverFromURL(s.Endpoint)
+			o.UsePathStyle = s.PathStyle
+		}
+	}), nil
+}
+
+// storageBuckets returns the names of the buckets of stack name that are kept in storage
+func storageBuckets(name string) []string {
+	var buckets []string
+	for _, suffix := range storageBucketSuffixes {
+		buckets = append(buckets, fmt.Sprintf("%v-%v", name, suffix))
+	}
+	return buckets
+}
+
+func validateStorageURL(rawURL string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidStorage, err)
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" || parsed.Host == "" {
+		return fmt.Errorf("%w: url must start with http:// or https://", ErrInvalidStorage)
+	}
+	return nil
+}
@@ -77,6 +77,48 @@ func (c *SubscribeClient) Subscribe(ctx context.Context) (bool, error) {
 	return false, fmt.Errorf("failed to subscribe to notifications - unable to find topic %v", c.name)
 }
 
+// Unsubscribe looks for a topic with name and removes all confirmed subscriptions from it. If the topic no longer
+// exists, there is nothing to remove and no error is returned.
+func (c *SubscribeClient) Unsubscribe(ctx context.Context) error {
+	snsClient := sns.NewFromConfig(c.cfg)
+	topicsPaginator := sns.NewListTopicsPaginator(snsClient, &sns.ListTopicsInput{})
+	for topicsPaginator.HasMorePages() {
+		topicsPage, err := topicsPaginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list sns topics: %w", err)
+		}
+
+		for _, topic := range topicsPage.Topics {
+			if c.name != strings.Split(*topic.TopicArn, ":")[5] {
+				continue
+			}
+
+			subscriptionsPaginator := sns.NewListSubscriptionsByTopicPaginator(snsClient, &sns.ListSubscriptionsByTopicInput{
+				TopicArn: topic.TopicArn,
+			})
+			for subscriptionsPaginator.HasMorePages() {
+				subscriptionsPage, err := subscriptionsPaginator.NextPage(ctx)
+				if err != nil {
+					return fmt.Errorf("failed to list SNS subscriptions for topic %v: %w", *topic.TopicArn, err)
+				}
+
+				for _, subscription := range subscriptionsPage.Subscriptions {
+					// subscriptions that were never confirmed can't be removed and expire on their own
+					if *subscription.SubscriptionArn == "PendingConfirmation" {
+						continue
+					}
+					_, err := snsClient.Unsubscribe(ctx, &sns.UnsubscribeInput{SubscriptionArn: subscription.SubscriptionArn})
+					if err != nil {
+						return fmt.Errorf("failed to remove SNS subscription %v: %w", *subscription.SubscriptionArn, err)
+					}
+				}
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
 func checkSNSAccess(cfg aws.Config) error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
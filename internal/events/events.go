@@ -0,0 +1,181 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"sync"
+	"time"
+)
+
+// Type is the kind of event
+type Type string
+
+const (
+	// TypePhaseStarted is emitted when a phase of a stack operation starts
+	TypePhaseStarted Type = "phase_started"
+	// TypePhaseFinished is emitted when a phase of a stack operation finishes, successfully or not
+	TypePhaseFinished Type = "phase_finished"
+	// TypeOutput is emitted for every line of output from an external tool (e.g. terraform)
+	TypeOutput Type = "output"
+	// TypeDiff is emitted for every rendered file that differs from the last deploy
+	TypeDiff Type = "diff"
+)
+
+// Event is a single progress update from a stack operation
+type Event struct {
+	// Time is when the event happened
+	Time time.Time `json:"time"`
+	// Type is the kind of event
+	Type Type `json:"type"`
+	// Stack is the name of the stack the event is for
+	Stack string `json:"stack,omitempty"`
+	// Phase is the phase that started or finished
+	Phase string `json:"phase,omitempty"`
+	// Message is a human readable description of the event
+	Message string `json:"message,omitempty"`
+	// Duration is how long the phase took, only set for finished phases
+	Duration time.Duration `json:"-"`
+	// Error is the error the phase finished with, empty on success
+	Error string `json:"error,omitempty"`
+	// Source is the tool that produced an output line (e.g. terraform)
+	Source string `json:"source,omitempty"`
+	// Line is a single line of output
+	Line string `json:"line,omitempty"`
+	// File is the name of the rendered file a diff is for
+	File string `json:"file,omitempty"`
+	// Diff is a unified diff from the last deployed file to the rendered file
+	Diff string `json:"diff,omitempty"`
+}
+
+// MarshalJSON encodes the event with its duration in seconds for finished phases
+func (e Event) MarshalJSON() ([]byte, error) {
+	type event Event
+	out := struct {
+		event
+		DurationSeconds *float64 `json:"duration_seconds,omitempty"`
+	}{event: event(e)}
+	if e.Type == TypePhaseFinished {
+		seconds := e.Duration.Seconds()
+		out.DurationSeconds = &seconds
+	}
+	return json.Marshal(out)
+}
+
+// Sink is an interface for receiving events
+type Sink interface {
+	Emit(event Event)
+}
+
+// LogSink writes events in a human readable format, logging phases and writing output lines and diffs as is
+type LogSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewLogSink returns an initialized LogSink that writes output lines and diffs to w
+func NewLogSink(w io.Writer) *LogSink {
+	return &LogSink{
+		w: w,
+	}
+}
+
+// Emit writes event in a human readable format
+func (s *LogSink) Emit(event Event) {
+	switch event.Type {
+	case TypePhaseStarted:
+		log.Info(event.Message)
+	case TypePhaseFinished:
+		log.Debugf("phase %v for stack %v finished in %v", event.Phase, event.Stack, event.Duration.Round(time.Millisecond))
+	case TypeOutput:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		_, _ = fmt.Fprintln(s.w, event.Line)
+	case TypeDiff:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		_, _ = fmt.Fprint(s.w, event.Diff)
+	}
+}
+
+// JSONSink writes every event as a single line of JSON
+type JSONSink struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+// NewJSONSink returns an initialized JSONSink that writes to w
+func NewJSONSink(w io.Writer) *JSONSink {
+	return &JSONSink{
+		encoder: json.NewEncoder(w),
+	}
+}
+
+// Emit writes event as a line of JSON
+func (s *JSONSink) Emit(event Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.encoder.Encode(event); err != nil {
+		log.Errorf("failed to write event: %v", err)
+	}
+}
+
+// OutputWriter is an io.Writer that emits every complete line written to it as an output event. Close or Flush it
+// once the output is complete, so a last line without a trailing newline isn't lost.
+type OutputWriter struct {
+	mu     sync.Mutex
+	sink   Sink
+	source string
+	buf    bytes.Buffer
+}
+
+// NewOutputWriter returns an initialized OutputWriter that emits lines from source to sink
+func NewOutputWriter(sink Sink, source string) *OutputWriter {
+	return &OutputWriter{
+		sink:   sink,
+		source: source,
+	}
+}
+
+// Write emits every complete line in p. An incomplete last line is held until the rest of it is written.
+func (w *OutputWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf.Write(p)
+	for {
+		i := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if i < 0 {
+			break
+		}
+		w.emit(w.buf.Next(i + 1)[:i])
+	}
+	return len(p), nil
+}
+
+// Flush emits an incomplete last line as if it was complete
+func (w *OutputWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.buf.Len() > 0 {
+		w.emit(w.buf.Next(w.buf.Len()))
+	}
+	return nil
+}
+
+// Close flushes an incomplete last line
+func (w *OutputWriter) Close() error {
+	return w.Flush()
+}
+
+func (w *OutputWriter) emit(line []byte) {
+	w.sink.Emit(Event{
+		Time:   time.Now(),
+		Type:   TypeOutput,
+		Source: w.source,
+		Line:   string(bytes.TrimSuffix(line, []byte("\r"))),
+	})
+}
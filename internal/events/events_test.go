@@ -0,0 +1,140 @@
+package events
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestJSONSink_Emit(t *testing.T) {
+	eventTime := time.Date(2021, 11, 5, 10, 0, 0, 0, time.UTC)
+
+	tests := map[string]struct {
+		event    Event
+		expected string
+	}{
+		"phase started": {
+			event:    Event{Time: eventTime, Type: TypePhaseStarted, Stack: "test", Phase: "deploy", Message: "Deploying stack test"},
+			expected: `{"time":"2021-11-05T10:00:00Z","type":"phase_started","stack":"test","phase":"deploy","message":"Deploying stack test"}` + "\n",
+		},
+		"phase finished includes duration": {
+			event:    Event{Time: eventTime, Type: TypePhaseFinished, Stack: "test", Phase: "deploy", Duration: time.Millisecond * 1500},
+			expected: `{"time":"2021-11-05T10:00:00Z","type":"phase_finished","stack":"test","phase":"deploy","duration_seconds":1.5}` + "\n",
+		},
+		"phase finished includes zero duration and error": {
+			event:    Event{Time: eventTime, Type: TypePhaseFinished, Stack: "test", Phase: "setup", Error: "setup failed"},
+			expected: `{"time":"2021-11-05T10:00:00Z","type":"phase_finished","stack":"test","phase":"setup","error":"setup failed","duration_seconds":0}` + "\n",
+		},
+		"diff": {
+			event:    Event{Time: eventTime, Type: TypeDiff, Stack: "test", File: "build.sh", Diff: "-old\n+new\n"},
+			expected: `{"time":"2021-11-05T10:00:00Z","type":"diff","stack":"test","file":"build.sh","diff":"-old\n+new\n"}` + "\n",
+		},
+		"output line": {
+			event:    Event{Time: eventTime, Type: TypeOutput, Source: "terraform", Line: "Apply complete!"},
+			expected: `{"time":"2021-11-05T10:00:00Z","type":"output","source":"terraform","line":"Apply complete!"}` + "\n",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			NewJSONSink(buf).Emit(tc.event)
+			assert.Equal(t, tc.expected, buf.String())
+		})
+	}
+}
+
+func TestLogSink_Emit(t *testing.T) {
+	tests := map[string]struct {
+		event    Event
+		expected string
+	}{
+		"phase started is only logged": {
+			event:    Event{Type: TypePhaseStarted, Stack: "test", Phase: "deploy", Message: "Deploying stack test"},
+			expected: "",
+		},
+		"diff": {
+			event:    Event{Type: TypeDiff, Stack: "test", File: "build.sh", Diff: "-old\n+new\n"},
+			expected: "-old\n+new\n",
+		},
+		"output line": {
+			event:    Event{Type: TypeOutput, Source: "terraform", Line: "Apply complete!"},
+			expected: "Apply complete!\n",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			NewLogSink(buf).Emit(tc.event)
+			assert.Equal(t, tc.expected, buf.String())
+		})
+	}
+}
+
+func TestOutputWriter_Write(t *testing.T) {
+	tests := map[string]struct {
+		writes   []string
+		close    bool
+		expected []string
+	}{
+		"single line": {
+			writes:   []string{"Apply complete!\n"},
+			expected: []string{"Apply complete!"},
+		},
+		"multiple lines in one write": {
+			writes:   []string{"Initializing...\n\nApply complete!\n"},
+			expected: []string{"Initializing...", "", "Apply complete!"},
+		},
+		"line split across writes": {
+			writes:   []string{"Apply ", "complete!\nDone"},
+			expected: []string{"Apply complete!"},
+		},
+		"windows line endings": {
+			writes:   []string{"Apply complete!\r\n"},
+			expected: []string{"Apply complete!"},
+		},
+		"close emits incomplete last line": {
+			writes:   []string{"Apply complete!\nDone"},
+			close:    true,
+			expected: []string{"Apply complete!", "Done"},
+		},
+		"close without incomplete last line": {
+			writes:   []string{"Apply complete!\n"},
+			close:    true,
+			expected: []string{"Apply complete!"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			sink := &testSink{}
+			w := NewOutputWriter(sink, "terraform")
+			for _, write := range tc.writes {
+				n, err := w.Write([]byte(write))
+				assert.Nil(t, err)
+				assert.Equal(t, len(write), n)
+			}
+			if tc.close {
+				assert.Nil(t, w.Close())
+			}
+
+			var lines []string
+			for _, event := range sink.events {
+				assert.Equal(t, TypeOutput, event.Type)
+				assert.Equal(t, "terraform", event.Source)
+				lines = append(lines, event.Line)
+			}
+			assert.Equal(t, tc.expected, lines)
+		})
+	}
+}
+
+type testSink struct {
+	events []Event
+}
+
+func (s *testSink) Emit(event Event) {
+	s.events = append(s.events, event)
+}
@@ -0,0 +1,96 @@
+package migrate
+
+import (
+	"context"
+	"github.com/dan-v/rattlesnakeos-stack/internal/stack"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+const (
+	// DefaultMigrateTimeout is the default timeout for migrations. Release buckets can contain large build artifacts
+	// that take a while to copy.
+	DefaultMigrateTimeout = time.Minute * 60
+)
+
+// StackDeployer is an interface for deploying a stack
+type StackDeployer interface {
+	Deploy(ctx context.Context, timeout time.Duration, approve func() error) error
+}
+
+// StackRemover is an interface for removing a stack
+type StackRemover interface {
+	Remove(ctx context.Context) error
+}
+
+// KeyCopier is an interface for copying signing keys and release metadata between stacks
+type KeyCopier interface {
+	CheckKeys(ctx context.Context) error
+	CopyKeys(ctx context.Context) error
+	CopyRelease(ctx context.Context) error
+	VerifyKeys(ctx context.Context) error
+}
+
+// Migration moves an existing stack to a new name and/or region while keeping its signing keys
+type Migration struct {
+	fromName       string
+	toName         string
+	newStack       StackDeployer
+	oldStack       StackRemover
+	keyCopier      KeyCopier
+	removeOldStack bool
+}
+
+// New returns an initialized Migration. The old stack is only removed if removeOldStack is true.
+func New(fromName, toName string, newStack StackDeployer, oldStack StackRemover, keyCopier KeyCopier, removeOldStack bool) *Migration {
+	return &Migration{
+		fromName:       fromName,
+		toName:         toName,
+		newStack:       newStack,
+		oldStack:       oldStack,
+		keyCopier:      keyCopier,
+		removeOldStack: removeOldStack,
+	}
+}
+
+// Run deploys the new stack, copies keys and release metadata from the old stack, verifies that the signing keys
+// match, and then optionally removes the old stack
+func (m *Migration) Run(ctx context.Context) error {
+	log.Infof("Checking signing keys exist for stack %v", m.fromName)
+	if err := m.keyCopier.CheckKeys(ctx); err != nil {
+		return err
+	}
+
+	log.Infof("Deploying new stack %v", m.toName)
+	if err := m.newStack.Deploy(ctx, stack.DefaultDeployTimeout, nil); err != nil {
+		return err
+	}
+
+	log.Infof("Copying signing keys from stack %v to %v", m.fromName, m.toName)
+	if err := m.keyCopier.CopyKeys(ctx); err != nil {
+		return err
+	}
+
+	log.Infof("Copying release metadata from stack %v to %v", m.fromName, m.toName)
+	if err := m.keyCopier.CopyRelease(ctx); err != nil {
+		return err
+	}
+
+	log.Infof("Verifying signing keys match between stack %v and %v", m.fromName, m.toName)
+	if err := m.keyCopier.VerifyKeys(ctx); err != nil {
+		return err
+	}
+
+	if !m.removeOldStack {
+		log.Infof("Successfully migrated stack %v to %v - old stack %v was kept", m.fromName, m.toName, m.fromName)
+		return nil
+	}
+
+	log.Infof("Removing old stack %v", m.fromName)
+	if err := m.oldStack.Remove(ctx); err != nil {
+		return err
+	}
+
+	log.Infof("Successfully migrated stack %v to %v and removed old stack", m.fromName, m.toName)
+	return nil
+}
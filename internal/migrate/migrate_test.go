@@ -0,0 +1,139 @@
+package migrate_test
+
+import (
+	"context"
+	"errors"
+	"github.com/dan-v/rattlesnakeos-stack/internal/migrate"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+var (
+	errCheckKeys   = errors.New("check keys error")
+	errDeploy      = errors.New("deploy error")
+	errCopyKeys    = errors.New("copy keys error")
+	errCopyRelease = errors.New("copy release error")
+	errVerifyKeys  = errors.New("verify keys error")
+	errRemove      = errors.New("remove error")
+)
+
+func TestMigration_Run(t *testing.T) {
+	tests := map[string]struct {
+		newStack       *fakeStackDeployer
+		keyCopier      *fakeKeyCopier
+		oldStackErr    error
+		removeOldStack bool
+		expected       error
+		expectRemoved  bool
+	}{
+		"migrate keeping old stack": {
+			newStack:       &fakeStackDeployer{},
+			keyCopier:      &fakeKeyCopier{},
+			removeOldStack: false,
+			expected:       nil,
+			expectRemoved:  false,
+		},
+		"migrate removing old stack": {
+			newStack:       &fakeStackDeployer{},
+			keyCopier:      &fakeKeyCopier{},
+			removeOldStack: true,
+			expected:       nil,
+			expectRemoved:  true,
+		},
+		"missing keys stops before deploy": {
+			newStack:       &fakeStackDeployer{},
+			keyCopier:      &fakeKeyCopier{checkErr: errCheckKeys},
+			removeOldStack: true,
+			expected:       errCheckKeys,
+			expectRemoved:  false,
+		},
+		"deploy error": {
+			newStack:       &fakeStackDeployer{err: errDeploy},
+			keyCopier:      &fakeKeyCopier{},
+			removeOldStack: true,
+			expected:       errDeploy,
+			expectRemoved:  false,
+		},
+		"copy keys error": {
+			newStack:       &fakeStackDeployer{},
+			keyCopier:      &fakeKeyCopier{copyKeysErr: errCopyKeys},
+			removeOldStack: true,
+			expected:       errCopyKeys,
+			expectRemoved:  false,
+		},
+		"copy release error": {
+			newStack:       &fakeStackDeployer{},
+			keyCopier:      &fakeKeyCopier{copyReleaseErr: errCopyRelease},
+			removeOldStack: true,
+			expected:       errCopyRelease,
+			expectRemoved:  false,
+		},
+		"key verification failure keeps old stack": {
+			newStack:       &fakeStackDeployer{},
+			keyCopier:      &fakeKeyCopier{verifyErr: errVerifyKeys},
+			removeOldStack: true,
+			expected:       errVerifyKeys,
+			expectRemoved:  false,
+		},
+		"remove old stack error": {
+			newStack:       &fakeStackDeployer{},
+			keyCopier:      &fakeKeyCopier{},
+			oldStackErr:    errRemove,
+			removeOldStack: true,
+			expected:       errRemove,
+			expectRemoved:  true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			oldStack := &fakeStackRemover{err: tc.oldStackErr}
+			m := migrate.New("old", "new", tc.newStack, oldStack, tc.keyCopier, tc.removeOldStack)
+			err := m.Run(context.Background())
+			assert.ErrorIs(t, err, tc.expected)
+			assert.Equal(t, tc.expectRemoved, oldStack.removed)
+		})
+	}
+}
+
+type fakeStackDeployer struct {
+	err error
+}
+
+func (f *fakeStackDeployer) Deploy(ctx context.Context, timeout time.Duration, approve func() error) error {
+	return f.err
+}
+
+type fakeStackRemover struct {
+	err     error
+	removed bool
+}
+
+func (f *fakeStackRemover) Remove(ctx context.Context) error {
+	f.removed = true
+	return f.err
+}
+
+type fakeKeyCopier struct {
+	checkErr       error
+	copyKeysErr    error
+	copyReleaseErr error
+	verifyErr      error
+}
+
+func (f *fakeKeyCopier) CheckKeys(ctx context.Context) error {
+	return f.checkErr
+}
+
+func (f *fakeKeyCopier) CopyKeys(ctx context.Context) error {
+	return f.copyKeysErr
+}
+
+func (f *fakeKeyCopier) CopyRelease(ctx context.Context) error {
+	return f.copyReleaseErr
+}
+
+func (f *fakeKeyCopier) VerifyKeys(ctx context.Context) error {
+	return f.verifyErr
+}
@@ -1,34 +1,237 @@
 package stack
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"github.com/dan-v/rattlesnakeos-stack/internal/events"
+	"github.com/dan-v/rattlesnakeos-stack/internal/terraform"
+	"github.com/pmezard/go-difflib/difflib"
 	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
 	"time"
 )
 
 const (
 	// DefaultDeployTimeout is the default timeout for deployments
 	DefaultDeployTimeout = time.Minute * 5
+	// DefaultApproveTimeout is the default time allowed for approving the changes of a deployment
+	DefaultApproveTimeout = time.Minute * 30
+	// DefaultRemoveTimeout is the default timeout for removals
+	DefaultRemoveTimeout = time.Minute * 30
+	// DefaultUnlockTimeout is the default timeout for releasing the stack lock
+	DefaultUnlockTimeout = time.Second * 30
+	// DefaultInfoTimeout is the default timeout for getting stack info
+	DefaultInfoTimeout = time.Minute * 5
+)
+
+const (
+	// PhasePlan is the phase covering an entire plan
+	PhasePlan = "plan"
+	// PhaseDeploy is the phase covering an entire deploy
+	PhaseDeploy = "deploy"
+	// PhaseRemove is the phase covering an entire remove
+	PhaseRemove = "remove"
+	// PhaseAdopt is the phase covering an entire adopt
+	PhaseAdopt = "adopt"
+	// PhaseMigrateState is the phase covering an entire state migration
+	PhaseMigrateState = "migrate_state"
+	// PhaseDiff is the phase covering an entire diff
+	PhaseDiff = "diff"
+	// PhaseRender is the phase that renders all templates
+	PhaseRender = "render"
+	// PhaseLock is the phase that acquires the stack lock
+	PhaseLock = "lock"
+	// PhaseUnlock is the phase that releases the stack lock
+	PhaseUnlock = "unlock"
+	// PhaseSetup is the phase that creates/updates non terraform resources
+	PhaseSetup = "setup"
+	// PhaseTerraformPlan is the phase that runs terraform plan
+	PhaseTerraformPlan = "terraform_plan"
+	// PhaseTerraformApply is the phase that runs terraform apply
+	PhaseTerraformApply = "terraform_apply"
+	// PhaseTerraformDestroy is the phase that runs terraform destroy
+	PhaseTerraformDestroy = "terraform_destroy"
+	// PhaseTerraformImport is the phase that imports existing resources into terraform state
+	PhaseTerraformImport = "terraform_import"
+	// PhaseSaveArtifacts is the phase that stores the rendered files of a successful deploy
+	PhaseSaveArtifacts = "save_artifacts"
+	// PhaseSubscribe is the phase that ensures notifications are setup
+	PhaseSubscribe = "subscribe"
+	// PhaseUnsubscribe is the phase that removes notification subscriptions
+	PhaseUnsubscribe = "unsubscribe"
+	// PhaseTeardown is the phase that removes non terraform resources
+	PhaseTeardown = "teardown"
+)
+
+var (
+	// ErrNoState is returned if there is no terraform state to migrate
+	ErrNoState = errors.New("no terraform state found")
+	// ErrStateExists is returned if terraform state would be overwritten by a migration
+	ErrStateExists = errors.New("terraform state already exists")
+	// ErrExcludedResourceInState is returned if terraform would destroy a resource that is no longer managed by it
+	ErrExcludedResourceInState = errors.New("resource no longer managed by terraform is still in state")
 )
 
 // TemplateRenderer is an interface for template rendering
 type TemplateRenderer interface {
 	RenderAll() error
+	Artifacts() (map[string][]byte, error)
 }
 
-// CloudSetup is an interface for cloud setup
+// CloudSetup is an interface for cloud setup and teardown
 type CloudSetup interface {
 	Setup(ctx context.Context) error
+	BackupState(ctx context.Context) error
+	Teardown(ctx context.Context) error
+	Resources(ctx context.Context) ([]*Resource, error)
+	ExcludedResources() []string
 }
 
 // CloudSubscriber is an interface for cloud subscription
 type CloudSubscriber interface {
 	Subscribe(ctx context.Context) (bool, error)
+	Unsubscribe(ctx context.Context) error
+}
+
+// CloudAdopter is an interface for finding existing cloud resources that can be imported into terraform state
+type CloudAdopter interface {
+	Adoptable(ctx context.Context) ([]*Resource, error)
 }
 
-// TerraformApplier is an interface for applying terraform
+// ArtifactStore is an interface for keeping the rendered files of the last successful deploy
+type ArtifactStore interface {
+	Save(ctx context.Context, artifacts map[string][]byte) error
+	Last(ctx context.Context) (map[string][]byte, error)
+}
+
+// StackLocker is an interface for preventing concurrent changes to a stack
+type StackLocker interface {
+	Lock(ctx context.Context, operation string) error
+	Unlock(ctx context.Context) error
+}
+
+// TerraformApplier is an interface for applying a saved terraform plan
 type TerraformApplier interface {
-	Apply(ctx context.Context) ([]byte, error)
+	ApplyPlan(ctx context.Context) ([]byte, error)
+}
+
+// TerraformPlanner is an interface for planning and saving terraform changes
+type TerraformPlanner interface {
+	Plan(ctx context.Context) ([]byte, error)
+}
+
+// TerraformDestroyer is an interface for destroying terraform resources
+type TerraformDestroyer interface {
+	Destroy(ctx context.Context) ([]byte, error)
+}
+
+// TerraformOutputter is an interface for reading terraform outputs
+type TerraformOutputter interface {
+	Output(ctx context.Context, v interface{}) error
+}
+
+// TerraformStateReader is an interface for reading the resources in terraform state
+type TerraformStateReader interface {
+	StateList(ctx context.Context) ([]string, error)
+	StateShow(ctx context.Context, address string) (map[string]string, error)
+	StateResources(ctx context.Context) ([]string, error)
+}
+
+// TerraformImporter is an interface for importing existing resources into terraform state
+type TerraformImporter interface {
+	Import(ctx context.Context, address, id string) ([]byte, error)
+}
+
+// TerraformDriftDetector is an interface for finding differences between terraform config and deployed resources
+type TerraformDriftDetector interface {
+	Drift(ctx context.Context) ([]*Drift, error)
+}
+
+// TerraformStateMover is an interface for reading and writing the terraform state of the configured backend
+type TerraformStateMover interface {
+	StatePull(ctx context.Context) ([]byte, error)
+	StatePush(ctx context.Context, state []byte) error
+}
+
+// TerraformClient is an interface for all the terraform operations required by a stack
+type TerraformClient interface {
+	TerraformApplier
+	TerraformPlanner
+	TerraformDestroyer
+	TerraformOutputter
+	TerraformStateReader
+	TerraformImporter
+	TerraformDriftDetector
+	TerraformStateMover
+}
+
+// Info contains details of the resources deployed for a stack, read from the terraform outputs
+type Info struct {
+	KeysBucket          string            `json:"keys_bucket"`
+	KeysEncryptedBucket string            `json:"keys_encrypted_bucket"`
+	LogsBucket          string            `json:"logs_bucket"`
+	ReleaseBucket       string            `json:"release_bucket"`
+	ScriptBucket        string            `json:"script_bucket"`
+	EC2InstanceProfile  string            `json:"ec2_instance_profile"`
+	LambdaFunctionName  string            `json:"lambda_function_name"`
+	LambdaFunctionARN   string            `json:"lambda_function_arn"`
+	SNSTopicARN         string            `json:"sns_topic_arn"`
+	ScheduleRules       map[string]string `json:"schedule_rules"`
+	OTABaseURL          string            `json:"ota_base_url"`
+}
+
+const (
+	// ManagedByTerraform is set on resources that are managed by terraform
+	ManagedByTerraform = "terraform"
+	// ManagedBySetup is set on resources that are created by cloud setup outside of terraform
+	ManagedBySetup = "setup"
+	// RegionGlobal is the region of resources that aren't regional (e.g. IAM roles)
+	RegionGlobal = "global"
+)
+
+// keyAttributes are the attributes of terraform resources that are shown in resource listings
+var keyAttributes = []string{"arn", "bucket", "name", "function_name", "key", "role", "runtime", "schedule_expression"}
+
+// Resource is a cloud resource that belongs to a stack
+type Resource struct {
+	// Address is the terraform address of the resource, or a similar unique address for resources created by setup
+	Address string `json:"address"`
+	// Type is the terraform resource type (e.g. aws_s3_bucket)
+	Type string `json:"type"`
+	// ID is the cloud provider id of the resource
+	ID string `json:"id"`
+	// Region is where the resource is, or empty if it is in the region of the stack
+	Region string `json:"region,omitempty"`
+	// ManagedBy is ManagedByTerraform or ManagedBySetup
+	ManagedBy string `json:"managed_by"`
+	// Attributes are key attributes of the resource, or all simple attributes when showing a single resource
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+const (
+	// DriftActionCreate is the action for resources in the templates that aren't deployed
+	DriftActionCreate = terraform.DriftActionCreate
+	// DriftActionUpdate is the action for deployed resources with attributes that differ from the templates
+	DriftActionUpdate = terraform.DriftActionUpdate
+	// DriftActionReplace is the action for deployed resources that have to be recreated to match the templates
+	DriftActionReplace = terraform.DriftActionReplace
+	// DriftActionDelete is the action for deployed resources that are no longer in the templates
+	DriftActionDelete = terraform.DriftActionDelete
+)
+
+// Drift is a difference between a deployed resource and the rendered templates, along with the action a deploy would
+// take to remove it
+type Drift = terraform.Drift
+
+// ArtifactDiff is the difference between a rendered file and the same file from the last deploy
+type ArtifactDiff struct {
+	// Name is the file name of the artifact
+	Name string `json:"name"`
+	// Diff is a unified diff from the last deployed file to the rendered file
+	Diff string `json:"diff"`
 }
 
 // Stack contains all the necessary pieces to generate and deploy a stack
@@ -37,47 +240,548 @@ type Stack struct {
 	templateRenderer TemplateRenderer
 	cloudSetup       CloudSetup
 	cloudSubscriber  CloudSubscriber
-	terraformApplier TerraformApplier
+	terraformClient  TerraformClient
+	stackLocker      StackLocker
+	artifactStore    ArtifactStore
+	eventSink        events.Sink
 }
 
 // New returns an initialized Stack that is ready for deployment
-func New(name string, templateRenderer TemplateRenderer, cloudSetup CloudSetup, cloudSubscriber CloudSubscriber, terraformApplier TerraformApplier) *Stack {
+func New(name string, templateRenderer TemplateRenderer, cloudSetup CloudSetup, cloudSubscriber CloudSubscriber, terraformClient TerraformClient, stackLocker StackLocker, artifactStore ArtifactStore, eventSink events.Sink) *Stack {
 	return &Stack{
 		name:             name,
 		templateRenderer: templateRenderer,
 		cloudSetup:       cloudSetup,
 		cloudSubscriber:  cloudSubscriber,
-		terraformApplier: terraformApplier,
+		terraformClient:  terraformClient,
+		stackLocker:      stackLocker,
+		artifactStore:    artifactStore,
+		eventSink:        eventSink,
 	}
 }
 
-// Deploy renders files, runs cloud setup, runs terraform apply, and ensures notifications are setup
-func (s *Stack) Deploy(ctx context.Context) error {
-	log.Infof("Rendering all templates files for stack %v", s.name)
-	if err := s.templateRenderer.RenderAll(); err != nil {
+// Plan renders files and runs terraform plan to show what a deploy would change, without running cloud setup
+func (s *Stack) Plan(ctx context.Context) error {
+	return s.runPhase(PhasePlan, fmt.Sprintf("Planning changes for stack %v", s.name), func() error {
+		if err := s.render(); err != nil {
+			return err
+		}
+
+		return s.withLock(ctx, "plan", func() error {
+			return s.plan(ctx)
+		})
+	})
+}
+
+func (s *Stack) plan(ctx context.Context) error {
+	err := s.runPhase(PhaseTerraformPlan, fmt.Sprintf("Executing terraform plan for stack %v", s.name), func() error {
+		if err := s.cloudSetup.BackupState(ctx); err != nil {
+			return err
+		}
+		if err := s.checkExcludedResources(ctx); err != nil {
+			return err
+		}
+		_, err := s.terraformClient.Plan(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Successfully planned changes for stack %v", s.name)
+	return nil
+}
+
+// checkExcludedResources fails if a resource that is left out of the rendered terraform config is still in state, as
+// terraform would destroy it along with its data
+func (s *Stack) checkExcludedResources(ctx context.Context) error {
+	excluded := s.cloudSetup.ExcludedResources()
+	if len(excluded) == 0 {
+		return nil
+	}
+	addresses, err := s.terraformClient.StateResources(ctx)
+	if err != nil {
+		return err
+	}
+	for _, address := range addresses {
+		for _, e := range excluded {
+			if address == e {
+				return fmt.Errorf("%w: deploying would destroy %v - copy any data it holds, then run "+
+					"'terraform state rm %v' in the output directory to keep it", ErrExcludedResourceInState, address, address)
+			}
+		}
+	}
+	return nil
+}
+
+// Deploy renders files and runs terraform plan. If approve returns nil, it then runs cloud setup, applies the saved
+// plan, stores the rendered files, and ensures notifications are setup. The stack lock is held from plan to apply, so
+// only the approved changes are made. A nil approve applies the plan without asking. Planning and applying each get
+// timeout, so the time spent in approve isn't taken from apply.
+func (s *Stack) Deploy(ctx context.Context, timeout time.Duration, approve func() error) error {
+	return s.runPhase(PhaseDeploy, fmt.Sprintf("Deploying stack %v", s.name), func() error {
+		if err := s.render(); err != nil {
+			return err
+		}
+
+		return s.withLock(ctx, "deploy", func() error {
+			return s.deploy(ctx, timeout, approve)
+		})
+	})
+}
+
+func (s *Stack) deploy(ctx context.Context, timeout time.Duration, approve func() error) error {
+	planCtx, planCancel := context.WithTimeout(ctx, timeout)
+	defer planCancel()
+	if err := s.plan(planCtx); err != nil {
 		return err
 	}
+	if approve != nil {
+		if err := approve(); err != nil {
+			return err
+		}
+	}
 
-	log.Infof("Creating/updating non terraform resources for stack %v", s.name)
-	if err := s.cloudSetup.Setup(ctx); err != nil {
+	applyCtx, applyCancel := context.WithTimeout(ctx, timeout)
+	defer applyCancel()
+	if err := s.setup(applyCtx); err != nil {
 		return err
 	}
 
-	log.Infof("Executing terraform apply for stack %v", s.name)
-	if _, err := s.terraformApplier.Apply(ctx); err != nil {
+	err := s.runPhase(PhaseTerraformApply, fmt.Sprintf("Executing terraform apply for stack %v", s.name), func() error {
+		_, err := s.terraformClient.ApplyPlan(applyCtx)
+		return err
+	})
+	if err != nil {
 		return err
 	}
 
-	log.Infof("Ensuring notifications enabled for stack %v", s.name)
-	subscribed, err := s.cloudSubscriber.Subscribe(ctx)
+	err = s.runPhase(PhaseSaveArtifacts, fmt.Sprintf("Saving rendered files of stack %v", s.name), func() error {
+		artifacts, err := s.templateRenderer.Artifacts()
+		if err != nil {
+			return err
+		}
+		return s.artifactStore.Save(applyCtx, artifacts)
+	})
 	if err != nil {
 		return err
 	}
-	if subscribed {
-		log.Infof("Successfully setup email notifications for stack %v - you'll need to click link in "+
-			"confirmation email to get notifications.", s.name)
+
+	err = s.runPhase(PhaseSubscribe, fmt.Sprintf("Ensuring notifications enabled for stack %v", s.name), func() error {
+		subscribed, err := s.cloudSubscriber.Subscribe(applyCtx)
+		if err != nil {
+			return err
+		}
+		if subscribed {
+			log.Infof("Successfully setup email notifications for stack %v - you'll need to click link in "+
+				"confirmation email to get notifications.", s.name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
 	log.Infof("Successfully deployed/updated resources for stack %v", s.name)
 	return nil
 }
+
+// Remove renders files, removes notification subscriptions, runs terraform destroy, and removes non terraform resources
+func (s *Stack) Remove(ctx context.Context) error {
+	return s.runPhase(PhaseRemove, fmt.Sprintf("Removing stack %v", s.name), func() error {
+		if err := s.render(); err != nil {
+			return err
+		}
+
+		return s.withLock(ctx, "remove", func() error {
+			return s.remove(ctx)
+		})
+	})
+}
+
+func (s *Stack) remove(ctx context.Context) error {
+	err := s.runPhase(PhaseUnsubscribe, fmt.Sprintf("Removing notification subscriptions for stack %v", s.name), func() error {
+		return s.cloudSubscriber.Unsubscribe(ctx)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = s.runPhase(PhaseTerraformDestroy, fmt.Sprintf("Executing terraform destroy for stack %v", s.name), func() error {
+		_, err := s.terraformClient.Destroy(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = s.runPhase(PhaseTeardown, fmt.Sprintf("Removing non terraform resources for stack %v", s.name), func() error {
+		return s.cloudSetup.Teardown(ctx)
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Successfully removed all resources for stack %v", s.name)
+	return nil
+}
+
+// Adopt renders files, runs cloud setup, and imports the existing resources found by adopter that are missing from
+// terraform state. This recovers a stack whose terraform state was lost without having to delete its resources.
+func (s *Stack) Adopt(ctx context.Context, adopter CloudAdopter) error {
+	return s.runPhase(PhaseAdopt, fmt.Sprintf("Adopting existing resources for stack %v", s.name), func() error {
+		if err := s.render(); err != nil {
+			return err
+		}
+
+		return s.withLock(ctx, "adopt", func() error {
+			return s.adopt(ctx, adopter)
+		})
+	})
+}
+
+func (s *Stack) adopt(ctx context.Context, adopter CloudAdopter) error {
+	if err := s.setup(ctx); err != nil {
+		return err
+	}
+
+	return s.runPhase(PhaseTerraformImport, fmt.Sprintf("Importing existing resources for stack %v", s.name), func() error {
+		addresses, err := s.terraformClient.StateList(ctx)
+		if err != nil {
+			return err
+		}
+		inState := map[string]bool{}
+		for _, address := range addresses {
+			inState[address] = true
+		}
+
+		resources, err := adopter.Adoptable(ctx)
+		if err != nil {
+			return err
+		}
+
+		imported := 0
+		for _, resource := range resources {
+			if inState[resource.Address] {
+				continue
+			}
+			log.Infof("Importing %v (%v) into terraform state for stack %v", resource.Address, resource.ID, s.name)
+			if _, err := s.terraformClient.Import(ctx, resource.Address, resource.ID); err != nil {
+				return fmt.Errorf("failed to import %v: %w", resource.Address, err)
+			}
+			imported++
+		}
+
+		log.Infof("Imported %v existing resources into terraform state for stack %v", imported, s.name)
+		return nil
+	})
+}
+
+// MigrateState runs cloud setup and copies terraform state from the backend rendered by source to the backend rendered
+// by the stack templates. State in the source backend is left in place, and the migration fails rather than overwriting existing
+// state in the destination backend.
+func (s *Stack) MigrateState(ctx context.Context, source TemplateRenderer) error {
+	return s.runPhase(PhaseMigrateState, fmt.Sprintf("Migrating terraform state for stack %v", s.name), func() error {
+		return s.withLock(ctx, "migrate state", func() error {
+			return s.migrateState(ctx, source)
+		})
+	})
+}
+
+func (s *Stack) migrateState(ctx context.Context, source TemplateRenderer) error {
+	if err := s.setup(ctx); err != nil {
+		return err
+	}
+
+	if err := source.RenderAll(); err != nil {
+		return err
+	}
+	state, err := s.terraformClient.StatePull(ctx)
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(state)) == 0 {
+		return fmt.Errorf("source backend for stack %v: %w", s.name, ErrNoState)
+	}
+
+	if err := s.render(); err != nil {
+		return err
+	}
+	existing, err := s.terraformClient.StatePull(ctx)
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(existing)) != 0 {
+		return fmt.Errorf("destination backend for stack %v: %w", s.name, ErrStateExists)
+	}
+
+	if err := s.terraformClient.StatePush(ctx, state); err != nil {
+		return err
+	}
+
+	log.Infof("Successfully migrated terraform state for stack %v - the state in the old backend can now be deleted", s.name)
+	return nil
+}
+
+// Drift renders files and returns every difference between the deployed resources and the rendered templates, as
+// found by terraform plan. This includes changes to the uploaded build script, as its object is planned with the md5
+// of the rendered script as etag. The etag of an object is only its md5 if it was uploaded in a single part with S3
+// managed encryption, as terraform does, so a script uploaded with SSE-KMS or in parts is always reported as drift.
+// There is no drift if the returned slice is empty.
+func (s *Stack) Drift(ctx context.Context) ([]*Drift, error) {
+	if err := s.templateRenderer.RenderAll(); err != nil {
+		return nil, err
+	}
+
+	return s.terraformClient.Drift(ctx)
+}
+
+// Render renders files without deploying them. It only needs the template renderer and event sink of the stack.
+func (s *Stack) Render() error {
+	return s.render()
+}
+
+// Diff renders files and returns a unified diff of every rendered file that differs from the last deploy, emitting a
+// diff event for each of them. Nothing has changed if the returned slice is empty. It only needs the template
+// renderer, artifact store and event sink of the stack.
+func (s *Stack) Diff(ctx context.Context) ([]*ArtifactDiff, error) {
+	var diffs []*ArtifactDiff
+	err := s.runPhase(PhaseDiff, fmt.Sprintf("Comparing rendered files of stack %v with the last deploy", s.name), func() error {
+		var err error
+		diffs, err = s.diff(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return diffs, nil
+}
+
+func (s *Stack) diff(ctx context.Context) ([]*ArtifactDiff, error) {
+	if err := s.render(); err != nil {
+		return nil, err
+	}
+
+	artifacts, err := s.templateRenderer.Artifacts()
+	if err != nil {
+		return nil, err
+	}
+	lastArtifacts, err := s.artifactStore.Last(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[string]bool{}
+	for name := range artifacts {
+		names[name] = true
+	}
+	for name := range lastArtifacts {
+		names[name] = true
+	}
+	var sortedNames []string
+	for name := range names {
+		sortedNames = append(sortedNames, name)
+	}
+	sort.Strings(sortedNames)
+
+	var diffs []*ArtifactDiff
+	for _, name := range sortedNames {
+		if bytes.Equal(artifacts[name], lastArtifacts[name]) {
+			continue
+		}
+		fromFile, toFile := "deployed/"+name, "rendered/"+name
+		if _, ok := lastArtifacts[name]; !ok {
+			fromFile = "/dev/null"
+		}
+		if _, ok := artifacts[name]; !ok {
+			toFile = "/dev/null"
+		}
+		diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+			A:        splitLines(lastArtifacts[name]),
+			B:        splitLines(artifacts[name]),
+			FromFile: fromFile,
+			ToFile:   toFile,
+			Context:  3,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to diff %v: %w", name, err)
+		}
+		diffs = append(diffs, &ArtifactDiff{Name: name, Diff: diff})
+		s.eventSink.Emit(events.Event{
+			Time:  time.Now(),
+			Type:  events.TypeDiff,
+			Stack: s.name,
+			File:  name,
+			Diff:  diff,
+		})
+	}
+	return diffs, nil
+}
+
+// Info renders files and returns details of the deployed resources for the stack
+func (s *Stack) Info(ctx context.Context) (*Info, error) {
+	if err := s.templateRenderer.RenderAll(); err != nil {
+		return nil, err
+	}
+
+	info := &Info{}
+	if err := s.terraformClient.Output(ctx, info); err != nil {
+		return nil, fmt.Errorf("failed to get info for stack %v: %w", s.name, err)
+	}
+	return info, nil
+}
+
+// Resources renders files and returns every resource that belongs to the stack, with its key attributes
+func (s *Stack) Resources(ctx context.Context) ([]*Resource, error) {
+	if err := s.templateRenderer.RenderAll(); err != nil {
+		return nil, err
+	}
+
+	addresses, err := s.terraformClient.StateList(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list resources for stack %v: %w", s.name, err)
+	}
+
+	var resources []*Resource
+	for _, address := range addresses {
+		resource, err := s.resource(ctx, address)
+		if err != nil {
+			return nil, err
+		}
+		keys := map[string]string{}
+		for _, key := range keyAttributes {
+			if value, ok := resource.Attributes[key]; ok {
+				keys[key] = value
+			}
+		}
+		resource.Attributes = keys
+		resources = append(resources, resource)
+	}
+
+	setupResources, err := s.cloudSetup.Resources(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list non terraform resources for stack %v: %w", s.name, err)
+	}
+	return append(resources, setupResources...), nil
+}
+
+// Resource renders files and returns the terraform resource at address with all of its attributes
+func (s *Stack) Resource(ctx context.Context, address string) (*Resource, error) {
+	if err := s.templateRenderer.RenderAll(); err != nil {
+		return nil, err
+	}
+	return s.resource(ctx, address)
+}
+
+func (s *Stack) resource(ctx context.Context, address string) (*Resource, error) {
+	attributes, err := s.terraformClient.StateShow(ctx, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to show resource %v for stack %v: %w", address, s.name, err)
+	}
+
+	resourceType := strings.Split(strings.TrimPrefix(address, "data."), ".")[0]
+	return &Resource{
+		Address:    address,
+		Type:       resourceType,
+		ID:         attributes["id"],
+		Region:     resourceRegion(resourceType, attributes),
+		ManagedBy:  ManagedByTerraform,
+		Attributes: attributes,
+	}, nil
+}
+
+// resourceRegion returns the region of a terraform resource from its attributes or ARN, or empty if the resource
+// doesn't record it
+func resourceRegion(resourceType string, attributes map[string]string) string {
+	if region := attributes["region"]; region != "" {
+		return region
+	}
+	if strings.HasPrefix(resourceType, "aws_iam_") {
+		return RegionGlobal
+	}
+	// arn:partition:service:region:account-id:resource
+	if arnParts := strings.Split(attributes["arn"], ":"); len(arnParts) > 3 && arnParts[3] != "" {
+		return arnParts[3]
+	}
+	return ""
+}
+
+// splitLines splits contents into lines for diffing, each ending with a newline
+func splitLines(contents []byte) []string {
+	if len(contents) == 0 {
+		return nil
+	}
+	lines := strings.SplitAfter(string(contents), "\n")
+	if lines[len(lines)-1] == "" {
+		return lines[:len(lines)-1]
+	}
+	lines[len(lines)-1] += "\n"
+	return lines
+}
+
+func (s *Stack) render() error {
+	return s.runPhase(PhaseRender, fmt.Sprintf("Rendering all templates files for stack %v", s.name), func() error {
+		return s.templateRenderer.RenderAll()
+	})
+}
+
+func (s *Stack) setup(ctx context.Context) error {
+	return s.runPhase(PhaseSetup, fmt.Sprintf("Creating/updating non terraform resources for stack %v", s.name), func() error {
+		return s.cloudSetup.Setup(ctx)
+	})
+}
+
+// withLock holds the stack lock while running fn. The lock is released even if ctx has expired, and an error
+// releasing it is only returned if fn succeeded.
+func (s *Stack) withLock(ctx context.Context, operation string, fn func() error) (err error) {
+	err = s.runPhase(PhaseLock, fmt.Sprintf("Acquiring lock for stack %v", s.name), func() error {
+		return s.stackLocker.Lock(ctx, operation)
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		unlockErr := s.runPhase(PhaseUnlock, fmt.Sprintf("Releasing lock for stack %v", s.name), func() error {
+			unlockCtx, cancel := context.WithTimeout(context.Background(), DefaultUnlockTimeout)
+			defer cancel()
+			return s.stackLocker.Unlock(unlockCtx)
+		})
+		if unlockErr == nil {
+			return
+		}
+		if err != nil {
+			log.Errorf("failed to release lock for stack %v: %v", s.name, unlockErr)
+			return
+		}
+		err = unlockErr
+	}()
+
+	return fn()
+}
+
+// runPhase emits started and finished events around fn
+func (s *Stack) runPhase(phase, message string, fn func() error) error {
+	start := time.Now()
+	s.eventSink.Emit(events.Event{
+		Time:    start,
+		Type:    events.TypePhaseStarted,
+		Stack:   s.name,
+		Phase:   phase,
+		Message: message,
+	})
+
+	err := fn()
+
+	finished := events.Event{
+		Time:     time.Now(),
+		Type:     events.TypePhaseFinished,
+		Stack:    s.name,
+		Phase:    phase,
+		Duration: time.Since(start),
+	}
+	if err != nil {
+		finished.Error = err.Error()
+	}
+	s.eventSink.Emit(finished)
+	return err
+}
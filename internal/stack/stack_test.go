@@ -3,16 +3,38 @@ package stack_test
 import (
 	"context"
 	"errors"
+	"fmt"
+	"github.com/dan-v/rattlesnakeos-stack/internal/events"
 	"github.com/dan-v/rattlesnakeos-stack/internal/stack"
 	"github.com/stretchr/testify/assert"
+	"sort"
 	"testing"
+	"time"
 )
 
 var (
-	errTemplateRender = errors.New("template renderer error")
-	errCloudSetup     = errors.New("cloud setup error")
-	errCloudSubscribe = errors.New("cloud subscriber error")
-	errTerraformApply = errors.New("terraform apply error")
+	errTemplateRender   = errors.New("template renderer error")
+	errCloudSetup       = errors.New("cloud setup error")
+	errCloudBackup      = errors.New("cloud backup error")
+	errApprove          = errors.New("approve error")
+	errCloudSubscribe   = errors.New("cloud subscriber error")
+	errTerraformApply   = errors.New("terraform apply error")
+	errTerraformPlan    = errors.New("terraform plan error")
+	errTerraformDestroy = errors.New("terraform destroy error")
+	errTerraformOutput  = errors.New("terraform output error")
+	errTerraformState   = errors.New("terraform state error")
+	errTerraformImport  = errors.New("terraform import error")
+	errTerraformDrift   = errors.New("terraform drift error")
+	errStatePull        = errors.New("terraform state pull error")
+	errStatePush        = errors.New("terraform state push error")
+	errCloudAdoptable   = errors.New("cloud adoptable error")
+	errCloudResources   = errors.New("cloud resources error")
+	errCloudTeardown    = errors.New("cloud teardown error")
+	errCloudUnsubscribe = errors.New("cloud unsubscribe error")
+	errStackLock        = errors.New("stack lock error")
+	errStackUnlock      = errors.New("stack unlock error")
+	errArtifactsSave    = errors.New("artifacts save error")
+	errArtifactsLast    = errors.New("artifacts last error")
 )
 
 func TestDeploy(t *testing.T) {
@@ -26,7 +48,10 @@ func TestDeploy(t *testing.T) {
 				&fakeTemplateRenderer{err: nil},
 				&fakeCloudSetup{err: nil},
 				&fakeCloudSubscriber{subscribed: true, err: nil},
-				&fakeTerraformApplier{output: []byte("test"), err: nil},
+				&fakeTerraformClient{output: []byte("test"), err: nil},
+				&fakeStackLocker{},
+				&fakeArtifactStore{},
+				&fakeEventSink{},
 			),
 			expected: nil,
 		},
@@ -36,7 +61,10 @@ func TestDeploy(t *testing.T) {
 				&fakeTemplateRenderer{err: nil},
 				&fakeCloudSetup{err: nil},
 				&fakeCloudSubscriber{subscribed: false, err: nil},
-				&fakeTerraformApplier{output: []byte("test"), err: nil},
+				&fakeTerraformClient{output: []byte("test"), err: nil},
+				&fakeStackLocker{},
+				&fakeArtifactStore{},
+				&fakeEventSink{},
 			),
 			expected: nil,
 		},
@@ -46,7 +74,10 @@ func TestDeploy(t *testing.T) {
 				&fakeTemplateRenderer{err: errTemplateRender},
 				&fakeCloudSetup{err: nil},
 				&fakeCloudSubscriber{subscribed: false, err: nil},
-				&fakeTerraformApplier{output: []byte("test"), err: nil},
+				&fakeTerraformClient{output: []byte("test"), err: nil},
+				&fakeStackLocker{},
+				&fakeArtifactStore{},
+				&fakeEventSink{},
 			),
 			expected: errTemplateRender,
 		},
@@ -56,7 +87,10 @@ func TestDeploy(t *testing.T) {
 				&fakeTemplateRenderer{err: nil},
 				&fakeCloudSetup{err: errCloudSetup},
 				&fakeCloudSubscriber{subscribed: false, err: nil},
-				&fakeTerraformApplier{output: []byte("test"), err: nil},
+				&fakeTerraformClient{output: []byte("test"), err: nil},
+				&fakeStackLocker{},
+				&fakeArtifactStore{},
+				&fakeEventSink{},
 			),
 			expected: errCloudSetup,
 		},
@@ -66,7 +100,10 @@ func TestDeploy(t *testing.T) {
 				&fakeTemplateRenderer{err: nil},
 				&fakeCloudSetup{err: nil},
 				&fakeCloudSubscriber{subscribed: false, err: errCloudSubscribe},
-				&fakeTerraformApplier{output: []byte("test"), err: nil},
+				&fakeTerraformClient{output: []byte("test"), err: nil},
+				&fakeStackLocker{},
+				&fakeArtifactStore{},
+				&fakeEventSink{},
 			),
 			expected: errCloudSubscribe,
 		},
@@ -76,50 +113,1217 @@ func TestDeploy(t *testing.T) {
 				&fakeTemplateRenderer{err: nil},
 				&fakeCloudSetup{err: nil},
 				&fakeCloudSubscriber{subscribed: false, err: nil},
-				&fakeTerraformApplier{output: []byte("test"), err: errTerraformApply},
+				&fakeTerraformClient{output: []byte("test"), err: errTerraformApply},
+				&fakeStackLocker{},
+				&fakeArtifactStore{},
+				&fakeEventSink{},
 			),
 			expected: errTerraformApply,
 		},
+		"artifacts save error": {
+			stack: stack.New(
+				"test",
+				&fakeTemplateRenderer{err: nil},
+				&fakeCloudSetup{err: nil},
+				&fakeCloudSubscriber{subscribed: false, err: nil},
+				&fakeTerraformClient{output: []byte("test"), err: nil},
+				&fakeStackLocker{},
+				&fakeArtifactStore{saveErr: errArtifactsSave},
+				&fakeEventSink{},
+			),
+			expected: errArtifactsSave,
+		},
+		"stack lock error": {
+			stack: stack.New(
+				"test",
+				&fakeTemplateRenderer{err: nil},
+				&fakeCloudSetup{err: nil},
+				&fakeCloudSubscriber{subscribed: false, err: nil},
+				&fakeTerraformClient{output: []byte("test"), err: nil},
+				&fakeStackLocker{lockErr: errStackLock},
+				&fakeArtifactStore{},
+				&fakeEventSink{},
+			),
+			expected: errStackLock,
+		},
+		"stack unlock error": {
+			stack: stack.New(
+				"test",
+				&fakeTemplateRenderer{err: nil},
+				&fakeCloudSetup{err: nil},
+				&fakeCloudSubscriber{subscribed: false, err: nil},
+				&fakeTerraformClient{output: []byte("test"), err: nil},
+				&fakeStackLocker{unlockErr: errStackUnlock},
+				&fakeArtifactStore{},
+				&fakeEventSink{},
+			),
+			expected: errStackUnlock,
+		},
+		"terraform apply error is returned over stack unlock error": {
+			stack: stack.New(
+				"test",
+				&fakeTemplateRenderer{err: nil},
+				&fakeCloudSetup{err: nil},
+				&fakeCloudSubscriber{subscribed: false, err: nil},
+				&fakeTerraformClient{output: []byte("test"), err: errTerraformApply},
+				&fakeStackLocker{unlockErr: errStackUnlock},
+				&fakeArtifactStore{},
+				&fakeEventSink{},
+			),
+			expected: errTerraformApply,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := tc.stack.Deploy(context.Background(), stack.DefaultDeployTimeout, nil)
+			assert.ErrorIs(t, err, tc.expected)
+		})
+	}
+}
+
+func TestDeploy_Approve(t *testing.T) {
+	tests := map[string]struct {
+		planErr       error
+		approveErr    error
+		expectApprove bool
+		expectApplied bool
+		expected      error
+	}{
+		"approved plan is applied": {
+			expectApprove: true,
+			expectApplied: true,
+		},
+		"declined plan runs neither setup nor apply": {
+			approveErr:    errApprove,
+			expectApprove: true,
+			expected:      errApprove,
+		},
+		"failed plan isn't approved": {
+			planErr:  errTerraformPlan,
+			expected: errTerraformPlan,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			cloudSetup := &fakeCloudSetup{}
+			terraformClient := &fakeTerraformClient{planErr: tc.planErr}
+			locker := &fakeStackLocker{}
+			s := stack.New(
+				"test",
+				&fakeTemplateRenderer{},
+				cloudSetup,
+				&fakeCloudSubscriber{},
+				terraformClient,
+				locker,
+				&fakeArtifactStore{},
+				&fakeEventSink{},
+			)
+
+			approved := false
+			err := s.Deploy(context.Background(), stack.DefaultDeployTimeout, func() error {
+				assert.True(t, locker.locked)
+				assert.False(t, cloudSetup.setupRun)
+				approved = true
+				return tc.approveErr
+			})
+			assert.ErrorIs(t, err, tc.expected)
+			assert.Equal(t, tc.expectApprove, approved)
+			assert.Equal(t, tc.expectApplied, cloudSetup.setupRun)
+			assert.Equal(t, tc.expectApplied, terraformClient.applied)
+			assert.False(t, locker.locked)
+		})
+	}
+}
+
+func TestDeployTimeoutStartsAfterApproval(t *testing.T) {
+	terraformClient := &fakeTerraformClient{}
+	s := stack.New(
+		"test",
+		&fakeTemplateRenderer{},
+		&fakeCloudSetup{},
+		&fakeCloudSubscriber{},
+		terraformClient,
+		&fakeStackLocker{},
+		&fakeArtifactStore{},
+		&fakeEventSink{},
+	)
+
+	timeout := time.Millisecond * 50
+	err := s.Deploy(context.Background(), timeout, func() error {
+		time.Sleep(timeout * 2)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.True(t, terraformClient.applied)
+}
+
+func TestPlan(t *testing.T) {
+	tests := map[string]struct {
+		stack    *stack.Stack
+		expected error
+	}{
+		"plan with no errors": {
+			stack: stack.New(
+				"test",
+				&fakeTemplateRenderer{err: nil},
+				&fakeCloudSetup{err: nil},
+				&fakeCloudSubscriber{subscribed: false, err: nil},
+				&fakeTerraformClient{output: []byte("test"), planErr: nil},
+				&fakeStackLocker{},
+				&fakeArtifactStore{},
+				&fakeEventSink{},
+			),
+			expected: nil,
+		},
+		"template render error": {
+			stack: stack.New(
+				"test",
+				&fakeTemplateRenderer{err: errTemplateRender},
+				&fakeCloudSetup{err: nil},
+				&fakeCloudSubscriber{subscribed: false, err: nil},
+				&fakeTerraformClient{output: []byte("test"), planErr: nil},
+				&fakeStackLocker{},
+				&fakeArtifactStore{},
+				&fakeEventSink{},
+			),
+			expected: errTemplateRender,
+		},
+		"cloud setup isn't run": {
+			stack: stack.New(
+				"test",
+				&fakeTemplateRenderer{err: nil},
+				&fakeCloudSetup{err: errCloudSetup},
+				&fakeCloudSubscriber{subscribed: false, err: nil},
+				&fakeTerraformClient{output: []byte("test"), planErr: nil},
+				&fakeStackLocker{},
+				&fakeArtifactStore{},
+				&fakeEventSink{},
+			),
+			expected: nil,
+		},
+		"cloud state backup error": {
+			stack: stack.New(
+				"test",
+				&fakeTemplateRenderer{err: nil},
+				&fakeCloudSetup{backupErr: errCloudBackup},
+				&fakeCloudSubscriber{subscribed: false, err: nil},
+				&fakeTerraformClient{output: []byte("test"), planErr: nil},
+				&fakeStackLocker{},
+				&fakeArtifactStore{},
+				&fakeEventSink{},
+			),
+			expected: errCloudBackup,
+		},
+		"terraform plan error": {
+			stack: stack.New(
+				"test",
+				&fakeTemplateRenderer{err: nil},
+				&fakeCloudSetup{err: nil},
+				&fakeCloudSubscriber{subscribed: false, err: nil},
+				&fakeTerraformClient{output: []byte("test"), planErr: errTerraformPlan},
+				&fakeStackLocker{},
+				&fakeArtifactStore{},
+				&fakeEventSink{},
+			),
+			expected: errTerraformPlan,
+		},
+		"stack lock error": {
+			stack: stack.New(
+				"test",
+				&fakeTemplateRenderer{err: nil},
+				&fakeCloudSetup{err: nil},
+				&fakeCloudSubscriber{subscribed: false, err: nil},
+				&fakeTerraformClient{output: []byte("test"), planErr: nil},
+				&fakeStackLocker{lockErr: errStackLock},
+				&fakeArtifactStore{},
+				&fakeEventSink{},
+			),
+			expected: errStackLock,
+		},
+		"excluded resource in state": {
+			stack: stack.New(
+				"test",
+				&fakeTemplateRenderer{err: nil},
+				&fakeCloudSetup{excluded: []string{"aws_s3_bucket.keys"}},
+				&fakeCloudSubscriber{subscribed: false, err: nil},
+				&fakeTerraformClient{output: []byte("test"), state: map[string]map[string]string{
+					"aws_s3_bucket.keys": {},
+				}},
+				&fakeStackLocker{},
+				&fakeArtifactStore{},
+				&fakeEventSink{},
+			),
+			expected: stack.ErrExcludedResourceInState,
+		},
+		"excluded resource not in state": {
+			stack: stack.New(
+				"test",
+				&fakeTemplateRenderer{err: nil},
+				&fakeCloudSetup{excluded: []string{"aws_s3_bucket.keys"}},
+				&fakeCloudSubscriber{subscribed: false, err: nil},
+				&fakeTerraformClient{output: []byte("test"), state: map[string]map[string]string{
+					"aws_s3_bucket.script": {},
+				}},
+				&fakeStackLocker{},
+				&fakeArtifactStore{},
+				&fakeEventSink{},
+			),
+			expected: nil,
+		},
+		"excluded resources state error": {
+			stack: stack.New(
+				"test",
+				&fakeTemplateRenderer{err: nil},
+				&fakeCloudSetup{excluded: []string{"aws_s3_bucket.keys"}},
+				&fakeCloudSubscriber{subscribed: false, err: nil},
+				&fakeTerraformClient{output: []byte("test"), stateErr: errTerraformState},
+				&fakeStackLocker{},
+				&fakeArtifactStore{},
+				&fakeEventSink{},
+			),
+			expected: errTerraformState,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := tc.stack.Plan(context.Background())
+			assert.ErrorIs(t, err, tc.expected)
+		})
+	}
+}
+
+func TestRemove(t *testing.T) {
+	tests := map[string]struct {
+		stack    *stack.Stack
+		expected error
+	}{
+		"remove with no errors": {
+			stack: stack.New(
+				"test",
+				&fakeTemplateRenderer{err: nil},
+				&fakeCloudSetup{teardownErr: nil},
+				&fakeCloudSubscriber{unsubscribeErr: nil},
+				&fakeTerraformClient{output: []byte("test"), destroyErr: nil},
+				&fakeStackLocker{},
+				&fakeArtifactStore{},
+				&fakeEventSink{},
+			),
+			expected: nil,
+		},
+		"template render error": {
+			stack: stack.New(
+				"test",
+				&fakeTemplateRenderer{err: errTemplateRender},
+				&fakeCloudSetup{teardownErr: nil},
+				&fakeCloudSubscriber{unsubscribeErr: nil},
+				&fakeTerraformClient{output: []byte("test"), destroyErr: nil},
+				&fakeStackLocker{},
+				&fakeArtifactStore{},
+				&fakeEventSink{},
+			),
+			expected: errTemplateRender,
+		},
+		"cloud unsubscribe error": {
+			stack: stack.New(
+				"test",
+				&fakeTemplateRenderer{err: nil},
+				&fakeCloudSetup{teardownErr: nil},
+				&fakeCloudSubscriber{unsubscribeErr: errCloudUnsubscribe},
+				&fakeTerraformClient{output: []byte("test"), destroyErr: nil},
+				&fakeStackLocker{},
+				&fakeArtifactStore{},
+				&fakeEventSink{},
+			),
+			expected: errCloudUnsubscribe,
+		},
+		"terraform destroy error": {
+			stack: stack.New(
+				"test",
+				&fakeTemplateRenderer{err: nil},
+				&fakeCloudSetup{teardownErr: nil},
+				&fakeCloudSubscriber{unsubscribeErr: nil},
+				&fakeTerraformClient{output: []byte("test"), destroyErr: errTerraformDestroy},
+				&fakeStackLocker{},
+				&fakeArtifactStore{},
+				&fakeEventSink{},
+			),
+			expected: errTerraformDestroy,
+		},
+		"cloud teardown error": {
+			stack: stack.New(
+				"test",
+				&fakeTemplateRenderer{err: nil},
+				&fakeCloudSetup{teardownErr: errCloudTeardown},
+				&fakeCloudSubscriber{unsubscribeErr: nil},
+				&fakeTerraformClient{output: []byte("test"), destroyErr: nil},
+				&fakeStackLocker{},
+				&fakeArtifactStore{},
+				&fakeEventSink{},
+			),
+			expected: errCloudTeardown,
+		},
+		"stack lock error": {
+			stack: stack.New(
+				"test",
+				&fakeTemplateRenderer{err: nil},
+				&fakeCloudSetup{teardownErr: nil},
+				&fakeCloudSubscriber{unsubscribeErr: nil},
+				&fakeTerraformClient{output: []byte("test"), destroyErr: nil},
+				&fakeStackLocker{lockErr: errStackLock},
+				&fakeArtifactStore{},
+				&fakeEventSink{},
+			),
+			expected: errStackLock,
+		},
 	}
 
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
-			err := tc.stack.Deploy(context.Background())
+			err := tc.stack.Remove(context.Background())
 			assert.ErrorIs(t, err, tc.expected)
 		})
 	}
 }
 
+func TestInfo(t *testing.T) {
+	info := &stack.Info{
+		ReleaseBucket:      "test-release",
+		EC2InstanceProfile: "test-ec2",
+		ScheduleRules:      map[string]string{"redfin": "test-build-schedule-redfin"},
+		OTABaseURL:         "https://test-release.s3.amazonaws.com",
+	}
+
+	tests := map[string]struct {
+		stack       *stack.Stack
+		expected    *stack.Info
+		expectedErr error
+	}{
+		"info with no errors": {
+			stack: stack.New(
+				"test",
+				&fakeTemplateRenderer{err: nil},
+				&fakeCloudSetup{err: nil},
+				&fakeCloudSubscriber{subscribed: false, err: nil},
+				&fakeTerraformClient{info: info},
+				&fakeStackLocker{},
+				&fakeArtifactStore{},
+				&fakeEventSink{},
+			),
+			expected:    info,
+			expectedErr: nil,
+		},
+		"template render error": {
+			stack: stack.New(
+				"test",
+				&fakeTemplateRenderer{err: errTemplateRender},
+				&fakeCloudSetup{err: nil},
+				&fakeCloudSubscriber{subscribed: false, err: nil},
+				&fakeTerraformClient{info: info},
+				&fakeStackLocker{},
+				&fakeArtifactStore{},
+				&fakeEventSink{},
+			),
+			expected:    nil,
+			expectedErr: errTemplateRender,
+		},
+		"terraform output error": {
+			stack: stack.New(
+				"test",
+				&fakeTemplateRenderer{err: nil},
+				&fakeCloudSetup{err: nil},
+				&fakeCloudSubscriber{subscribed: false, err: nil},
+				&fakeTerraformClient{outputErr: errTerraformOutput},
+				&fakeStackLocker{},
+				&fakeArtifactStore{},
+				&fakeEventSink{},
+			),
+			expected:    nil,
+			expectedErr: errTerraformOutput,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			output, err := tc.stack.Info(context.Background())
+			assert.ErrorIs(t, err, tc.expectedErr)
+			assert.Equal(t, tc.expected, output)
+		})
+	}
+}
+
+func TestResources(t *testing.T) {
+	state := map[string]map[string]string{
+		"aws_iam_role.rattlesnake_ec2_role": {
+			"arn":                "arn:aws:iam::123456789012:role/test-ec2",
+			"assume_role_policy": "{}",
+			"id":                 "test-ec2",
+			"name":               "test-ec2",
+		},
+		"aws_s3_bucket.rattlesnake_s3_keys": {
+			"arn":    "arn:aws:s3:::test-keys",
+			"bucket": "test-keys",
+			"id":     "test-keys",
+			"region": "us-west-2",
+		},
+		"aws_sns_topic.rattlesnake": {
+			"arn":  "arn:aws:sns:us-west-2:123456789012:test",
+			"id":   "arn:aws:sns:us-west-2:123456789012:test",
+			"name": "test",
+		},
+		"aws_s3_object.rattlesnake_s3_script_file": {
+			"bucket": "test-script",
+			"etag":   "abc123",
+			"id":     "build.sh",
+			"key":    "build.sh",
+		},
+	}
+	setupResources := []*stack.Resource{
+		{Address: "setup.aws_s3_bucket.test", Type: "aws_s3_bucket", ID: "test", Region: "us-west-2", ManagedBy: stack.ManagedBySetup},
+	}
+
+	tests := map[string]struct {
+		stack       *stack.Stack
+		expected    []*stack.Resource
+		expectedErr error
+	}{
+		"terraform and setup resources are listed": {
+			stack: stack.New(
+				"test",
+				&fakeTemplateRenderer{err: nil},
+				&fakeCloudSetup{resources: setupResources},
+				&fakeCloudSubscriber{subscribed: false, err: nil},
+				&fakeTerraformClient{state: state},
+				&fakeStackLocker{},
+				&fakeArtifactStore{},
+				&fakeEventSink{},
+			),
+			expected: []*stack.Resource{
+				{
+					Address:    "aws_iam_role.rattlesnake_ec2_role",
+					Type:       "aws_iam_role",
+					ID:         "test-ec2",
+					Region:     stack.RegionGlobal,
+					ManagedBy:  stack.ManagedByTerraform,
+					Attributes: map[string]string{"arn": "arn:aws:iam::123456789012:role/test-ec2", "name": "test-ec2"},
+				},
+				{
+					Address:    "aws_s3_bucket.rattlesnake_s3_keys",
+					Type:       "aws_s3_bucket",
+					ID:         "test-keys",
+					Region:     "us-west-2",
+					ManagedBy:  stack.ManagedByTerraform,
+					Attributes: map[string]string{"arn": "arn:aws:s3:::test-keys", "bucket": "test-keys"},
+				},
+				{
+					Address:    "aws_s3_object.rattlesnake_s3_script_file",
+					Type:       "aws_s3_object",
+					ID:         "build.sh",
+					Region:     "",
+					ManagedBy:  stack.ManagedByTerraform,
+					Attributes: map[string]string{"bucket": "test-script", "key": "build.sh"},
+				},
+				{
+					Address:    "aws_sns_topic.rattlesnake",
+					Type:       "aws_sns_topic",
+					ID:         "arn:aws:sns:us-west-2:123456789012:test",
+					Region:     "us-west-2",
+					ManagedBy:  stack.ManagedByTerraform,
+					Attributes: map[string]string{"arn": "arn:aws:sns:us-west-2:123456789012:test", "name": "test"},
+				},
+				setupResources[0],
+			},
+			expectedErr: nil,
+		},
+		"terraform state error": {
+			stack: stack.New(
+				"test",
+				&fakeTemplateRenderer{err: nil},
+				&fakeCloudSetup{resources: setupResources},
+				&fakeCloudSubscriber{subscribed: false, err: nil},
+				&fakeTerraformClient{state: state, stateErr: errTerraformState},
+				&fakeStackLocker{},
+				&fakeArtifactStore{},
+				&fakeEventSink{},
+			),
+			expected:    nil,
+			expectedErr: errTerraformState,
+		},
+		"cloud resources error": {
+			stack: stack.New(
+				"test",
+				&fakeTemplateRenderer{err: nil},
+				&fakeCloudSetup{resourcesErr: errCloudResources},
+				&fakeCloudSubscriber{subscribed: false, err: nil},
+				&fakeTerraformClient{state: state},
+				&fakeStackLocker{},
+				&fakeArtifactStore{},
+				&fakeEventSink{},
+			),
+			expected:    nil,
+			expectedErr: errCloudResources,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			resources, err := tc.stack.Resources(context.Background())
+			assert.ErrorIs(t, err, tc.expectedErr)
+			assert.Equal(t, tc.expected, resources)
+		})
+	}
+}
+
+func TestResource(t *testing.T) {
+	attributes := map[string]string{
+		"arn":                "arn:aws:iam::123456789012:role/test-ec2",
+		"assume_role_policy": "{}",
+		"id":                 "test-ec2",
+		"name":               "test-ec2",
+	}
+	s := stack.New(
+		"test",
+		&fakeTemplateRenderer{err: nil},
+		&fakeCloudSetup{},
+		&fakeCloudSubscriber{subscribed: false, err: nil},
+		&fakeTerraformClient{state: map[string]map[string]string{"aws_iam_role.rattlesnake_ec2_role": attributes}},
+		&fakeStackLocker{},
+		&fakeArtifactStore{},
+		&fakeEventSink{},
+	)
+
+	resource, err := s.Resource(context.Background(), "aws_iam_role.rattlesnake_ec2_role")
+	assert.Nil(t, err)
+	assert.Equal(t, &stack.Resource{
+		Address:    "aws_iam_role.rattlesnake_ec2_role",
+		Type:       "aws_iam_role",
+		ID:         "test-ec2",
+		Region:     stack.RegionGlobal,
+		ManagedBy:  stack.ManagedByTerraform,
+		Attributes: attributes,
+	}, resource)
+}
+
+func TestAdopt(t *testing.T) {
+	adoptable := []*stack.Resource{
+		{Address: "aws_s3_bucket.rattlesnake_s3_keys", Type: "aws_s3_bucket", ID: "test-keys"},
+		{Address: "aws_sns_topic.rattlesnake", Type: "aws_sns_topic", ID: "arn:aws:sns:us-west-2:123456789012:test"},
+	}
+	state := map[string]map[string]string{
+		"aws_s3_bucket.rattlesnake_s3_keys": {"id": "test-keys"},
+	}
+
+	tests := map[string]struct {
+		terraformClient  *fakeTerraformClient
+		cloudSetup       *fakeCloudSetup
+		adopter          *fakeCloudAdopter
+		expectedImported []string
+		expectedErr      error
+	}{
+		"resources missing from state are imported": {
+			terraformClient:  &fakeTerraformClient{state: state},
+			cloudSetup:       &fakeCloudSetup{},
+			adopter:          &fakeCloudAdopter{resources: adoptable},
+			expectedImported: []string{"aws_sns_topic.rattlesnake=arn:aws:sns:us-west-2:123456789012:test"},
+			expectedErr:      nil,
+		},
+		"all resources imported with empty state": {
+			terraformClient: &fakeTerraformClient{},
+			cloudSetup:      &fakeCloudSetup{},
+			adopter:         &fakeCloudAdopter{resources: adoptable},
+			expectedImported: []string{
+				"aws_s3_bucket.rattlesnake_s3_keys=test-keys",
+				"aws_sns_topic.rattlesnake=arn:aws:sns:us-west-2:123456789012:test",
+			},
+			expectedErr: nil,
+		},
+		"nothing to import": {
+			terraformClient:  &fakeTerraformClient{state: state},
+			cloudSetup:       &fakeCloudSetup{},
+			adopter:          &fakeCloudAdopter{},
+			expectedImported: nil,
+			expectedErr:      nil,
+		},
+		"cloud setup error": {
+			terraformClient:  &fakeTerraformClient{},
+			cloudSetup:       &fakeCloudSetup{err: errCloudSetup},
+			adopter:          &fakeCloudAdopter{resources: adoptable},
+			expectedImported: nil,
+			expectedErr:      errCloudSetup,
+		},
+		"terraform state error": {
+			terraformClient:  &fakeTerraformClient{stateErr: errTerraformState},
+			cloudSetup:       &fakeCloudSetup{},
+			adopter:          &fakeCloudAdopter{resources: adoptable},
+			expectedImported: nil,
+			expectedErr:      errTerraformState,
+		},
+		"cloud adoptable error": {
+			terraformClient:  &fakeTerraformClient{},
+			cloudSetup:       &fakeCloudSetup{},
+			adopter:          &fakeCloudAdopter{err: errCloudAdoptable},
+			expectedImported: nil,
+			expectedErr:      errCloudAdoptable,
+		},
+		"terraform import error": {
+			terraformClient:  &fakeTerraformClient{importErr: errTerraformImport},
+			cloudSetup:       &fakeCloudSetup{},
+			adopter:          &fakeCloudAdopter{resources: adoptable},
+			expectedImported: nil,
+			expectedErr:      errTerraformImport,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := stack.New(
+				"test",
+				&fakeTemplateRenderer{err: nil},
+				tc.cloudSetup,
+				&fakeCloudSubscriber{subscribed: false, err: nil},
+				tc.terraformClient,
+				&fakeStackLocker{},
+				&fakeArtifactStore{},
+				&fakeEventSink{},
+			)
+			err := s.Adopt(context.Background(), tc.adopter)
+			assert.ErrorIs(t, err, tc.expectedErr)
+			assert.Equal(t, tc.expectedImported, tc.terraformClient.imported)
+		})
+	}
+}
+
+func TestDrift(t *testing.T) {
+	terraformDrift := []*stack.Drift{
+		{Address: "aws_lambda_function.rattlesnake_lambda_build", Action: stack.DriftActionUpdate, Attribute: "timeout", Expected: "180", Actual: "300"},
+	}
+
+	tests := map[string]struct {
+		terraformClient  *fakeTerraformClient
+		templateRenderer *fakeTemplateRenderer
+		expected         []*stack.Drift
+		expectedErr      error
+	}{
+		"no drift": {
+			terraformClient:  &fakeTerraformClient{},
+			templateRenderer: &fakeTemplateRenderer{},
+			expected:         nil,
+			expectedErr:      nil,
+		},
+		"terraform drift": {
+			terraformClient:  &fakeTerraformClient{drift: terraformDrift},
+			templateRenderer: &fakeTemplateRenderer{},
+			expected:         terraformDrift,
+			expectedErr:      nil,
+		},
+		"template render error": {
+			terraformClient:  &fakeTerraformClient{},
+			templateRenderer: &fakeTemplateRenderer{err: errTemplateRender},
+			expected:         nil,
+			expectedErr:      errTemplateRender,
+		},
+		"terraform drift error": {
+			terraformClient:  &fakeTerraformClient{driftErr: errTerraformDrift},
+			templateRenderer: &fakeTemplateRenderer{},
+			expected:         nil,
+			expectedErr:      errTerraformDrift,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := stack.New(
+				"test",
+				tc.templateRenderer,
+				&fakeCloudSetup{},
+				&fakeCloudSubscriber{subscribed: false, err: nil},
+				tc.terraformClient,
+				&fakeStackLocker{},
+				&fakeArtifactStore{},
+				&fakeEventSink{},
+			)
+			drift, err := s.Drift(context.Background())
+			assert.ErrorIs(t, err, tc.expectedErr)
+			assert.Equal(t, tc.expected, drift)
+		})
+	}
+}
+
+func TestDiff(t *testing.T) {
+	deployed := map[string][]byte{
+		"build.sh": []byte("#!/usr/bin/env bash\nSTACK_NAME=\"test\"\n"),
+		"main.tf":  []byte("variable \"name\" {}\n"),
+		"old.txt":  []byte("old\n"),
+	}
+
+	tests := map[string]struct {
+		templateRenderer *fakeTemplateRenderer
+		artifactStore    *fakeArtifactStore
+		expected         []*stack.ArtifactDiff
+		expectedErr      error
+	}{
+		"nothing changed": {
+			templateRenderer: &fakeTemplateRenderer{artifacts: deployed},
+			artifactStore:    &fakeArtifactStore{last: deployed},
+			expected:         nil,
+			expectedErr:      nil,
+		},
+		"changed, added and removed files": {
+			templateRenderer: &fakeTemplateRenderer{artifacts: map[string][]byte{
+				"build.sh":      []byte("#!/usr/bin/env bash\nSTACK_NAME=\"renamed\"\n"),
+				"main.tf":       deployed["main.tf"],
+				"manifest.json": []byte("{}\n"),
+			}},
+			artifactStore: &fakeArtifactStore{last: deployed},
+			expected: []*stack.ArtifactDiff{
+				{
+					Name: "build.sh",
+					Diff: "--- deployed/build.sh\n+++ rendered/build.sh\n@@ -1,2 +1,2 @@\n #!/usr/bin/env bash\n" +
+						"-STACK_NAME=\"test\"\n+STACK_NAME=\"renamed\"\n",
+				},
+				{Name: "manifest.json", Diff: "--- /dev/null\n+++ rendered/manifest.json\n@@ -0,0 +1 @@\n+{}\n"},
+				{Name: "old.txt", Diff: "--- deployed/old.txt\n+++ /dev/null\n@@ -1 +0,0 @@\n-old\n"},
+			},
+			expectedErr: nil,
+		},
+		"template render error": {
+			templateRenderer: &fakeTemplateRenderer{err: errTemplateRender},
+			artifactStore:    &fakeArtifactStore{last: deployed},
+			expected:         nil,
+			expectedErr:      errTemplateRender,
+		},
+		"artifacts last error": {
+			templateRenderer: &fakeTemplateRenderer{artifacts: deployed},
+			artifactStore:    &fakeArtifactStore{lastErr: errArtifactsLast},
+			expected:         nil,
+			expectedErr:      errArtifactsLast,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := stack.New(
+				"test",
+				tc.templateRenderer,
+				&fakeCloudSetup{},
+				&fakeCloudSubscriber{subscribed: false, err: nil},
+				&fakeTerraformClient{},
+				&fakeStackLocker{},
+				tc.artifactStore,
+				&fakeEventSink{},
+			)
+			diffs, err := s.Diff(context.Background())
+			assert.ErrorIs(t, err, tc.expectedErr)
+			assert.Equal(t, tc.expected, diffs)
+		})
+	}
+}
+
+func TestDiffEvents(t *testing.T) {
+	sink := &fakeEventSink{}
+	s := stack.New(
+		"test",
+		&fakeTemplateRenderer{artifacts: map[string][]byte{"build.sh": []byte("new\n"), "main.tf": []byte("same\n")}},
+		&fakeCloudSetup{},
+		&fakeCloudSubscriber{},
+		&fakeTerraformClient{},
+		&fakeStackLocker{},
+		&fakeArtifactStore{last: map[string][]byte{"build.sh": []byte("old\n"), "main.tf": []byte("same\n")}},
+		sink,
+	)
+	_, err := s.Diff(context.Background())
+	assert.Nil(t, err)
+
+	var output []string
+	for _, event := range sink.events {
+		assert.Equal(t, "test", event.Stack)
+		output = append(output, fmt.Sprintf("%v %v%v", event.Type, event.Phase, event.File))
+	}
+	assert.Equal(t, []string{
+		"phase_started diff", "phase_started render", "phase_finished render",
+		"diff build.sh",
+		"phase_finished diff",
+	}, output)
+	assert.Equal(t, "--- deployed/build.sh\n+++ rendered/build.sh\n@@ -1 +1 @@\n-old\n+new\n", sink.events[3].Diff)
+}
+
+func TestDeploySavesArtifacts(t *testing.T) {
+	artifacts := map[string][]byte{"build.sh": []byte("#!/usr/bin/env bash\n")}
+	artifactStore := &fakeArtifactStore{}
+	s := stack.New(
+		"test",
+		&fakeTemplateRenderer{artifacts: artifacts},
+		&fakeCloudSetup{},
+		&fakeCloudSubscriber{subscribed: false, err: nil},
+		&fakeTerraformClient{output: []byte("test")},
+		&fakeStackLocker{},
+		artifactStore,
+		&fakeEventSink{},
+	)
+
+	assert.Nil(t, s.Deploy(context.Background(), stack.DefaultDeployTimeout, nil))
+	assert.Equal(t, artifacts, artifactStore.saved)
+}
+
+func TestMigrateState(t *testing.T) {
+	state := []byte(`{"version": 4, "serial": 3}`)
+
+	tests := map[string]struct {
+		backendStates map[string][]byte
+		sourceErr     error
+		pullErr       error
+		pushErr       error
+		expected      map[string][]byte
+		expectedErr   error
+	}{
+		"state is copied to destination": {
+			backendStates: map[string][]byte{"source": state},
+			expected:      map[string][]byte{"source": state, "destination": state},
+			expectedErr:   nil,
+		},
+		"no source state": {
+			backendStates: map[string][]byte{"source": []byte("\n")},
+			expected:      map[string][]byte{"source": []byte("\n")},
+			expectedErr:   stack.ErrNoState,
+		},
+		"existing destination state isn't overwritten": {
+			backendStates: map[string][]byte{"source": state, "destination": []byte(`{"version": 4}`)},
+			expected:      map[string][]byte{"source": state, "destination": []byte(`{"version": 4}`)},
+			expectedErr:   stack.ErrStateExists,
+		},
+		"source render error": {
+			backendStates: map[string][]byte{"source": state},
+			sourceErr:     errTemplateRender,
+			expected:      map[string][]byte{"source": state},
+			expectedErr:   errTemplateRender,
+		},
+		"state pull error": {
+			backendStates: map[string][]byte{"source": state},
+			pullErr:       errStatePull,
+			expected:      map[string][]byte{"source": state},
+			expectedErr:   errStatePull,
+		},
+		"state push error": {
+			backendStates: map[string][]byte{"source": state},
+			pushErr:       errStatePush,
+			expected:      map[string][]byte{"source": state},
+			expectedErr:   errStatePush,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			renderer := &fakeBackendRenderer{}
+			terraformClient := &fakeTerraformClient{
+				backendStates: tc.backendStates,
+				renderer:      renderer,
+				pullErr:       tc.pullErr,
+				pushErr:       tc.pushErr,
+			}
+			s := stack.New(
+				"test",
+				&fakeBackendTemplates{renderer: renderer, backend: "destination"},
+				&fakeCloudSetup{},
+				&fakeCloudSubscriber{subscribed: false, err: nil},
+				terraformClient,
+				&fakeStackLocker{},
+				&fakeArtifactStore{},
+				&fakeEventSink{},
+			)
+			err := s.MigrateState(context.Background(), &fakeBackendTemplates{renderer: renderer, backend: "source", err: tc.sourceErr})
+			assert.ErrorIs(t, err, tc.expectedErr)
+			assert.Equal(t, tc.expected, terraformClient.backendStates)
+		})
+	}
+}
+
+func TestDeployEvents(t *testing.T) {
+	tests := map[string]struct {
+		terraformClient *fakeTerraformClient
+		expected        []string
+		expectedErrors  map[string]string
+	}{
+		"deploy emits started and finished events for each phase": {
+			terraformClient: &fakeTerraformClient{output: []byte("test")},
+			expected: []string{
+				"phase_started deploy", "phase_started render", "phase_finished render",
+				"phase_started lock", "phase_finished lock",
+				"phase_started terraform_plan", "phase_finished terraform_plan",
+				"phase_started setup", "phase_finished setup",
+				"phase_started terraform_apply", "phase_finished terraform_apply",
+				"phase_started save_artifacts", "phase_finished save_artifacts",
+				"phase_started subscribe", "phase_finished subscribe",
+				"phase_started unlock", "phase_finished unlock",
+				"phase_finished deploy",
+			},
+			expectedErrors: map[string]string{},
+		},
+		"failed phase finishes with error and stops deploy": {
+			terraformClient: &fakeTerraformClient{output: []byte("test"), err: errTerraformApply},
+			expected: []string{
+				"phase_started deploy", "phase_started render", "phase_finished render",
+				"phase_started lock", "phase_finished lock",
+				"phase_started terraform_plan", "phase_finished terraform_plan",
+				"phase_started setup", "phase_finished setup",
+				"phase_started terraform_apply", "phase_finished terraform_apply",
+				"phase_started unlock", "phase_finished unlock",
+				"phase_finished deploy",
+			},
+			expectedErrors: map[string]string{
+				stack.PhaseTerraformApply: errTerraformApply.Error(),
+				stack.PhaseDeploy:         errTerraformApply.Error(),
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			sink := &fakeEventSink{}
+			s := stack.New(
+				"test",
+				&fakeTemplateRenderer{},
+				&fakeCloudSetup{},
+				&fakeCloudSubscriber{},
+				tc.terraformClient,
+				&fakeStackLocker{},
+				&fakeArtifactStore{},
+				sink,
+			)
+			_ = s.Deploy(context.Background(), stack.DefaultDeployTimeout, nil)
+
+			var output []string
+			errs := map[string]string{}
+			for _, event := range sink.events {
+				assert.Equal(t, "test", event.Stack)
+				output = append(output, fmt.Sprintf("%v %v", event.Type, event.Phase))
+				if event.Error != "" {
+					errs[event.Phase] = event.Error
+				}
+			}
+			assert.Equal(t, tc.expected, output)
+			assert.Equal(t, tc.expectedErrors, errs)
+		})
+	}
+}
+
 type fakeTemplateRenderer struct {
-	err error
+	err       error
+	artifacts map[string][]byte
 }
 
 func (f *fakeTemplateRenderer) RenderAll() error {
 	return f.err
 }
 
+func (f *fakeTemplateRenderer) Artifacts() (map[string][]byte, error) {
+	return f.artifacts, nil
+}
+
+// fakeBackendRenderer records which backend was rendered last, as the rendered templates decide which backend
+// terraform uses
+type fakeBackendRenderer struct {
+	current string
+}
+
+type fakeBackendTemplates struct {
+	renderer *fakeBackendRenderer
+	backend  string
+	err      error
+}
+
+func (f *fakeBackendTemplates) Artifacts() (map[string][]byte, error) {
+	return nil, nil
+}
+
+func (f *fakeBackendTemplates) RenderAll() error {
+	if f.err != nil {
+		return f.err
+	}
+	f.renderer.current = f.backend
+	return nil
+}
+
 type fakeCloudSetup struct {
-	err error
+	err          error
+	setupRun     bool
+	backupErr    error
+	teardownErr  error
+	resources    []*stack.Resource
+	resourcesErr error
+	excluded     []string
 }
 
 func (f *fakeCloudSetup) Setup(ctx context.Context) error {
+	f.setupRun = true
 	return f.err
 }
 
+func (f *fakeCloudSetup) BackupState(ctx context.Context) error {
+	return f.backupErr
+}
+
+func (f *fakeCloudSetup) Teardown(ctx context.Context) error {
+	return f.teardownErr
+}
+
+func (f *fakeCloudSetup) Resources(ctx context.Context) ([]*stack.Resource, error) {
+	return f.resources, f.resourcesErr
+}
+
+func (f *fakeCloudSetup) ExcludedResources() []string {
+	return f.excluded
+}
+
 type fakeCloudSubscriber struct {
-	subscribed bool
-	err        error
+	subscribed     bool
+	err            error
+	unsubscribeErr error
 }
 
 func (f *fakeCloudSubscriber) Subscribe(ctx context.Context) (bool, error) {
 	return f.subscribed, f.err
 }
 
-type fakeTerraformApplier struct {
-	output []byte
-	err    error
+func (f *fakeCloudSubscriber) Unsubscribe(ctx context.Context) error {
+	return f.unsubscribeErr
 }
 
-func (f *fakeTerraformApplier) Apply(ctx context.Context) ([]byte, error) {
+type fakeTerraformClient struct {
+	output     []byte
+	err        error
+	applied    bool
+	planErr    error
+	destroyErr error
+	info       *stack.Info
+	outputErr  error
+	state      map[string]map[string]string
+	stateErr   error
+	importErr  error
+	imported   []string
+	drift      []*stack.Drift
+	driftErr   error
+	// backendStates is the state returned by StatePull for each backend, keyed by the last backend rendered
+	backendStates map[string][]byte
+	renderer      *fakeBackendRenderer
+	pullErr       error
+	pushErr       error
+}
+
+func (f *fakeTerraformClient) ApplyPlan(ctx context.Context) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.applied = true
 	return f.output, f.err
 }
+
+func (f *fakeTerraformClient) Plan(ctx context.Context) ([]byte, error) {
+	return f.output, f.planErr
+}
+
+func (f *fakeTerraformClient) Destroy(ctx context.Context) ([]byte, error) {
+	return f.output, f.destroyErr
+}
+
+func (f *fakeTerraformClient) StateList(ctx context.Context) ([]string, error) {
+	var addresses []string
+	for address := range f.state {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	return addresses, f.stateErr
+}
+
+func (f *fakeTerraformClient) StateResources(ctx context.Context) ([]string, error) {
+	return f.StateList(ctx)
+}
+
+func (f *fakeTerraformClient) StateShow(ctx context.Context, address string) (map[string]string, error) {
+	return f.state[address], f.stateErr
+}
+
+func (f *fakeTerraformClient) Import(ctx context.Context, address, id string) ([]byte, error) {
+	if f.importErr != nil {
+		return f.output, f.importErr
+	}
+	f.imported = append(f.imported, fmt.Sprintf("%v=%v", address, id))
+	return f.output, nil
+}
+
+func (f *fakeTerraformClient) Drift(ctx context.Context) ([]*stack.Drift, error) {
+	return f.drift, f.driftErr
+}
+
+func (f *fakeTerraformClient) StatePull(ctx context.Context) ([]byte, error) {
+	return f.backendStates[f.renderer.current], f.pullErr
+}
+
+func (f *fakeTerraformClient) StatePush(ctx context.Context, state []byte) error {
+	if f.pushErr != nil {
+		return f.pushErr
+	}
+	f.backendStates[f.renderer.current] = state
+	return nil
+}
+
+func (f *fakeTerraformClient) Output(ctx context.Context, v interface{}) error {
+	if f.outputErr != nil {
+		return f.outputErr
+	}
+	*v.(*stack.Info) = *f.info
+	return nil
+}
+
+type fakeCloudAdopter struct {
+	resources []*stack.Resource
+	err       error
+}
+
+func (f *fakeCloudAdopter) Adoptable(ctx context.Context) ([]*stack.Resource, error) {
+	return f.resources, f.err
+}
+
+type fakeArtifactStore struct {
+	saved   map[string][]byte
+	saveErr error
+	last    map[string][]byte
+	lastErr error
+}
+
+func (f *fakeArtifactStore) Save(ctx context.Context, artifacts map[string][]byte) error {
+	if f.saveErr != nil {
+		return f.saveErr
+	}
+	f.saved = artifacts
+	return nil
+}
+
+func (f *fakeArtifactStore) Last(ctx context.Context) (map[string][]byte, error) {
+	return f.last, f.lastErr
+}
+
+type fakeStackLocker struct {
+	locked    bool
+	lockErr   error
+	unlockErr error
+}
+
+func (f *fakeStackLocker) Lock(ctx context.Context, operation string) error {
+	f.locked = f.lockErr == nil
+	return f.lockErr
+}
+
+func (f *fakeStackLocker) Unlock(ctx context.Context) error {
+	f.locked = false
+	return f.unlockErr
+}
+
+type fakeEventSink struct {
+	events []events.Event
+}
+
+func (f *fakeEventSink) Emit(event events.Event) {
+	f.events = append(f.events, event)
+}
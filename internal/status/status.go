@@ -0,0 +1,225 @@
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dan-v/rattlesnakeos-stack/internal/version"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultStatusTimeout is the default timeout for gathering stack status
+	DefaultStatusTimeout = time.Second * 30
+)
+
+const (
+	// ComponentRelease is the name of the release component
+	ComponentRelease = "release"
+	// ComponentVendor is the name of the vendor build id component
+	ComponentVendor = "vendor build id"
+	// ComponentChromium is the name of the chromium component
+	ComponentChromium = "chromium"
+	// ComponentStack is the name of the rattlesnakeos-stack version component
+	ComponentStack = "stack version"
+)
+
+var (
+	// ErrLatestFetch is returned if latest versions can't be retrieved from releases url
+	ErrLatestFetch = errors.New("failed to fetch latest versions")
+	// ErrDeviceNotInLatest is returned if device is missing from latest versions
+	ErrDeviceNotInLatest = errors.New("device not found in latest versions")
+)
+
+// MetadataReader is an interface for reading metadata written by builds
+type MetadataReader interface {
+	GetMetadata(ctx context.Context, key string) (string, error)
+}
+
+// Latest contains the latest component versions from the releases url
+type Latest struct {
+	Release             string                  `json:"release"`
+	Chromium            string                  `json:"chromium"`
+	MinimumStackVersion string                  `json:"minimum_stack_version"`
+	Devices             map[string]LatestDevice `json:"devices"`
+}
+
+// LatestDevice contains the latest device specific versions from the releases url
+type LatestDevice struct {
+	BuildID string `json:"build_id"`
+	AOSPTag string `json:"aosp_tag"`
+}
+
+// Component is the deployed and latest version of a single build component
+type Component struct {
+	// Name is the name of the component
+	Name string
+	// Current is the version from the last successful build (empty if never built)
+	Current string
+	// Latest is the version that would be used for the next build
+	Latest string
+	// Behind is whether the current version is older than the latest version
+	Behind bool
+}
+
+// DeviceStatus contains the build freshness of a single device
+type DeviceStatus struct {
+	// Device is the device code name
+	Device string
+	// Components are the versions of all tracked components
+	Components []Component
+	// LastOTAPublished is when the last OTA was published (zero if never published)
+	LastOTAPublished time.Time
+	// BelowMinimumStackVersion is whether builds will be cancelled until stack is updated
+	BelowMinimumStackVersion bool
+}
+
+// UpToDate returns whether all components are up to date
+func (d *DeviceStatus) UpToDate() bool {
+	for _, component := range d.Components {
+		if component.Behind {
+			return false
+		}
+	}
+	return true
+}
+
+// Client gathers the status of a deployed stack and compares it with the latest versions
+type Client struct {
+	metadataReader        MetadataReader
+	releasesURL           string
+	stackVersion          string
+	chromiumVersion       string
+	chromiumBuildDisabled bool
+	devices               []string
+	httpClient            *http.Client
+}
+
+// New returns an initialized Client for a stack that builds devices. If chromiumVersion is set, it is used instead of
+// the latest chromium version.
+func New(metadataReader MetadataReader, releasesURL, stackVersion, chromiumVersion string, chromiumBuildDisabled bool,
+	devices []string) *Client {
+	return &Client{
+		metadataReader:        metadataReader,
+		releasesURL:           releasesURL,
+		stackVersion:          stackVersion,
+		chromiumVersion:       chromiumVersion,
+		chromiumBuildDisabled: chromiumBuildDisabled,
+		devices:               devices,
+		httpClient:            http.DefaultClient,
+	}
+}
+
+// GetLatest fetches the latest component versions from the releases url
+func (c *Client) GetLatest(ctx context.Context) (*Latest, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.releasesURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", err, ErrLatestFetch)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %v from %v: %w", resp.StatusCode, c.releasesURL, ErrLatestFetch)
+	}
+
+	latest := &Latest{}
+	if err := json.NewDecoder(resp.Body).Decode(latest); err != nil {
+		return nil, fmt.Errorf("failed to parse %v: %v: %w", c.releasesURL, err, ErrLatestFetch)
+	}
+	return latest, nil
+}
+
+// GetDeviceStatus reads build metadata for device and compares it with latest
+func (c *Client) GetDeviceStatus(ctx context.Context, latest *Latest, device string) (*DeviceStatus, error) {
+	latestDevice, ok := latest.Devices[device]
+	if !ok {
+		return nil, fmt.Errorf("'%v': %w", device, ErrDeviceNotInLatest)
+	}
+
+	// stacks that only supported a single device stored some metadata without a device prefix. the release only
+	// belongs to the original device, so devices added since then are behind until they are built.
+	releaseKeys := []string{fmt.Sprintf("%v-release", device)}
+	if len(c.devices) == 1 {
+		releaseKeys = append(releaseKeys, "release")
+	}
+	release, err := c.getMetadata(ctx, releaseKeys...)
+	if err != nil {
+		return nil, err
+	}
+	vendor, err := c.getMetadata(ctx, fmt.Sprintf("%v-vendor", device))
+	if err != nil {
+		return nil, err
+	}
+	stack, err := c.getMetadata(ctx, "rattlesnakeos-stack/revision")
+	if err != nil {
+		return nil, err
+	}
+	stable, err := c.getMetadata(ctx, fmt.Sprintf("%v-stable", device))
+	if err != nil {
+		return nil, err
+	}
+
+	status := &DeviceStatus{
+		Device: device,
+		Components: []Component{
+			{Name: ComponentRelease, Current: release, Latest: latest.Release, Behind: release == "" || version.Compare(release, latest.Release) < 0},
+			{Name: ComponentVendor, Current: vendor, Latest: latestDevice.BuildID, Behind: vendor != latestDevice.BuildID},
+		},
+		LastOTAPublished:         parseOTATimestamp(stable),
+		BelowMinimumStackVersion: stack != "" && latest.MinimumStackVersion != "" && version.Compare(stack, latest.MinimumStackVersion) < 0,
+	}
+
+	if !c.chromiumBuildDisabled {
+		chromium, err := c.getMetadata(ctx, fmt.Sprintf("chromium/%v/revision", device), "chromium/revision")
+		if err != nil {
+			return nil, err
+		}
+		latestChromium := latest.Chromium
+		if c.chromiumVersion != "" {
+			latestChromium = c.chromiumVersion
+		}
+		status.Components = append(status.Components,
+			Component{Name: ComponentChromium, Current: chromium, Latest: latestChromium, Behind: chromium != latestChromium})
+	}
+
+	status.Components = append(status.Components,
+		Component{Name: ComponentStack, Current: stack, Latest: c.stackVersion, Behind: stack == "" || version.Compare(stack, c.stackVersion) < 0})
+
+	return status, nil
+}
+
+// getMetadata returns the first non empty metadata value from keys
+func (c *Client) getMetadata(ctx context.Context, keys ...string) (string, error) {
+	for _, key := range keys {
+		value, err := c.metadataReader.GetMetadata(ctx, key)
+		if err != nil {
+			return "", err
+		}
+		if value != "" {
+			return value, nil
+		}
+	}
+	return "", nil
+}
+
+// parseOTATimestamp parses release channel metadata in the format '<build date> <build timestamp> <build id> <channel>'
+func parseOTATimestamp(metadata string) time.Time {
+	fields := strings.Fields(metadata)
+	if len(fields) < 2 {
+		return time.Time{}
+	}
+	timestamp, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(timestamp, 0).UTC()
+}
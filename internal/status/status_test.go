@@ -0,0 +1,259 @@
+package status
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var errMetadataRead = errors.New("metadata read error")
+
+func TestClient_GetLatest(t *testing.T) {
+	tests := map[string]struct {
+		statusCode  int
+		body        string
+		expected    *Latest
+		expectedErr error
+	}{
+		"happy path latest is parsed": {
+			statusCode: http.StatusOK,
+			body: `{"release": "2021.10.05.1", "chromium": "94.0.4606.71", "minimum_stack_version": "12.0.0",
+				"devices": {"redfin": {"build_id": "SP1A.211105.003", "aosp_tag": "android-12.0.0_r13"}}}`,
+			expected: &Latest{
+				Release:             "2021.10.05.1",
+				Chromium:            "94.0.4606.71",
+				MinimumStackVersion: "12.0.0",
+				Devices: map[string]LatestDevice{
+					"redfin": {BuildID: "SP1A.211105.003", AOSPTag: "android-12.0.0_r13"},
+				},
+			},
+			expectedErr: nil,
+		},
+		"non 200 status code returns error": {
+			statusCode:  http.StatusNotFound,
+			body:        "not found",
+			expected:    nil,
+			expectedErr: ErrLatestFetch,
+		},
+		"invalid json returns error": {
+			statusCode:  http.StatusOK,
+			body:        "{",
+			expected:    nil,
+			expectedErr: ErrLatestFetch,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.statusCode)
+				_, _ = fmt.Fprint(w, tc.body)
+			}))
+			defer server.Close()
+
+			client := New(&fakeMetadataReader{}, server.URL, "12.0.5", "", false, []string{"redfin"})
+			output, err := client.GetLatest(context.Background())
+			assert.ErrorIs(t, err, tc.expectedErr)
+			assert.Equal(t, tc.expected, output)
+		})
+	}
+}
+
+func TestClient_GetDeviceStatus(t *testing.T) {
+	latest := &Latest{
+		Release:             "2021.11.05.10",
+		Chromium:            "95.0.4638.50",
+		MinimumStackVersion: "12.0.0",
+		Devices: map[string]LatestDevice{
+			"redfin": {BuildID: "SP1A.211105.003"},
+		},
+	}
+
+	tests := map[string]struct {
+		metadata              map[string]string
+		metadataErr           error
+		chromiumVersion       string
+		chromiumBuildDisabled bool
+		devices               []string
+		device                string
+		expected              *DeviceStatus
+		expectedErr           error
+	}{
+		"up to date device": {
+			metadata: map[string]string{
+				"redfin-release":               "2021.11.05.10",
+				"redfin-vendor":                "SP1A.211105.003",
+				"redfin-stable":                "2021110512 1636100000 SP1A.211105.003 stable",
+				"chromium/redfin/revision":     "95.0.4638.50",
+				"rattlesnakeos-stack/revision": "12.0.5",
+			},
+			device: "redfin",
+			expected: &DeviceStatus{
+				Device: "redfin",
+				Components: []Component{
+					{Name: ComponentRelease, Current: "2021.11.05.10", Latest: "2021.11.05.10", Behind: false},
+					{Name: ComponentVendor, Current: "SP1A.211105.003", Latest: "SP1A.211105.003", Behind: false},
+					{Name: ComponentChromium, Current: "95.0.4638.50", Latest: "95.0.4638.50", Behind: false},
+					{Name: ComponentStack, Current: "12.0.5", Latest: "12.0.5", Behind: false},
+				},
+				LastOTAPublished: time.Unix(1636100000, 0).UTC(),
+			},
+			expectedErr: nil,
+		},
+		"behind device with legacy single device metadata": {
+			metadata: map[string]string{
+				"release":                      "2021.10.05.1",
+				"redfin-vendor":                "RQ3A.211001.001",
+				"chromium/revision":            "94.0.4606.71",
+				"rattlesnakeos-stack/revision": "11.0.9",
+			},
+			devices: []string{"redfin"},
+			device:  "redfin",
+			expected: &DeviceStatus{
+				Device: "redfin",
+				Components: []Component{
+					{Name: ComponentRelease, Current: "2021.10.05.1", Latest: "2021.11.05.10", Behind: true},
+					{Name: ComponentVendor, Current: "RQ3A.211001.001", Latest: "SP1A.211105.003", Behind: true},
+					{Name: ComponentChromium, Current: "94.0.4606.71", Latest: "95.0.4638.50", Behind: true},
+					{Name: ComponentStack, Current: "11.0.9", Latest: "12.0.5", Behind: true},
+				},
+				BelowMinimumStackVersion: true,
+			},
+			expectedErr: nil,
+		},
+		"added device doesn't use legacy single device release": {
+			metadata: map[string]string{
+				"release":                      "2021.11.05.10",
+				"redfin-vendor":                "SP1A.211105.003",
+				"chromium/revision":            "95.0.4638.50",
+				"rattlesnakeos-stack/revision": "12.0.5",
+			},
+			devices: []string{"sunfish", "redfin"},
+			device:  "redfin",
+			expected: &DeviceStatus{
+				Device: "redfin",
+				Components: []Component{
+					{Name: ComponentRelease, Current: "", Latest: "2021.11.05.10", Behind: true},
+					{Name: ComponentVendor, Current: "SP1A.211105.003", Latest: "SP1A.211105.003", Behind: false},
+					{Name: ComponentChromium, Current: "95.0.4638.50", Latest: "95.0.4638.50", Behind: false},
+					{Name: ComponentStack, Current: "12.0.5", Latest: "12.0.5", Behind: false},
+				},
+			},
+			expectedErr: nil,
+		},
+		"release compared numerically": {
+			metadata: map[string]string{
+				"redfin-release":               "2021.11.05.9",
+				"redfin-vendor":                "SP1A.211105.003",
+				"chromium/redfin/revision":     "95.0.4638.50",
+				"rattlesnakeos-stack/revision": "12.0.5",
+			},
+			devices: []string{"redfin"},
+			device:  "redfin",
+			expected: &DeviceStatus{
+				Device: "redfin",
+				Components: []Component{
+					{Name: ComponentRelease, Current: "2021.11.05.9", Latest: "2021.11.05.10", Behind: true},
+					{Name: ComponentVendor, Current: "SP1A.211105.003", Latest: "SP1A.211105.003", Behind: false},
+					{Name: ComponentChromium, Current: "95.0.4638.50", Latest: "95.0.4638.50", Behind: false},
+					{Name: ComponentStack, Current: "12.0.5", Latest: "12.0.5", Behind: false},
+				},
+			},
+			expectedErr: nil,
+		},
+		"never built device with pinned chromium": {
+			metadata:        map[string]string{},
+			chromiumVersion: "94.0.4606.71",
+			device:          "redfin",
+			expected: &DeviceStatus{
+				Device: "redfin",
+				Components: []Component{
+					{Name: ComponentRelease, Current: "", Latest: "2021.11.05.10", Behind: true},
+					{Name: ComponentVendor, Current: "", Latest: "SP1A.211105.003", Behind: true},
+					{Name: ComponentChromium, Current: "", Latest: "94.0.4606.71", Behind: true},
+					{Name: ComponentStack, Current: "", Latest: "12.0.5", Behind: true},
+				},
+			},
+			expectedErr: nil,
+		},
+		"chromium build disabled skips chromium": {
+			metadata: map[string]string{
+				"redfin-release":               "2021.11.05.10",
+				"redfin-vendor":                "SP1A.211105.003",
+				"rattlesnakeos-stack/revision": "12.0.10",
+			},
+			chromiumBuildDisabled: true,
+			device:                "redfin",
+			expected: &DeviceStatus{
+				Device: "redfin",
+				Components: []Component{
+					{Name: ComponentRelease, Current: "2021.11.05.10", Latest: "2021.11.05.10", Behind: false},
+					{Name: ComponentVendor, Current: "SP1A.211105.003", Latest: "SP1A.211105.003", Behind: false},
+					{Name: ComponentStack, Current: "12.0.10", Latest: "12.0.5", Behind: false},
+				},
+			},
+			expectedErr: nil,
+		},
+		"device missing from latest returns error": {
+			metadata:    map[string]string{},
+			device:      "barbet",
+			expected:    nil,
+			expectedErr: ErrDeviceNotInLatest,
+		},
+		"metadata read error returns error": {
+			metadataErr: errMetadataRead,
+			device:      "redfin",
+			expected:    nil,
+			expectedErr: errMetadataRead,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			client := New(&fakeMetadataReader{metadata: tc.metadata, err: tc.metadataErr}, "", "12.0.5", tc.chromiumVersion,
+				tc.chromiumBuildDisabled, tc.devices)
+			output, err := client.GetDeviceStatus(context.Background(), latest, tc.device)
+			assert.ErrorIs(t, err, tc.expectedErr)
+			assert.Equal(t, tc.expected, output)
+		})
+	}
+}
+
+func TestDeviceStatus_UpToDate(t *testing.T) {
+	tests := map[string]struct {
+		status   *DeviceStatus
+		expected bool
+	}{
+		"all components up to date": {
+			status:   &DeviceStatus{Components: []Component{{Name: ComponentRelease}, {Name: ComponentVendor}}},
+			expected: true,
+		},
+		"any component behind": {
+			status:   &DeviceStatus{Components: []Component{{Name: ComponentRelease}, {Name: ComponentVendor, Behind: true}}},
+			expected: false,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, tc.status.UpToDate())
+		})
+	}
+}
+
+type fakeMetadataReader struct {
+	metadata map[string]string
+	err      error
+}
+
+func (f *fakeMetadataReader) GetMetadata(ctx context.Context, key string) (string, error) {
+	if f.err != nil {
+		return "", f.err
+	}
+	return f.metadata[key], nil
+}
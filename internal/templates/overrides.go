@@ -0,0 +1,268 @@
+package templates
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template/parse"
+)
+
+const (
+	// BuildScriptFilename is the file name of the build script in a templates directory
+	BuildScriptFilename = "build.sh"
+	// BuildScriptVarsFilename is the file name of the build script vars and funcs template in a templates directory
+	BuildScriptVarsFilename = "generated_vars_and_funcs.sh"
+	// LambdaTemplateFilename is the file name of the lambda function template in a templates directory
+	LambdaTemplateFilename = "lambda.py"
+	// TerraformTemplateFilename is the file name of the terraform template in a templates directory
+	TerraformTemplateFilename = "terraform.tf"
+	// LocalBuildTemplateFilename is the file name of the local cloud build script template in a templates directory
+	LocalBuildTemplateFilename = "local_build.sh"
+)
+
+var (
+	// ErrInvalidOverride is returned if a template override is not compatible with this version of stack
+	ErrInvalidOverride = errors.New("invalid template override")
+)
+
+// templateVersionRegex matches the version marker line every embedded template carries
+var templateVersionRegex = regexp.MustCompile(`rattlesnakeos-stack template version: (\d+)`)
+
+// templateOverride describes a file that can be overridden: where it lives in TemplateFiles, what it must contain and
+// the data it is rendered with. A nil data type means the file is not a template.
+type templateOverride struct {
+	filename        string
+	file            func(templateFiles *TemplateFiles) *string
+	requiredMarkers []string
+	dataType        reflect.Type
+}
+
+var templateOverrides = []templateOverride{
+	{
+		filename:        BuildScriptFilename,
+		file:            func(templateFiles *TemplateFiles) *string { return &templateFiles.BuildScript },
+		requiredMarkers: []string{defaultGeneratedVarReplaceString},
+	},
+	{
+		filename: BuildScriptVarsFilename,
+		file:     func(templateFiles *TemplateFiles) *string { return &templateFiles.BuildScriptVars },
+		dataType: reflect.TypeOf(&Config{}),
+	},
+	{
+		filename:        LambdaTemplateFilename,
+		file:            func(templateFiles *TemplateFiles) *string { return &templateFiles.LambdaTemplate },
+		requiredMarkers: []string{"def lambda_handler("},
+		dataType:        reflect.TypeOf(lambdaTemplateData{}),
+	},
+	{
+		filename:        TerraformTemplateFilename,
+		file:            func(templateFiles *TemplateFiles) *string { return &templateFiles.TerraformTemplate },
+		requiredMarkers: []string{".StateBackend.Type", ".LambdaZipFileLocation", ".BuildScriptFileLocation"},
+		dataType:        reflect.TypeOf(terraformTemplateData{}),
+	},
+	{
+		filename: LocalBuildTemplateFilename,
+		file:     func(templateFiles *TemplateFiles) *string { return &templateFiles.LocalBuildTemplate },
+		dataType: reflect.TypeOf(&Config{}),
+	},
+}
+
+// WithOverrides returns a copy of templateFiles with every file found in dir used in place of the embedded one. Each
+// override must contain the markers stack relies on and only reference template fields that exist. A warning is logged
+// if an override is based on an older version of the embedded template.
+func WithOverrides(templateFiles *TemplateFiles, dir string) (*TemplateFiles, error) {
+	overridden := *templateFiles
+	found := false
+	for _, override := range templateOverrides {
+		path := filepath.Join(dir, override.filename)
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to read template override %v: %w", path, err)
+		}
+		found = true
+
+		embedded := override.file(templateFiles)
+		if err := checkOverride(override, string(contents)); err != nil {
+			return nil, fmt.Errorf("%w %v: %v", ErrInvalidOverride, path, err)
+		}
+		if embeddedVersion, version := templateVersion(*embedded), templateVersion(string(contents)); version < embeddedVersion {
+			log.Warnf("template override %v is based on template version %v but the embedded template is version %v - "+
+				"compare it with templates/%v of this release and update it", path, version, embeddedVersion, override.filename)
+		}
+		log.Infof("using template override %v", path)
+		*override.file(&overridden) = string(contents)
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: no template files found in %v", ErrInvalidOverride, dir)
+	}
+	return &overridden, nil
+}
+
+func checkOverride(override templateOverride, contents string) error {
+	for _, marker := range override.requiredMarkers {
+		if !strings.Contains(contents, marker) {
+			return fmt.Errorf("required marker %q is missing", marker)
+		}
+	}
+	if override.dataType == nil {
+		return nil
+	}
+
+	temp, err := parseTemplate(contents)
+	if err != nil {
+		return fmt.Errorf("failed to parse template: %w", err)
+	}
+	checker := &fieldChecker{vars: map[string]reflect.Type{"$": override.dataType}}
+	checker.walk(temp.Tree.Root, override.dataType)
+	if len(checker.errs) > 0 {
+		return errors.New(strings.Join(checker.errs, ", "))
+	}
+	return nil
+}
+
+// templateVersion returns the version from the marker line of a template, or 0 if it has none
+func templateVersion(contents string) int {
+	match := templateVersionRegex.FindStringSubmatch(contents)
+	if match == nil {
+		return 0
+	}
+	version, _ := strconv.Atoi(match[1])
+	return version
+}
+
+// fieldChecker walks a parsed template and records every field reference that doesn't exist in the data the template
+// is rendered with. Types that can't be known ahead of rendering (e.g. function results) are not checked.
+type fieldChecker struct {
+	vars map[string]reflect.Type
+	errs []string
+}
+
+func (c *fieldChecker) walk(node parse.Node, dot reflect.Type) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			c.walk(child, dot)
+		}
+	case *parse.ActionNode:
+		c.pipe(n.Pipe, dot)
+	case *parse.IfNode:
+		c.pipe(n.Pipe, dot)
+		c.walk(n.List, dot)
+		c.walk(n.ElseList, dot)
+	case *parse.RangeNode:
+		elemType := rangeElem(c.pipe(n.Pipe, dot))
+		for i, decl := range n.Pipe.Decl {
+			c.vars[decl.Ident[0]] = nil
+			if i == len(n.Pipe.Decl)-1 {
+				c.vars[decl.Ident[0]] = elemType
+			}
+		}
+		c.walk(n.List, elemType)
+		c.walk(n.ElseList, dot)
+	case *parse.WithNode:
+		c.walk(n.List, c.pipe(n.Pipe, dot))
+		c.walk(n.ElseList, dot)
+	case *parse.TemplateNode:
+		c.pipe(n.Pipe, dot)
+	}
+}
+
+// pipe checks a pipeline and returns its type if it is a plain field reference
+func (c *fieldChecker) pipe(pipe *parse.PipeNode, dot reflect.Type) reflect.Type {
+	if pipe == nil {
+		return nil
+	}
+	var pipeType reflect.Type
+	for _, cmd := range pipe.Cmds {
+		pipeType = nil
+		for _, arg := range cmd.Args {
+			pipeType = c.arg(arg, dot)
+		}
+		if len(cmd.Args) != 1 {
+			pipeType = nil
+		}
+	}
+	if len(pipe.Cmds) != 1 {
+		pipeType = nil
+	}
+	for _, decl := range pipe.Decl {
+		c.vars[decl.Ident[0]] = pipeType
+	}
+	return pipeType
+}
+
+func (c *fieldChecker) arg(node parse.Node, dot reflect.Type) reflect.Type {
+	switch n := node.(type) {
+	case *parse.DotNode:
+		return dot
+	case *parse.FieldNode:
+		return c.fields(dot, n.Ident, n.String())
+	case *parse.VariableNode:
+		return c.fields(c.vars[n.Ident[0]], n.Ident[1:], n.String())
+	case *parse.ChainNode:
+		return c.fields(c.arg(n.Node, dot), n.Field, n.String())
+	case *parse.PipeNode:
+		return c.pipe(n, dot)
+	}
+	return nil
+}
+
+func (c *fieldChecker) fields(typ reflect.Type, names []string, reference string) reflect.Type {
+	for _, name := range names {
+		if typ == nil {
+			return nil
+		}
+		if typ.Kind() == reflect.Ptr {
+			typ = typ.Elem()
+		}
+		if method, ok := reflect.PtrTo(typ).MethodByName(name); ok && method.Type.NumOut() > 0 {
+			typ = method.Type.Out(0)
+			continue
+		}
+		switch typ.Kind() {
+		case reflect.Struct:
+			field, ok := typ.FieldByName(name)
+			if !ok || field.PkgPath != "" {
+				c.errs = append(c.errs, fmt.Sprintf("%v references field %v that doesn't exist in %v", reference, name, typ))
+				return nil
+			}
+			typ = field.Type
+		case reflect.Map:
+			typ = typ.Elem()
+		case reflect.Interface:
+			return nil
+		default:
+			c.errs = append(c.errs, fmt.Sprintf("%v references field %v of non-struct type %v", reference, name, typ))
+			return nil
+		}
+	}
+	return typ
+}
+
+// rangeElem returns the type of dot inside a range over typ
+func rangeElem(typ reflect.Type) reflect.Type {
+	if typ == nil {
+		return nil
+	}
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	switch typ.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map, reflect.Chan:
+		return typ.Elem()
+	}
+	return nil
+}
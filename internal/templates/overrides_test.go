@@ -0,0 +1,99 @@
+package templates
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestWithOverrides(t *testing.T) {
+	embedded := &TemplateFiles{
+		BuildScript:       "embedded build script",
+		BuildScriptVars:   "embedded build script vars",
+		LambdaTemplate:    "embedded lambda",
+		TerraformTemplate: "embedded terraform",
+	}
+
+	tests := map[string]struct {
+		files       map[string]string
+		expected    *TemplateFiles
+		expectedErr error
+	}{
+		"subset of files is overridden": {
+			files: map[string]string{
+				BuildScriptFilename:     fmt.Sprintf("custom\n%v\n", defaultGeneratedVarReplaceString),
+				BuildScriptVarsFilename: `<% range $i, $device := .Devices %><% $i %>=<% $device.Name %><% end %><% $.Name %>`,
+			},
+			expected: &TemplateFiles{
+				BuildScript:       fmt.Sprintf("custom\n%v\n", defaultGeneratedVarReplaceString),
+				BuildScriptVars:   `<% range $i, $device := .Devices %><% $i %>=<% $device.Name %><% end %><% $.Name %>`,
+				LambdaTemplate:    "embedded lambda",
+				TerraformTemplate: "embedded terraform",
+			},
+		},
+		"lambda override with nested config fields": {
+			files: map[string]string{
+				LambdaTemplateFilename: `<% with .Config %><% .Name %><% range .Devices %><% .Friendly %><% end %><% end %>def lambda_handler(`,
+			},
+			expected: &TemplateFiles{
+				BuildScript:       "embedded build script",
+				BuildScriptVars:   "embedded build script vars",
+				LambdaTemplate:    `<% with .Config %><% .Name %><% range .Devices %><% .Friendly %><% end %><% end %>def lambda_handler(`,
+				TerraformTemplate: "embedded terraform",
+			},
+		},
+		"build script without generated vars marker returns error": {
+			files:       map[string]string{BuildScriptFilename: "custom build script"},
+			expectedErr: ErrInvalidOverride,
+		},
+		"unknown config field returns error": {
+			files:       map[string]string{LambdaTemplateFilename: `<% .Config.DoesNotExist %>def lambda_handler(`},
+			expectedErr: ErrInvalidOverride,
+		},
+		"unknown device field in range returns error": {
+			files:       map[string]string{BuildScriptVarsFilename: `<% range .Devices %><% .DoesNotExist %><% end %>`},
+			expectedErr: ErrInvalidOverride,
+		},
+		"unknown terraform field returns error": {
+			files: map[string]string{TerraformTemplateFilename: "<% .StateBackend.Type %><% .LambdaZipFileLocation %>" +
+				"<% .BuildScriptFileLocation %><% .StateBackend.DoesNotExist %>"},
+			expectedErr: ErrInvalidOverride,
+		},
+		"invalid template returns error": {
+			files:       map[string]string{BuildScriptVarsFilename: `<% if .Name %>`},
+			expectedErr: ErrInvalidOverride,
+		},
+		"empty directory returns error": {
+			files:       map[string]string{},
+			expectedErr: ErrInvalidOverride,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			for filename, contents := range tc.files {
+				assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, filename), []byte(contents), 0644))
+			}
+
+			output, err := WithOverrides(embedded, dir)
+			assert.ErrorIs(t, err, tc.expectedErr)
+
+			assert.Equal(t, tc.expected, output)
+		})
+	}
+}
+
+func TestWithOverrides_EmbeddedTemplates(t *testing.T) {
+	for _, override := range templateOverrides {
+		t.Run(override.filename, func(t *testing.T) {
+			contents, err := ioutil.ReadFile(filepath.Join("..", "..", "templates", override.filename))
+			assert.Nil(t, err)
+
+			assert.Nil(t, checkOverride(override, string(contents)))
+			assert.Greater(t, templateVersion(string(contents)), 0)
+		})
+	}
+}
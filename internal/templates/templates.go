@@ -3,17 +3,20 @@ package templates
 import (
 	"archive/zip"
 	"bytes"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/dan-v/rattlesnakeos-stack/internal/cloudaws"
 	"github.com/dan-v/rattlesnakeos-stack/internal/devices"
+	"github.com/dan-v/rattlesnakeos-stack/internal/terraform"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 	"text/template"
+	"time"
 )
 
 const (
@@ -26,11 +29,20 @@ const (
 	DefaultRattlesnakeOSStackReleaseURL = "https://api.github.com/repos/dan-v/rattlesnakeos-stack/releases/latest"
 )
 
+const (
+	// CloudAWS builds on EC2 spot instances launched by a lambda function
+	CloudAWS = "aws"
+	// CloudLocal builds on the local machine with keys, metadata and artifacts kept in a local directory
+	CloudLocal = "local"
+)
+
 const (
 	defaultBuildScriptFilename       = "build.sh"
+	defaultLocalBuildScriptFilename  = "run_build.sh"
 	defaultLambdaFunctionFilename    = "lambda_spot_function.py"
 	defaultLambdaZipFilename         = "lambda_spot.zip"
 	defaultTFMainFilename            = "main.tf"
+	defaultManifestFilename          = "manifest.json"
 	defaultGeneratedVarReplaceString = "#### <generated_vars_and_funcs.sh> ####"
 )
 
@@ -49,6 +61,8 @@ type TemplateFiles struct {
 	LambdaTemplate string
 	// TerraformTemplate is a template file of the Terraform code
 	TerraformTemplate string
+	// LocalBuildTemplate is a template file of the script that starts builds for the local cloud
+	LocalBuildTemplate string
 }
 
 // Config contains all of the template config values
@@ -59,10 +73,8 @@ type Config struct {
 	Name string
 	// Region is the region to deploy stack
 	Region string
-	// Device is the device to build for
-	Device string
-	// Device details is full device details
-	DeviceDetails *devices.Device
+	// Devices are the full device details of all the devices to build for
+	Devices []*devices.Device
 	// Email is the email address to subscribe to notifications for stack
 	Email string
 	// InstanceType is the instance type to use for builds
@@ -91,8 +103,21 @@ type Config struct {
 	CustomConfigRepoBranch string
 	// ReleasesURL is the URL to use for gathering latest versions of components for builds
 	ReleasesURL string
-	// Cloud specifies which cloud to build on (only aws supported right now)
+	// Cloud specifies which cloud to build on (aws or local)
 	Cloud string
+	// LocalDir is the directory on the build machine for keys, metadata, artifacts and logs of the local cloud
+	LocalDir string
+	// LocalReleaseURL is the URL the release directory in LocalDir is served at for OTA updates
+	LocalReleaseURL string
+	// LocalNotifyWebhook is a URL that notifications of the local cloud are posted to as JSON, in addition to the
+	// notifications log in LocalDir
+	LocalNotifyWebhook string
+	// StateBackend is where terraform state is stored, or nil to use the default backend
+	StateBackend *terraform.Backend
+	// Storage is where the keys, logs and release buckets are stored
+	Storage cloudaws.Storage
+	// AllowKeysDestroy lets terraform destroy the keys bucket, which is only set when removing a stack
+	AllowKeysDestroy bool
 	// Delay instance shutdown/termination if there are active SSH sessions
 	InstanceDebugDelayTermination bool
 	// TODO: apv workaround - remove once alternative is built
@@ -104,14 +129,41 @@ type Config struct {
 	ApvRevision string
 }
 
+// lambdaTemplateData is the data the lambda function template is rendered with
+type lambdaTemplateData struct {
+	Config                        *Config
+	RegionAMIs                    string
+	Devices                       string
+	RattlesnakeOSStackReleasesURL string
+}
+
+// terraformTemplateData is the data the terraform template is rendered with
+type terraformTemplateData struct {
+	Config                  Config
+	StateBackend            *terraform.Backend
+	LambdaZipFileLocation   string
+	BuildScriptFileLocation string
+}
+
+// zipModified is the modification time of every file in the lambda zip, so the zip only changes if its content does
+var zipModified = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Manifest records what was rendered: the sha256 hash of each artifact and the config it was rendered with
+type Manifest struct {
+	Artifacts map[string]string `json:"artifacts"`
+	Config    *Config           `json:"config"`
+}
+
 // Templates provides the ability to render templates and write them to disk
 type Templates struct {
 	config                 *Config
 	templateFiles          *TemplateFiles
 	buildScriptFilePath    string
+	localBuildFilePath     string
 	lambdaFunctionFilePath string
 	lambdaZipFilePath      string
 	tfMainFilePath         string
+	manifestFilePath       string
 }
 
 // New returns an initialized Templates
@@ -119,28 +171,65 @@ func New(config *Config, templateFiles *TemplateFiles, outputDir string) (*Templ
 	return &Templates{
 		config:                 config,
 		templateFiles:          templateFiles,
-		buildScriptFilePath:    filepath.Join(outputDir, defaultBuildScriptFilename),
+		buildScriptFilePath:    BuildScriptFilePath(outputDir),
+		localBuildFilePath:     LocalBuildScriptFilePath(outputDir),
 		lambdaFunctionFilePath: filepath.Join(outputDir, defaultLambdaFunctionFilename),
 		lambdaZipFilePath:      filepath.Join(outputDir, defaultLambdaZipFilename),
 		tfMainFilePath:         filepath.Join(outputDir, defaultTFMainFilename),
+		manifestFilePath:       filepath.Join(outputDir, defaultManifestFilename),
 	}, nil
 }
 
-// RenderAll renders all templates and writes them to output directory
+// BuildScriptFilePath returns where the build script is rendered to in outputDir
+func BuildScriptFilePath(outputDir string) string {
+	return filepath.Join(outputDir, defaultBuildScriptFilename)
+}
+
+// LocalBuildScriptFilePath returns where the script that starts local cloud builds is rendered to in outputDir
+func LocalBuildScriptFilePath(outputDir string) string {
+	return filepath.Join(outputDir, defaultLocalBuildScriptFilename)
+}
+
+// RenderAll renders all templates, checks that the rendered files parse and writes them to output directory. The local
+// cloud only renders the build script and the script that starts builds.
 func (t *Templates) RenderAll() error {
 	renderedBuildScript, err := t.renderBuildScript()
 	if err != nil {
 		return err
 	}
+	err = validateBuildScript(t.buildScriptFilePath, renderedBuildScript)
+	if err != nil {
+		return err
+	}
 	err = t.writeBuildScript(renderedBuildScript)
 	if err != nil {
 		return err
 	}
 
+	if t.config.Cloud == CloudLocal {
+		renderedLocalBuild, err := renderTemplate(t.templateFiles.LocalBuildTemplate, t.config)
+		if err != nil {
+			return err
+		}
+		err = validateBuildScript(t.localBuildFilePath, renderedLocalBuild)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(t.localBuildFilePath, renderedLocalBuild, 0755)
+		if err != nil {
+			return err
+		}
+		return t.writeManifest()
+	}
+
 	renderedLambdaFunction, err := t.renderLambdaFunction()
 	if err != nil {
 		return err
 	}
+	err = validateLambdaFunction(t.lambdaFunctionFilePath, renderedLambdaFunction)
+	if err != nil {
+		return err
+	}
 	err = t.writeLambdaFunction(renderedLambdaFunction)
 	if err != nil {
 		return err
@@ -150,12 +239,35 @@ func (t *Templates) RenderAll() error {
 	if err != nil {
 		return err
 	}
+	err = validateTerraform(t.tfMainFilePath, renderedTerraform)
+	if err != nil {
+		return err
+	}
 	err = t.writeTerraform(renderedTerraform)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return t.writeManifest()
+}
+
+// Artifacts returns the contents of the rendered text files and the manifest by file name. RenderAll must be called
+// first.
+func (t *Templates) Artifacts() (map[string][]byte, error) {
+	paths := []string{t.buildScriptFilePath, t.lambdaFunctionFilePath, t.tfMainFilePath, t.manifestFilePath}
+	if t.config.Cloud == CloudLocal {
+		paths = []string{t.buildScriptFilePath, t.localBuildFilePath, t.manifestFilePath}
+	}
+
+	artifacts := map[string][]byte{}
+	for _, path := range paths {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read rendered file: %w", err)
+		}
+		artifacts[filepath.Base(path)] = contents
+	}
+	return artifacts, nil
 }
 
 func (t *Templates) renderBuildScript() ([]byte, error) {
@@ -178,26 +290,33 @@ func (t *Templates) renderLambdaFunction() ([]byte, error) {
 		return nil, err
 	}
 
-	return renderTemplate(t.templateFiles.LambdaTemplate, struct {
-		Config                        *Config
-		RegionAMIs                    string
-		RattlesnakeOSStackReleasesURL string
-	}{
-		t.config,
-		string(regionAMIs),
-		DefaultRattlesnakeOSStackReleaseURL,
+	var deviceNames []string
+	for _, device := range t.config.Devices {
+		deviceNames = append(deviceNames, device.Name)
+	}
+	devicesJSON, err := json.Marshal(deviceNames)
+	if err != nil {
+		return nil, err
+	}
+
+	return renderTemplate(t.templateFiles.LambdaTemplate, lambdaTemplateData{
+		Config:                        t.config,
+		RegionAMIs:                    string(regionAMIs),
+		Devices:                       string(devicesJSON),
+		RattlesnakeOSStackReleasesURL: DefaultRattlesnakeOSStackReleaseURL,
 	})
 }
 
 func (t *Templates) renderTerraform() ([]byte, error) {
-	return renderTemplate(t.templateFiles.TerraformTemplate, struct {
-		Config                  Config
-		LambdaZipFileLocation   string
-		BuildScriptFileLocation string
-	}{
-		*t.config,
-		strings.Replace(t.lambdaZipFilePath, "\\", "\\\\", -1),
-		strings.Replace(t.buildScriptFilePath, "\\", "\\\\", -1),
+	stateBackend := t.config.StateBackend
+	if stateBackend == nil {
+		stateBackend = terraform.DefaultBackend(t.config.Name, t.config.Region)
+	}
+	return renderTemplate(t.templateFiles.TerraformTemplate, terraformTemplateData{
+		Config:                  *t.config,
+		StateBackend:            stateBackend,
+		LambdaZipFileLocation:   t.lambdaZipFilePath,
+		BuildScriptFileLocation: t.buildScriptFilePath,
 	})
 }
 
@@ -227,15 +346,37 @@ func (t *Templates) writeTerraform(renderedTerraform []byte) error {
 	return nil
 }
 
+func (t *Templates) writeManifest() error {
+	paths := []string{t.buildScriptFilePath, t.lambdaFunctionFilePath, t.lambdaZipFilePath, t.tfMainFilePath}
+	if t.config.Cloud == CloudLocal {
+		paths = []string{t.buildScriptFilePath, t.localBuildFilePath}
+	}
+
+	manifest := &Manifest{Artifacts: map[string]string{}, Config: t.config}
+	for _, path := range paths {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		manifest.Artifacts[filepath.Base(path)] = fmt.Sprintf("%x", sha256.Sum256(contents))
+	}
+
+	renderedManifest, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	return ioutil.WriteFile(t.manifestFilePath, append(renderedManifest, '\n'), 0644)
+}
+
 func renderTemplate(templateStr string, params interface{}) ([]byte, error) {
-	temp, err := template.New("templates").Delims("<%", "%>").Parse(templateStr)
+	temp, err := parseTemplate(templateStr)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse templates: %w", err)
 	}
 
 	buffer := new(bytes.Buffer)
 	if err = temp.Execute(buffer, params); err != nil {
-		return nil, fmt.Errorf("%v: %w", err, ErrTemplateExecute)
+		return nil, fmt.Errorf("%w: %w", err, ErrTemplateExecute)
 	}
 
 	outputBytes, err := ioutil.ReadAll(buffer)
@@ -246,6 +387,10 @@ func renderTemplate(templateStr string, params interface{}) ([]byte, error) {
 	return outputBytes, nil
 }
 
+func parseTemplate(templateStr string) (*template.Template, error) {
+	return template.New("templates").Delims("<%", "%>").Funcs(templateFuncs).Parse(templateStr)
+}
+
 func zipFiles(filename string, files []string) error {
 	newFile, err := os.Create(filename)
 	if err != nil {
@@ -280,6 +425,7 @@ func zipFiles(filename string, files []string) error {
 		}
 
 		header.Method = zip.Deflate
+		header.Modified = zipModified
 
 		writer, err := zipWriter.CreateHeader(header)
 		if err != nil {
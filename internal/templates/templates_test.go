@@ -1,12 +1,19 @@
 package templates
 
 import (
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"github.com/dan-v/rattlesnakeos-stack/internal/devices"
+	"github.com/dan-v/rattlesnakeos-stack/internal/terraform"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestTemplates_RenderBuildScript(t *testing.T) {
@@ -22,12 +29,12 @@ func TestTemplates_RenderBuildScript(t *testing.T) {
 			buildScript: dedent(fmt.Sprintf(`above
 				%v
 				below`, defaultGeneratedVarReplaceString)),
-			buildScriptVars: dedent(`DEVICE="<% .Device %>"
-				DEVICE_FRIENDLY="<% .DeviceDetails.Friendly %>"
-				DEVICE_FAMILY="<% .DeviceDetails.Family %>"
-				DEVICE_AVB_MODE="<% .DeviceDetails.AVBMode %>"
-				DEVICE_EXTRA_OTA=<% .DeviceDetails.ExtraOTA %>
-				STACK_NAME="<% .Name %>"
+			buildScriptVars: dedent(`<% range .Devices %>DEVICE="<% .Name %>"
+				DEVICE_FRIENDLY="<% .Friendly %>"
+				DEVICE_FAMILY="<% .Family %>"
+				DEVICE_AVB_MODE="<% .AVBMode %>"
+				DEVICE_EXTRA_OTA=<% .ExtraOTA %>
+				<% end %>STACK_NAME="<% .Name %>"
 				STACK_VERSION="<% .Version %>"
 				CHROMIUM_BUILD_DISABLED="<% .ChromiumBuildDisabled %>"
 				CORE_CONFIG_REPO="<% .CoreConfigRepo %>"
@@ -40,6 +47,11 @@ func TestTemplates_RenderBuildScript(t *testing.T) {
 				DEVICE_FAMILY="family"
 				DEVICE_AVB_MODE="avb mode"
 				DEVICE_EXTRA_OTA=extra ota
+				DEVICE="second device"
+				DEVICE_FRIENDLY="second friendly"
+				DEVICE_FAMILY="second family"
+				DEVICE_AVB_MODE="second avb mode"
+				DEVICE_EXTRA_OTA=
 				STACK_NAME="test stack"
 				STACK_VERSION="test version"
 				CHROMIUM_BUILD_DISABLED="false"
@@ -60,7 +72,7 @@ func TestTemplates_RenderBuildScript(t *testing.T) {
 		"buildscript with no defaultGeneratedVarReplaceString does not have buildScriptVars inserted": {
 			config:          testConfig,
 			buildScript:     "",
-			buildScriptVars: `DEVICE="<% .Device %>"`,
+			buildScriptVars: `STACK_NAME="<% .Name %>"`,
 			expected:        []byte(""),
 			expectedErr:     nil,
 		},
@@ -88,23 +100,30 @@ func TestTemplates_RenderLambdaFunction(t *testing.T) {
 	}{
 		"happy path build script render": {
 			config: testConfig,
-			lambdaTemplate: dedent(`DEVICE="<% .Config.Device %>"
-				DEVICE_FRIENDLY="<% .Config.DeviceDetails.Friendly %>"
-				DEVICE_FAMILY="<% .Config.DeviceDetails.Family %>"
-				DEVICE_AVB_MODE="<% .Config.DeviceDetails.AVBMode %>"
-				DEVICE_EXTRA_OTA=<% .Config.DeviceDetails.ExtraOTA %>
-				STACK_NAME="<% .Config.Name %>"
+			lambdaTemplate: dedent(`DEVICES='<% .Devices %>'
+				<% range .Config.Devices %>DEVICE="<% .Name %>"
+				DEVICE_FRIENDLY="<% .Friendly %>"
+				DEVICE_FAMILY="<% .Family %>"
+				DEVICE_AVB_MODE="<% .AVBMode %>"
+				DEVICE_EXTRA_OTA=<% .ExtraOTA %>
+				<% end %>STACK_NAME="<% .Config.Name %>"
 				STACK_VERSION="<% .Config.Version %>"
 				CHROMIUM_BUILD_DISABLED="<% .Config.ChromiumBuildDisabled %>"
 				CORE_CONFIG_REPO="<% .Config.CoreConfigRepo %>"
 				CORE_CONFIG_REPO_BRANCH="<% .Config.CoreConfigRepoBranch %>"
 				CUSTOM_CONFIG_REPO="<% .Config.CustomConfigRepo %>"
 				CUSTOM_CONFIG_REPO_BRANCH="<% .Config.CustomConfigRepoBranch %>"`),
-			expected: []byte(dedent(`DEVICE="test device"
+			expected: []byte(dedent(`DEVICES='["test device","second device"]'
+				DEVICE="test device"
 				DEVICE_FRIENDLY="friendly"
 				DEVICE_FAMILY="family"
 				DEVICE_AVB_MODE="avb mode"
 				DEVICE_EXTRA_OTA=extra ota
+				DEVICE="second device"
+				DEVICE_FRIENDLY="second friendly"
+				DEVICE_FAMILY="second family"
+				DEVICE_AVB_MODE="second avb mode"
+				DEVICE_EXTRA_OTA=
 				STACK_NAME="test stack"
 				STACK_VERSION="test version"
 				CHROMIUM_BUILD_DISABLED="false"
@@ -144,12 +163,12 @@ func TestTemplates_RenderTerraform(t *testing.T) {
 	}{
 		"happy path build script render": {
 			config: testConfig,
-			terraformTemplate: dedent(`DEVICE="<% .Config.Device %>"
-				DEVICE_FRIENDLY="<% .Config.DeviceDetails.Friendly %>"
-				DEVICE_FAMILY="<% .Config.DeviceDetails.Family %>"
-				DEVICE_AVB_MODE="<% .Config.DeviceDetails.AVBMode %>"
-				DEVICE_EXTRA_OTA=<% .Config.DeviceDetails.ExtraOTA %>
-				STACK_NAME="<% .Config.Name %>"
+			terraformTemplate: dedent(`<% range .Config.Devices %>DEVICE="<% .Name %>"
+				DEVICE_FRIENDLY="<% .Friendly %>"
+				DEVICE_FAMILY="<% .Family %>"
+				DEVICE_AVB_MODE="<% .AVBMode %>"
+				DEVICE_EXTRA_OTA=<% .ExtraOTA %>
+				<% end %>STACK_NAME="<% .Config.Name %>"
 				STACK_VERSION="<% .Config.Version %>"
 				CHROMIUM_BUILD_DISABLED="<% .Config.ChromiumBuildDisabled %>"
 				CORE_CONFIG_REPO="<% .Config.CoreConfigRepo %>"
@@ -161,6 +180,11 @@ func TestTemplates_RenderTerraform(t *testing.T) {
 				DEVICE_FAMILY="family"
 				DEVICE_AVB_MODE="avb mode"
 				DEVICE_EXTRA_OTA=extra ota
+				DEVICE="second device"
+				DEVICE_FRIENDLY="second friendly"
+				DEVICE_FAMILY="second family"
+				DEVICE_AVB_MODE="second avb mode"
+				DEVICE_EXTRA_OTA=
 				STACK_NAME="test stack"
 				STACK_VERSION="test version"
 				CHROMIUM_BUILD_DISABLED="false"
@@ -170,6 +194,22 @@ func TestTemplates_RenderTerraform(t *testing.T) {
 				CUSTOM_CONFIG_REPO_BRANCH="custom-config-repo-branch"`)),
 			expectedErr: nil,
 		},
+		"default state backend is stack bucket": {
+			config:            testConfig,
+			terraformTemplate: `<% .StateBackend.Type %> <% .StateBackend.Bucket %> <% .StateBackend.Key %> <% .StateBackend.Region %>`,
+			expected:          []byte(`s3 test stack terraform.state test region`),
+			expectedErr:       nil,
+		},
+		"configured state backend": {
+			config: func() *Config {
+				config := *testConfig
+				config.StateBackend = &terraform.Backend{Type: terraform.BackendS3, Bucket: "shared", KeyPrefix: "test", Region: "us-east-1"}
+				return &config
+			}(),
+			terraformTemplate: `<% .StateBackend.Type %> <% .StateBackend.Bucket %> <% .StateBackend.Key %> <% .StateBackend.Region %>`,
+			expected:          []byte(`s3 shared test/terraform.state us-east-1`),
+			expectedErr:       nil,
+		},
 		"bad template variable returns error": {
 			config:            testConfig,
 			terraformTemplate: dedent(`DEVICE="<% .Bad %>""`),
@@ -191,17 +231,67 @@ func TestTemplates_RenderTerraform(t *testing.T) {
 	}
 }
 
+func TestTemplates_RenderAll_Manifest(t *testing.T) {
+	outputDir := t.TempDir()
+	templates, err := New(testConfig, &TemplateFiles{
+		BuildScript:       "#!/usr/bin/env bash\n",
+		LambdaTemplate:    "NAME = '<% pyquote .Config.Name %>'\n",
+		TerraformTemplate: "variable \"name\" {}\n",
+	}, outputDir)
+	assert.Nil(t, err)
+	assert.Nil(t, templates.RenderAll())
+
+	artifacts, err := templates.Artifacts()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("#!/usr/bin/env bash\n"), artifacts[defaultBuildScriptFilename])
+	assert.Equal(t, []byte("NAME = 'test stack'\n"), artifacts[defaultLambdaFunctionFilename])
+	assert.Equal(t, []byte("variable \"name\" {}\n"), artifacts[defaultTFMainFilename])
+
+	manifest := &Manifest{}
+	assert.Nil(t, json.Unmarshal(artifacts[defaultManifestFilename], manifest))
+	assert.Equal(t, testConfig, manifest.Config)
+	for _, filename := range []string{defaultBuildScriptFilename, defaultLambdaFunctionFilename, defaultLambdaZipFilename, defaultTFMainFilename} {
+		contents, err := ioutil.ReadFile(filepath.Join(outputDir, filename))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256(contents)), manifest.Artifacts[filename])
+	}
+}
+
+func TestZipFiles_IgnoresModificationTime(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, defaultLambdaFunctionFilename)
+	assert.Nil(t, ioutil.WriteFile(file, []byte("NAME = 'test'\n"), 0644))
+
+	var zips [][]byte
+	for _, modified := range []time.Time{time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)} {
+		assert.Nil(t, os.Chtimes(file, modified, modified))
+		zipFile := filepath.Join(dir, defaultLambdaZipFilename)
+		assert.Nil(t, zipFiles(zipFile, []string{file}))
+		contents, err := ioutil.ReadFile(zipFile)
+		assert.Nil(t, err)
+		zips = append(zips, contents)
+	}
+	assert.Equal(t, zips[0], zips[1])
+}
+
 var testConfig = &Config{
 	Version: "test version",
 	Name:    "test stack",
 	Region:  "test region",
-	Device:  "test device",
-	DeviceDetails: &devices.Device{
-		Name:     "test device",
-		Friendly: "friendly",
-		Family:   "family",
-		AVBMode:  "avb mode",
-		ExtraOTA: "extra ota",
+	Devices: []*devices.Device{
+		&devices.Device{
+			Name:     "test device",
+			Friendly: "friendly",
+			Family:   "family",
+			AVBMode:  "avb mode",
+			ExtraOTA: "extra ota",
+		},
+		&devices.Device{
+			Name:     "second device",
+			Friendly: "second friendly",
+			Family:   "second family",
+			AVBMode:  "second avb mode",
+		},
 	},
 	Email:                  "email",
 	InstanceType:           "instance type",
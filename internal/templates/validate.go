@@ -0,0 +1,43 @@
+package templates
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"mvdan.cc/sh/v3/syntax"
+	"strings"
+)
+
+var (
+	// ErrInvalidRender is returned if a rendered file doesn't parse
+	ErrInvalidRender = errors.New("rendered file is invalid")
+)
+
+// validateBuildScript parses the rendered build script as bash
+func validateBuildScript(filename string, renderedBuildScript []byte) error {
+	parser := syntax.NewParser(syntax.Variant(syntax.LangBash))
+	if _, err := parser.Parse(bytes.NewReader(renderedBuildScript), filename); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidRender, err)
+	}
+	return nil
+}
+
+// validateLambdaFunction checks the rendered lambda function for template delimiters that weren't rendered
+func validateLambdaFunction(filename string, renderedLambdaFunction []byte) error {
+	for i, line := range strings.Split(string(renderedLambdaFunction), "\n") {
+		if strings.Contains(line, "<%") || strings.Contains(line, "%>") {
+			return fmt.Errorf("%w: %v:%v: leftover template delimiter in %q", ErrInvalidRender, filename, i+1, strings.TrimSpace(line))
+		}
+	}
+	return nil
+}
+
+// validateTerraform parses the rendered terraform as HCL
+func validateTerraform(filename string, renderedTerraform []byte) error {
+	if _, diags := hclsyntax.ParseConfig(renderedTerraform, filename, hcl.InitialPos); diags.HasErrors() {
+		return fmt.Errorf("%w: %v", ErrInvalidRender, diags.Error())
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package templates
+
+import (
+	"github.com/dan-v/rattlesnakeos-stack/internal/cloudaws"
+	"github.com/dan-v/rattlesnakeos-stack/internal/devices"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := map[string]struct {
+		validate      func(filename string, rendered []byte) error
+		filename      string
+		rendered      string
+		expectedErr   error
+		expectedInErr string
+	}{
+		"valid build script": {
+			validate: validateBuildScript,
+			filename: defaultBuildScriptFilename,
+			rendered: "#!/usr/bin/env bash\nif [ -n \"${DEVICE}\" ]; then\n  echo \"${DEVICE}\"\nfi\n",
+		},
+		"build script with unclosed if returns error with line": {
+			validate:      validateBuildScript,
+			filename:      defaultBuildScriptFilename,
+			rendered:      "#!/usr/bin/env bash\n\nif [ -n \"${DEVICE}\" ]; then\n  echo \"${DEVICE}\"\n",
+			expectedErr:   ErrInvalidRender,
+			expectedInErr: "build.sh:3:",
+		},
+		"valid lambda function": {
+			validate: validateLambdaFunction,
+			filename: defaultLambdaFunctionFilename,
+			rendered: "NAME = 'stack'\nMODULO = 5 % 2\n",
+		},
+		"lambda function with leftover delimiter returns error with line": {
+			validate:      validateLambdaFunction,
+			filename:      defaultLambdaFunctionFilename,
+			rendered:      "NAME = 'stack'\nREGION = '<% .Config.Region'\n",
+			expectedErr:   ErrInvalidRender,
+			expectedInErr: "lambda_spot_function.py:2:",
+		},
+		"valid terraform": {
+			validate: validateTerraform,
+			filename: defaultTFMainFilename,
+			rendered: "variable \"name\" {\n  default = \"stack\"\n}\n",
+		},
+		"terraform with unclosed block returns error with line": {
+			validate:      validateTerraform,
+			filename:      defaultTFMainFilename,
+			rendered:      "variable \"name\" {\n  default = \"stack\"\n\nresource \"aws_sns_topic\" \"rattlesnake\" {\n",
+			expectedErr:   ErrInvalidRender,
+			expectedInErr: "main.tf:",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := tc.validate(tc.filename, []byte(tc.rendered))
+			assert.ErrorIs(t, err, tc.expectedErr)
+			if tc.expectedInErr != "" {
+				assert.Contains(t, err.Error(), tc.expectedInErr)
+			}
+		})
+	}
+}
+
+func TestTemplates_RenderAll_EmbeddedTemplates(t *testing.T) {
+	templateFiles := embeddedTemplateFiles(t)
+
+	config := *testConfig
+	config.Devices = []*devices.Device{
+		&devices.Device{Name: "sargo", Friendly: "Pixel 3a", Family: "bonito", AVBMode: devices.AVBModeChained},
+	}
+
+	outputDir := t.TempDir()
+	templates, err := New(&config, templateFiles, outputDir)
+	assert.Nil(t, err)
+
+	assert.Nil(t, templates.RenderAll())
+	for _, filename := range []string{defaultBuildScriptFilename, defaultLambdaZipFilename, defaultTFMainFilename} {
+		assert.FileExists(t, filepath.Join(outputDir, filename))
+	}
+}
+
+// embeddedTemplateFiles reads the templates from the root templates directory
+func embeddedTemplateFiles(t *testing.T) *TemplateFiles {
+	templateFiles := &TemplateFiles{}
+	for _, override := range templateOverrides {
+		contents, err := ioutil.ReadFile(filepath.Join("..", "..", "templates", override.filename))
+		assert.Nil(t, err)
+		*override.file(templateFiles) = string(contents)
+	}
+	return templateFiles
+}
+
+func TestTemplates_RenderAll_LocalCloud(t *testing.T) {
+	templateFiles := embeddedTemplateFiles(t)
+
+	config := *testConfig
+	config.Cloud = CloudLocal
+	config.LocalDir = "/srv/rattlesnakeos"
+	config.LocalNotifyWebhook = "https://hooks.example.com/build"
+	config.Devices = []*devices.Device{
+		&devices.Device{Name: "sargo", Friendly: "Pixel 3a", Family: "bonito", AVBMode: devices.AVBModeChained},
+		&devices.Device{Name: "bonito", Friendly: "Pixel 3a XL", Family: "bonito", AVBMode: devices.AVBModeChained},
+	}
+
+	outputDir := t.TempDir()
+	templates, err := New(&config, templateFiles, outputDir)
+	assert.Nil(t, err)
+	assert.Nil(t, templates.RenderAll())
+
+	buildScript, err := ioutil.ReadFile(filepath.Join(outputDir, defaultBuildScriptFilename))
+	assert.Nil(t, err)
+	assert.Contains(t, string(buildScript), "LOCAL_DIR=\"/srv/rattlesnakeos\"")
+	assert.Contains(t, string(buildScript), "LOCAL_NOTIFY_WEBHOOK=\"https://hooks.example.com/build\"")
+	assert.NotContains(t, string(buildScript), "aws s3")
+
+	localBuild, err := ioutil.ReadFile(filepath.Join(outputDir, defaultLocalBuildScriptFilename))
+	assert.Nil(t, err)
+	assert.Contains(t, string(localBuild), "DEVICES=(\"sargo\" \"bonito\")")
+	info, err := os.Stat(filepath.Join(outputDir, defaultLocalBuildScriptFilename))
+	assert.Nil(t, err)
+	assert.NotZero(t, info.Mode().Perm()&0100)
+
+	for _, filename := range []string{defaultLambdaZipFilename, defaultTFMainFilename} {
+		assert.NoFileExists(t, filepath.Join(outputDir, filename))
+	}
+
+	artifacts, err := templates.Artifacts()
+	assert.Nil(t, err)
+	assert.Len(t, artifacts, 3)
+	assert.Contains(t, artifacts, defaultLocalBuildScriptFilename)
+}
+
+func TestTemplates_RenderAll_StorageEndpoint(t *testing.T) {
+	templateFiles := embeddedTemplateFiles(t)
+
+	config := *testConfig
+	config.Cloud = CloudAWS
+	config.Name = "stack"
+	config.Storage = cloudaws.Storage{
+		Endpoint:             "http://minio.lan:9000",
+		PathStyle:            true,
+		CredentialsParameter: "/rattlesnakeos/storage",
+	}
+	config.Devices = []*devices.Device{
+		&devices.Device{Name: "sargo", Friendly: "Pixel 3a", Family: "bonito", AVBMode: devices.AVBModeChained},
+	}
+
+	outputDir := t.TempDir()
+	templates, err := New(&config, templateFiles, outputDir)
+	assert.Nil(t, err)
+	assert.Nil(t, templates.RenderAll())
+
+	buildScript, err := ioutil.ReadFile(filepath.Join(outputDir, defaultBuildScriptFilename))
+	assert.Nil(t, err)
+	assert.Contains(t, string(buildScript), "RELEASE_URL=\"http://minio.lan:9000/stack-release\"")
+	assert.Contains(t, string(buildScript), "STORAGE_ENDPOINT=\"http://minio.lan:9000\"")
+	assert.Contains(t, string(buildScript), "storage_s3 sync \"${KEYS_DIR}/${DEVICE}\"")
+
+	tfMain, err := ioutil.ReadFile(filepath.Join(outputDir, defaultTFMainFilename))
+	assert.Nil(t, err)
+	assert.NotContains(t, string(tfMain), "resource \"aws_s3_bucket\" \"rattlesnake_s3_release\"")
+	assert.Contains(t, string(tfMain), "ssm:GetParameter")
+	assert.Contains(t, string(tfMain), "\"http://minio.lan:9000/stack-release\"")
+}
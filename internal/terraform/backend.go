@@ -0,0 +1,88 @@
+package terraform
+
+import (
+	"errors"
+	"fmt"
+	"path"
+)
+
+const (
+	// BackendS3 stores state in an S3 bucket, or a bucket of an S3 compatible service if an endpoint is set
+	BackendS3 = "s3"
+	// BackendLocal stores state in a file in the root directory, which is only meant for experiments
+	BackendLocal = "local"
+	// StateKey is the name of the state object in the s3 backend, after the key prefix
+	StateKey = "terraform.state"
+	// LocalStateFile is the state file in the root directory for the local backend
+	LocalStateFile = "terraform.tfstate"
+)
+
+var (
+	// ErrInvalidBackend is returned if a state backend is misconfigured
+	ErrInvalidBackend = errors.New("invalid terraform state backend")
+)
+
+// Backend is where Terraform state for a stack is stored
+type Backend struct {
+	// Type is BackendS3 or BackendLocal
+	Type string
+	// Bucket is the bucket that holds state for the s3 backend
+	Bucket string
+	// KeyPrefix is prepended to the state key, so one bucket can hold the state of multiple stacks
+	KeyPrefix string
+	// Region is the region of Bucket
+	Region string
+	// Endpoint is the url of an S3 compatible service to use instead of AWS S3
+	Endpoint string
+}
+
+// DefaultBackend returns the backend used if nothing else is configured, which stores state in a bucket named after
+// the stack
+func DefaultBackend(name, region string) *Backend {
+	return &Backend{
+		Type:   BackendS3,
+		Bucket: name,
+		Region: region,
+	}
+}
+
+// Key returns the key of the state object for the s3 backend
+func (b *Backend) Key() string {
+	if b.KeyPrefix == "" {
+		return StateKey
+	}
+	return path.Join(b.KeyPrefix, StateKey)
+}
+
+// IsAWS returns whether state is stored in AWS S3, rather than locally or in an S3 compatible service
+func (b *Backend) IsAWS() bool {
+	return b.Type == BackendS3 && b.Endpoint == ""
+}
+
+// Validate returns an error if the backend is missing settings required by its type
+func (b *Backend) Validate() error {
+	switch b.Type {
+	case BackendS3:
+		if b.Bucket == "" {
+			return fmt.Errorf("%w: s3 backend requires a bucket", ErrInvalidBackend)
+		}
+		if b.Region == "" {
+			return fmt.Errorf("%w: s3 backend requires a region", ErrInvalidBackend)
+		}
+	case BackendLocal:
+	default:
+		return fmt.Errorf("%w: unsupported type '%v' - must be '%v' or '%v'", ErrInvalidBackend, b.Type, BackendS3, BackendLocal)
+	}
+	return nil
+}
+
+// String returns a description of where state is stored
+func (b *Backend) String() string {
+	if b.Type == BackendLocal {
+		return fmt.Sprintf("local file %v", LocalStateFile)
+	}
+	if b.Endpoint != "" {
+		return fmt.Sprintf("s3://%v/%v at %v", b.Bucket, b.Key(), b.Endpoint)
+	}
+	return fmt.Sprintf("s3://%v/%v in %v", b.Bucket, b.Key(), b.Region)
+}
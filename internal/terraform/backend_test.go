@@ -0,0 +1,70 @@
+package terraform
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBackend_Key(t *testing.T) {
+	tests := map[string]struct {
+		backend  *Backend
+		expected string
+	}{
+		"default backend": {
+			backend:  DefaultBackend("test", "us-west-2"),
+			expected: "terraform.state",
+		},
+		"key prefix": {
+			backend:  &Backend{Type: BackendS3, Bucket: "shared", KeyPrefix: "stacks/test", Region: "us-west-2"},
+			expected: "stacks/test/terraform.state",
+		},
+		"key prefix with trailing slash": {
+			backend:  &Backend{Type: BackendS3, Bucket: "shared", KeyPrefix: "test/", Region: "us-west-2"},
+			expected: "test/terraform.state",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, tc.backend.Key())
+		})
+	}
+}
+
+func TestBackend_Validate(t *testing.T) {
+	tests := map[string]struct {
+		backend     *Backend
+		expectedErr error
+	}{
+		"default backend": {
+			backend:     DefaultBackend("test", "us-west-2"),
+			expectedErr: nil,
+		},
+		"s3 compatible endpoint": {
+			backend:     &Backend{Type: BackendS3, Bucket: "state", Region: "us-east-1", Endpoint: "http://localhost:9000"},
+			expectedErr: nil,
+		},
+		"local": {
+			backend:     &Backend{Type: BackendLocal},
+			expectedErr: nil,
+		},
+		"s3 without bucket": {
+			backend:     &Backend{Type: BackendS3, Region: "us-west-2"},
+			expectedErr: ErrInvalidBackend,
+		},
+		"s3 without region": {
+			backend:     &Backend{Type: BackendS3, Bucket: "state"},
+			expectedErr: ErrInvalidBackend,
+		},
+		"unsupported type": {
+			backend:     &Backend{Type: "gcs", Bucket: "state", Region: "us-west-2"},
+			expectedErr: ErrInvalidBackend,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.ErrorIs(t, tc.backend.Validate(), tc.expectedErr)
+		})
+	}
+}
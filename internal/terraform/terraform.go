@@ -2,52 +2,195 @@ package terraform
 
 import (
 	"archive/zip"
-	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
 	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/dan-v/rattlesnakeos-stack/internal/version"
 	log "github.com/sirupsen/logrus"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
 const (
 	// Version is the Terraform version that is downloaded and used
-	// TODO: this version of Terraform is getting quite old, but don't have a great plan for seamless major version upgrade.
-	Version = "0.11.15"
+	Version = "1.5.7"
+	// LogDir is the directory in the root directory that a log of every Terraform command is written to
+	LogDir = "terraform-logs"
 	// DefaultTerraformDestroyTimeout is the default timeout for running Terraform destroy
-	DefaultTerraformDestroyTimeout = time.Minute * 2
+	//
+	// Deprecated: destroy runs within the configurable timeout of a stack removal, which defaults to the same value.
+	DefaultTerraformDestroyTimeout = time.Minute * 30
+	// minimumVersion is the oldest version of a preinstalled Terraform binary that can be used
+	minimumVersion = "1.0.0"
+)
+
+const (
+	legacyAWSProvider           = "registry.terraform.io/-/aws"
+	awsProvider                 = "registry.terraform.io/hashicorp/aws"
+	legacyScriptObjectAddress   = "aws_s3_bucket_object.rattlesnake_s3_script_file"
+	legacyStateBackupFilePrefix = "terraform-legacy-state-backup"
+	driftPlanFile               = "drift.tfplan"
+	deployPlanFile              = "tfplan"
+	pushStateFile               = "push.tfstate"
+	// planChangesExitCode is the exit code of plan with -detailed-exitcode if there are changes
+	planChangesExitCode = 2
 )
 
 var (
-	darwinBinaryURL  = fmt.Sprintf("https://releases.hashicorp.com/terraform/%s/terraform_%s_darwin_amd64.zip", Version, Version)
-	linuxBinaryURL   = fmt.Sprintf("https://releases.hashicorp.com/terraform/%s/terraform_%s_linux_amd64.zip", Version, Version)
-	windowsBinaryURL = fmt.Sprintf("https://releases.hashicorp.com/terraform/%s/terraform_%s_windows_amd64.zip", Version, Version)
+	// ErrLegacyStateMigration is returned if state written by Terraform 0.11 can't be migrated
+	ErrLegacyStateMigration = errors.New("failed to migrate legacy terraform state")
+	// ErrNoPlan is returned if a saved plan is applied before running plan
+	ErrNoPlan = errors.New("no saved terraform plan found - run plan first")
+	// ErrNoOutputs is returned if there are no terraform outputs, which happens if the stack hasn't been deployed by
+	// this version yet
+	ErrNoOutputs = errors.New("no terraform outputs found - deploy the stack with this version first")
+	// ErrInvalidSignature is returned if the Terraform release checksums aren't signed by HashiCorp
+	ErrInvalidSignature = errors.New("invalid terraform checksums signature")
+	// ErrChecksumNotFound is returned if the Terraform release checksums don't include the download for this platform
+	ErrChecksumNotFound = errors.New("terraform checksum not found")
+	// ErrChecksumMismatch is returned if the Terraform download doesn't match its release checksum
+	ErrChecksumMismatch = errors.New("terraform checksum mismatch")
+	// ErrUnsupportedPlatform is returned if Terraform isn't published for the current platform
+	ErrUnsupportedPlatform = errors.New("unsupported platform")
+	// ErrUnsupportedVersion is returned if a preinstalled Terraform binary is too old
+	ErrUnsupportedVersion = errors.New("unsupported terraform version")
+	// ErrUnsafeZipEntry is returned if the Terraform zip contains a file that would be written outside of the output directory
+	ErrUnsafeZipEntry = errors.New("unsafe zip entry")
 )
 
+const (
+	releasesURL = "https://releases.hashicorp.com/terraform"
+)
+
+var (
+	// supportedPlatforms are the platforms that Terraform Version is published for
+	supportedPlatforms = []string{
+		"darwin_amd64", "darwin_arm64",
+		"freebsd_386", "freebsd_amd64", "freebsd_arm",
+		"linux_386", "linux_amd64", "linux_arm", "linux_arm64",
+		"openbsd_386", "openbsd_amd64",
+		"solaris_amd64",
+		"windows_386", "windows_amd64",
+	}
+	// hashicorpPublicKey is the key HashiCorp signs release checksums with, from https://www.hashicorp.com/security
+	//go:embed hashicorp.asc
+	hashicorpPublicKey []byte
+)
+
+// Options configures where Terraform and its providers are installed from. The zero value downloads both from
+// the internet.
+type Options struct {
+	// BinaryFile is a preinstalled Terraform binary to use instead of downloading one
+	BinaryFile string
+	// MirrorURL is a mirror of https://releases.hashicorp.com/terraform to download Terraform from
+	MirrorURL string
+	// PublicKeyFile is an armored public key to verify downloads with instead of the embedded HashiCorp key, e.g. once
+	// HashiCorp has extended the expiry of its key
+	PublicKeyFile string
+	// PluginDir is a local directory to install providers from instead of the Terraform registry
+	PluginDir string
+	// PluginCacheDir is a directory to cache downloaded providers in, so they are only downloaded once
+	PluginCacheDir string
+}
+
 // Client provides a basic Terraform client
 type Client struct {
 	rootDir             string
 	terraformBinaryFile string
+	pluginDir           string
+	pluginCacheDir      string
+	output              io.Writer
+	legacyStateChecked  bool
+	initialized         bool
 }
 
-// New downloads the Terraform binary for current platform and returns an initialized Client
-func New(rootDir string) (*Client, error) {
-	terraformBinary, err := setupBinary(rootDir)
+// CommandError is returned if a terraform command fails
+type CommandError struct {
+	// Args are the arguments terraform was run with
+	Args []string
+	// ExitCode is the exit code of terraform, or -1 if it didn't exit normally
+	ExitCode int
+	// Output is the combined stdout and stderr of terraform
+	Output []byte
+	// Err is the underlying error from running terraform
+	Err error
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("terraform %v failed with exit code %v: %v", strings.Join(e.Args, " "), e.ExitCode, e.Err)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// New sets up the Terraform binary for current platform as configured by options and returns an initialized Client.
+// The combined output of Terraform commands is streamed to output.
+func New(rootDir string, options *Options, output io.Writer) (*Client, error) {
+	if options == nil {
+		options = &Options{}
+	}
+
+	var terraformBinary string
+	var err error
+	if options.BinaryFile != "" {
+		terraformBinary, err = checkBinary(options.BinaryFile)
+	} else {
+		baseURL := releasesURL
+		if options.MirrorURL != "" {
+			baseURL = strings.TrimSuffix(options.MirrorURL, "/")
+		}
+		publicKey := hashicorpPublicKey
+		if options.PublicKeyFile != "" {
+			publicKey, err = ioutil.ReadFile(options.PublicKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read terraform public key: %w", err)
+			}
+		}
+		terraformBinary, err = setupBinary(rootDir, baseURL, publicKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// terraform runs in rootDir, so relative directories are resolved now
+	pluginDir, err := absPath(options.PluginDir)
+	if err != nil {
+		return nil, err
+	}
+	pluginCacheDir, err := absPath(options.PluginCacheDir)
 	if err != nil {
 		return nil, err
 	}
+	if pluginCacheDir != "" {
+		if err := os.MkdirAll(pluginCacheDir, 0700); err != nil {
+			return nil, err
+		}
+	}
 
 	client := &Client{
 		rootDir:             rootDir,
 		terraformBinaryFile: terraformBinary,
+		pluginDir:           pluginDir,
+		pluginCacheDir:      pluginCacheDir,
+		output:              output,
 	}
 	return client, nil
 }
@@ -59,108 +202,674 @@ func (c *Client) Apply(ctx context.Context) ([]byte, error) {
 		return output, err
 	}
 
-	cmd := c.setup(ctx, []string{"apply", "-auto-approve", c.rootDir})
+	cmd := c.setup(ctx, []string{"apply", "-input=false", "-auto-approve"})
 	return c.run(cmd)
 }
 
-// Destroy runs terraform destroy
+// Plan runs terraform init and plan to show the changes an apply would make without making them. The plan is saved in
+// the root directory for ApplyPlan.
+func (c *Client) Plan(ctx context.Context) ([]byte, error) {
+	output, err := c.init(ctx)
+	if err != nil {
+		return output, err
+	}
+
+	cmd := c.setup(ctx, []string{"plan", "-input=false", "-out=" + deployPlanFile})
+	return c.run(cmd)
+}
+
+// ApplyPlan applies the plan saved by Plan, so exactly the changes that were shown are made. Terraform refuses to apply
+// the plan if state changed after it was saved. The saved plan is removed afterwards, even if the apply fails.
+func (c *Client) ApplyPlan(ctx context.Context) ([]byte, error) {
+	planFile := filepath.Join(c.rootDir, deployPlanFile)
+	if _, err := os.Stat(planFile); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoPlan, err)
+	}
+	defer func() {
+		_ = os.Remove(planFile)
+	}()
+
+	cmd := c.setup(ctx, []string{"apply", "-input=false", deployPlanFile})
+	return c.run(cmd)
+}
+
+// Destroy runs terraform init and destroy
 func (c *Client) Destroy(ctx context.Context) ([]byte, error) {
-	cmd := c.setup(ctx, []string{"destroy", "-auto-approve", c.rootDir})
+	output, err := c.init(ctx)
+	if err != nil {
+		return output, err
+	}
+
+	cmd := c.setup(ctx, []string{"destroy", "-input=false", "-auto-approve"})
 	return c.run(cmd)
 }
 
-func (c *Client) init(ctx context.Context) ([]byte, error) {
-	cmd := c.setup(ctx, []string{"init", c.rootDir})
+// Import runs terraform init and imports the existing cloud resource with id into state at address
+func (c *Client) Import(ctx context.Context, address, id string) ([]byte, error) {
+	output, err := c.init(ctx)
+	if err != nil {
+		return output, err
+	}
+
+	cmd := c.setup(ctx, []string{"import", "-input=false", address, id})
 	return c.run(cmd)
 }
 
-func (c *Client) setup(ctx context.Context, args []string) *exec.Cmd {
-	cmd := exec.CommandContext(ctx, c.terraformBinaryFile, args...)
-	cmd.Dir = c.rootDir
-	return cmd
+const (
+	// DriftActionCreate is the action for resources in the templates that aren't deployed
+	DriftActionCreate = "create"
+	// DriftActionUpdate is the action for deployed resources with attributes that differ from the templates
+	DriftActionUpdate = "update"
+	// DriftActionReplace is the action for deployed resources that have to be recreated to match the templates
+	DriftActionReplace = "replace"
+	// DriftActionDelete is the action for deployed resources that are no longer in the templates
+	DriftActionDelete = "delete"
+)
+
+// Drift is a difference between a deployed resource and the rendered templates, along with the action a deploy would
+// take to remove it
+type Drift struct {
+	// Address is the terraform address of the resource
+	Address string `json:"address"`
+	// Action is one of the DriftAction values
+	Action string `json:"action"`
+	// Attribute is the attribute that differs, or empty if the whole resource differs
+	Attribute string `json:"attribute,omitempty"`
+	// Expected is the value of the attribute in the rendered templates
+	Expected string `json:"expected,omitempty"`
+	// Actual is the deployed value of the attribute
+	Actual string `json:"actual,omitempty"`
 }
 
-func (c *Client) run(cmd *exec.Cmd) ([]byte, error) {
-	cmdOutput, err := cmd.StdoutPipe()
+// Drift runs terraform init and plan with -detailed-exitcode, and returns every change an apply would make to bring
+// the deployed resources in line with the config. Terraform output isn't emitted, as it's only needed if there's an
+// error.
+func (c *Client) Drift(ctx context.Context) ([]*Drift, error) {
+	if err := c.initQuiet(ctx); err != nil {
+		return nil, err
+	}
+
+	planFile := filepath.Join(c.rootDir, driftPlanFile)
+	defer func() {
+		_ = os.Remove(planFile)
+	}()
+
+	output, err := c.runQuiet(c.setup(ctx, []string{"plan", "-input=false", "-detailed-exitcode", "-out=" + driftPlanFile}))
+	if err == nil {
+		return nil, nil
+	}
+	var commandErr *CommandError
+	if !errors.As(err, &commandErr) || commandErr.ExitCode != planChangesExitCode {
+		return nil, fmt.Errorf("%w: %s", err, output)
+	}
+
+	output, err = c.runQuiet(c.setup(ctx, []string{"show", "-json", driftPlanFile}))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, output)
+	}
+	return parsePlanChanges(output)
+}
+
+// Output runs terraform init and unmarshals the values of all outputs into v, which should be a pointer to a struct
+// with json tags matching the output names. Terraform output isn't emitted, as it's only needed if there's an error.
+func (c *Client) Output(ctx context.Context, v interface{}) error {
+	if err := c.initQuiet(ctx); err != nil {
+		return err
+	}
+
+	output, err := c.setup(ctx, []string{"output", "-json"}).Output()
 	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return fmt.Errorf("terraform output failed: %w: %s", err, exitErr.Stderr)
+		}
+		return fmt.Errorf("terraform output failed: %w", err)
+	}
+	return parseOutputs(output, v)
+}
+
+// StateList runs terraform init and returns the addresses of all resources in state
+func (c *Client) StateList(ctx context.Context) ([]string, error) {
+	if err := c.initQuiet(ctx); err != nil {
 		return nil, err
 	}
-	cmd.Stderr = cmd.Stdout
 
-	err = cmd.Start()
+	output, err := c.runQuiet(c.setup(ctx, []string{"state", "list", "-no-color"}))
 	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, output)
+	}
+	var addresses []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			addresses = append(addresses, line)
+		}
+	}
+	return addresses, nil
+}
+
+// StateResources runs terraform init and returns the addresses of the managed resources in state. Unlike StateList,
+// it doesn't fail if the stack has no state yet.
+func (c *Client) StateResources(ctx context.Context) ([]string, error) {
+	if err := c.initQuiet(ctx); err != nil {
 		return nil, err
 	}
 
-	b := &bytes.Buffer{}
-	scanner := bufio.NewScanner(cmdOutput)
-	scanner.Split(bufio.ScanLines)
-	for scanner.Scan() {
-		fmt.Println(scanner.Text())
-		b.WriteString(scanner.Text() + "\n")
+	output, err := c.setup(ctx, []string{"state", "pull"}).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("terraform state pull failed: %w: %s", err, exitErr.Stderr)
+		}
+		return nil, fmt.Errorf("terraform state pull failed: %w", err)
+	}
+	return stateResources(output)
+}
+
+// StateShow runs terraform init and returns the top level attributes of the resource at address in state. Nested
+// blocks, lists, maps and sensitive values are left out.
+func (c *Client) StateShow(ctx context.Context, address string) (map[string]string, error) {
+	if err := c.initQuiet(ctx); err != nil {
+		return nil, err
 	}
 
-	err = cmd.Wait()
+	output, err := c.runQuiet(c.setup(ctx, []string{"state", "show", "-no-color", address}))
 	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, output)
+	}
+	return parseStateShow(output), nil
+}
+
+// StatePull runs terraform init with -reconfigure and returns the state stored in the backend, which is empty if
+// there is no state. Reconfiguring switches to the backend in the current config, even if a different backend was
+// used before, without copying any state.
+func (c *Client) StatePull(ctx context.Context) ([]byte, error) {
+	if err := c.reconfigure(ctx); err != nil {
 		return nil, err
 	}
-	return b.Bytes(), nil
+
+	output, err := c.setup(ctx, []string{"state", "pull"}).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("terraform state pull failed: %w: %s", err, exitErr.Stderr)
+		}
+		return nil, fmt.Errorf("terraform state pull failed: %w", err)
+	}
+	return output, nil
 }
 
-func getTerraformURL() (string, error) {
-	osName := runtime.GOOS
-	if osName == "darwin" {
-		return darwinBinaryURL, nil
-	} else if osName == "linux" {
-		return linuxBinaryURL, nil
-	} else if osName == "windows" {
-		return windowsBinaryURL, nil
+// StatePush runs terraform init with -reconfigure and writes state to the backend in the current config
+func (c *Client) StatePush(ctx context.Context, state []byte) error {
+	if err := c.reconfigure(ctx); err != nil {
+		return err
+	}
+
+	stateFile := filepath.Join(c.rootDir, pushStateFile)
+	if err := ioutil.WriteFile(stateFile, state, 0600); err != nil {
+		return fmt.Errorf("failed to write state file %v: %w", stateFile, err)
 	}
-	return "", fmt.Errorf("unknown os: `%s`", osName)
+	defer func() {
+		_ = os.Remove(stateFile)
+	}()
+
+	output, err := c.run(c.setup(ctx, []string{"state", "push", pushStateFile}))
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, output)
+	}
+	return nil
 }
 
-func setupBinary(outputDir string) (string, error) {
-	terraformZipFilename := fmt.Sprintf("terraform-%v.zip", Version)
-	terraformZipFullPathFilename := filepath.Join(outputDir, terraformZipFilename)
+// reconfigure runs terraform init with -reconfigure, so the backend in the current config is used without any attempt
+// to migrate state from the previous backend
+func (c *Client) reconfigure(ctx context.Context) error {
+	output, err := c.runQuiet(c.setup(ctx, append(c.initArgs(), "-reconfigure")))
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, output)
+	}
+	c.initialized = true
+	return nil
+}
 
-	downloadRequired := true
-	if _, err := os.Stat(terraformZipFullPathFilename); err == nil {
-		downloadRequired = false
-		log.Infof("Skipping download of terraform zip as it already exists %v", terraformZipFullPathFilename)
+func (c *Client) init(ctx context.Context) ([]byte, error) {
+	return c.initWith(ctx, c.run)
+}
+
+// initQuiet runs terraform init without streaming its output, unless it has already been run by this client
+func (c *Client) initQuiet(ctx context.Context) error {
+	if c.initialized {
+		return nil
 	}
+	if output, err := c.initWith(ctx, c.runQuiet); err != nil {
+		return fmt.Errorf("%w: %s", err, output)
+	}
+	return nil
+}
 
-	if downloadRequired {
-		fileHandler, err := os.Create(terraformZipFullPathFilename)
+// initWith runs terraform init with run. The first time it is run, it also migrates any state that was written by
+// Terraform 0.11.
+func (c *Client) initWith(ctx context.Context, run func(cmd *exec.Cmd) ([]byte, error)) ([]byte, error) {
+	output, err := run(c.setup(ctx, c.initArgs()))
+	if c.legacyStateChecked {
+		c.initialized = err == nil
+		return output, err
+	}
+
+	// init fails on state with legacy provider addresses, but the backend is configured by then so state can be
+	// inspected and migrated
+	migrated, migrateErr := c.migrateLegacyState(ctx)
+	if migrateErr != nil {
 		if err != nil {
-			return "", err
+			return output, err
 		}
+		return output, migrateErr
+	}
+	c.legacyStateChecked = true
+	if migrated {
+		output, err = run(c.setup(ctx, c.initArgs()))
+	}
+	c.initialized = err == nil
+	return output, err
+}
+
+func (c *Client) initArgs() []string {
+	args := []string{"init", "-input=false"}
+	if c.pluginDir != "" {
+		args = append(args, fmt.Sprintf("-plugin-dir=%v", c.pluginDir))
+	}
+	return args
+}
+
+// migrateLegacyState upgrades state that was written by Terraform 0.11 for use with the current version. A backup of
+// the state is written to the root directory before anything is changed. Returns whether a migration happened.
+func (c *Client) migrateLegacyState(ctx context.Context) (bool, error) {
+	state, err := c.setup(ctx, []string{"state", "pull"}).Output()
+	if err != nil {
+		return false, fmt.Errorf("failed to pull state: %v: %w", err, ErrLegacyStateMigration)
+	}
+	legacy, err := isLegacyState(state)
+	if err != nil {
+		return false, fmt.Errorf("%v: %w", err, ErrLegacyStateMigration)
+	}
+	if !legacy {
+		return false, nil
+	}
+
+	log.Warnf("Found state written by terraform 0.11 - migrating it for use with terraform %v", Version)
+	backupFile := filepath.Join(c.rootDir, fmt.Sprintf("%v-%v.json", legacyStateBackupFilePrefix, time.Now().Unix()))
+	if err := ioutil.WriteFile(backupFile, state, 0600); err != nil {
+		return false, fmt.Errorf("failed to write state backup %v: %v: %w", backupFile, err, ErrLegacyStateMigration)
+	}
+	log.Infof("Saved backup of state to %v - restore it with 'terraform state push' if anything goes wrong", backupFile)
+
+	cmd := c.setup(ctx, []string{"state", "replace-provider", "-auto-approve", legacyAWSProvider, awsProvider})
+	if _, err := c.run(cmd); err != nil {
+		return false, fmt.Errorf("failed to replace legacy aws provider: %v: %w", err, ErrLegacyStateMigration)
+	}
+
+	// the build script object moved to the aws_s3_object resource. it is removed from state rather than destroyed, so
+	// the object is just uploaded again on the next apply.
+	hasScriptObject, err := hasStateResource(state, legacyScriptObjectAddress)
+	if err != nil {
+		return false, fmt.Errorf("%v: %w", err, ErrLegacyStateMigration)
+	}
+	if hasScriptObject {
+		if _, err := c.run(c.setup(ctx, []string{"state", "rm", legacyScriptObjectAddress})); err != nil {
+			return false, fmt.Errorf("failed to remove %v from state: %v: %w", legacyScriptObjectAddress, err, ErrLegacyStateMigration)
+		}
+	}
+
+	log.Infof("Successfully migrated state for use with terraform %v", Version)
+	return true, nil
+}
+
+func (c *Client) setup(ctx context.Context, args []string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, c.terraformBinaryFile, args...)
+	cmd.Dir = c.rootDir
+	if c.pluginCacheDir != "" {
+		cmd.Env = append(os.Environ(), fmt.Sprintf("TF_PLUGIN_CACHE_DIR=%v", c.pluginCacheDir))
+	}
+	return cmd
+}
+
+// run runs cmd, streaming its combined output to the output writer of the client
+func (c *Client) run(cmd *exec.Cmd) ([]byte, error) {
+	return c.runTo(cmd, c.output)
+}
+
+// runQuiet runs cmd without streaming its output
+func (c *Client) runQuiet(cmd *exec.Cmd) ([]byte, error) {
+	return c.runTo(cmd, ioutil.Discard)
+}
+
+// flusher is implemented by output writers that hold back incomplete lines
+type flusher interface {
+	Flush() error
+}
+
+// runTo runs cmd, streaming its combined output to w and a log file. The combined output is returned even if cmd
+// fails, along with a CommandError.
+func (c *Client) runTo(cmd *exec.Cmd, w io.Writer) ([]byte, error) {
+	args := cmd.Args[1:]
+	start := time.Now()
+	b := &bytes.Buffer{}
+	writers := []io.Writer{b, w}
+
+	var logFile *os.File
+	var err error
+	if !isReadOnly(args) {
+		logFile, err = c.createLogFile(args, start)
+	}
+	if err != nil {
+		log.Warnf("failed to create terraform log file: %v", err)
+	} else if logFile != nil {
 		defer func() {
-			_ = fileHandler.Close()
+			_ = logFile.Close()
 		}()
+		_, _ = fmt.Fprintf(logFile, "# terraform %v\n# started at %v\n", strings.Join(args, " "), start.Format(time.RFC3339))
+		writers = append(writers, logFile)
+	}
 
-		url, err := getTerraformURL()
-		if err != nil {
-			return "", err
+	combinedOutput := io.MultiWriter(writers...)
+	cmd.Stdout = combinedOutput
+	cmd.Stderr = combinedOutput
+	err = cmd.Run()
+	// a last line without a trailing newline would otherwise be held until the next command
+	if f, ok := w.(flusher); ok {
+		if flushErr := f.Flush(); flushErr != nil {
+			log.Warnf("failed to flush terraform output: %v", flushErr)
 		}
+	}
 
-		log.Infoln("Downloading Terraform binary from URL:", url)
-		resp, err := http.Get(url)
-		if err != nil {
-			return "", err
+	exitCode := 0
+	if err != nil {
+		exitCode = -1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			exitCode = exitErr.ExitCode()
 		}
-		defer func() {
-			_ = resp.Body.Close()
-		}()
+		err = &CommandError{Args: args, ExitCode: exitCode, Output: b.Bytes(), Err: err}
+	}
+	if logFile != nil {
+		_, _ = fmt.Fprintf(logFile, "# finished in %v with exit code %v\n", time.Since(start).Round(time.Millisecond), exitCode)
+	}
+	return b.Bytes(), err
+}
+
+// isReadOnly returns whether a terraform command only reads state, so it doesn't need to be logged
+func isReadOnly(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	switch args[0] {
+	case "output", "show":
+		return true
+	case "state":
+		return len(args) > 1 && (args[1] == "list" || args[1] == "show" || args[1] == "pull")
+	}
+	return false
+}
 
-		if _, err := io.Copy(fileHandler, resp.Body); err != nil {
+// createLogFile creates a timestamped log file for a terraform command in the logs directory
+func (c *Client) createLogFile(args []string, start time.Time) (*os.File, error) {
+	logDir := filepath.Join(c.rootDir, LogDir)
+	if err := os.MkdirAll(logDir, 0700); err != nil {
+		return nil, err
+	}
+	command := "terraform"
+	if len(args) > 0 {
+		command = args[0]
+	}
+	logFilename := fmt.Sprintf("terraform-%v-%v.log", start.Format("20060102T150405"), command)
+	return os.OpenFile(filepath.Join(logDir, logFilename), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+}
+
+// parseStateShow returns the top level attributes with simple values from the output of terraform state show
+func parseStateShow(output []byte) map[string]string {
+	attributes := map[string]string{}
+	for _, line := range strings.Split(string(output), "\n") {
+		// top level attributes are indented by exactly four spaces
+		if !strings.HasPrefix(line, "    ") || strings.HasPrefix(line, "     ") {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			attributes[key] = unquoted
+		} else if value == "true" || value == "false" {
+			attributes[key] = value
+		} else if _, err := strconv.ParseFloat(value, 64); err == nil {
+			attributes[key] = value
+		}
+	}
+	return attributes
+}
+
+// plan is the part of the terraform show -json output for a plan that is needed to find changes
+type plan struct {
+	ResourceChanges []struct {
+		Address string `json:"address"`
+		Change  struct {
+			Actions         []string               `json:"actions"`
+			Before          map[string]interface{} `json:"before"`
+			After           map[string]interface{} `json:"after"`
+			AfterUnknown    map[string]interface{} `json:"after_unknown"`
+			BeforeSensitive interface{}            `json:"before_sensitive"`
+			AfterSensitive  interface{}            `json:"after_sensitive"`
+		} `json:"change"`
+	} `json:"resource_changes"`
+}
+
+// parsePlanChanges returns the resource changes in the json of a plan. Updated and replaced resources have a change
+// for each top level attribute that differs, with values that are only known after apply left out.
+func parsePlanChanges(output []byte) ([]*Drift, error) {
+	p := &plan{}
+	if err := json.Unmarshal(output, p); err != nil {
+		return nil, fmt.Errorf("failed to parse terraform plan: %w", err)
+	}
+
+	var changes []*Drift
+	for _, resourceChange := range p.ResourceChanges {
+		change := resourceChange.Change
+		var action string
+		switch strings.Join(change.Actions, ",") {
+		case "create":
+			action = DriftActionCreate
+		case "update":
+			action = DriftActionUpdate
+		case "delete":
+			action = DriftActionDelete
+		case "delete,create", "create,delete":
+			action = DriftActionReplace
+		default:
+			continue
+		}
+		if action == DriftActionCreate || action == DriftActionDelete {
+			changes = append(changes, &Drift{Address: resourceChange.Address, Action: action})
+			continue
+		}
+
+		attributes := map[string]bool{}
+		for attribute := range change.Before {
+			attributes[attribute] = true
+		}
+		for attribute := range change.After {
+			attributes[attribute] = true
+		}
+		var names []string
+		for attribute := range attributes {
+			if change.AfterUnknown[attribute] == true || reflect.DeepEqual(change.Before[attribute], change.After[attribute]) {
+				continue
+			}
+			names = append(names, attribute)
+		}
+		sort.Strings(names)
+
+		if len(names) == 0 {
+			changes = append(changes, &Drift{Address: resourceChange.Address, Action: action})
+		}
+		for _, attribute := range names {
+			changes = append(changes, &Drift{
+				Address:   resourceChange.Address,
+				Action:    action,
+				Attribute: attribute,
+				Expected:  formatPlanValue(change.After[attribute], isSensitive(change.AfterSensitive, attribute)),
+				Actual:    formatPlanValue(change.Before[attribute], isSensitive(change.BeforeSensitive, attribute)),
+			})
+		}
+	}
+	return changes, nil
+}
+
+// isSensitive returns whether attribute is marked as sensitive in the before_sensitive or after_sensitive value of a
+// change, which is either a bool for the whole resource or a map of attributes
+func isSensitive(sensitive interface{}, attribute string) bool {
+	switch v := sensitive.(type) {
+	case bool:
+		return v
+	case map[string]interface{}:
+		return v[attribute] == true
+	}
+	return false
+}
+
+func formatPlanValue(value interface{}, sensitive bool) string {
+	if sensitive {
+		return "(sensitive value)"
+	}
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(b)
+}
+
+// parseOutputs unmarshals the values from the output of terraform output -json into v
+func parseOutputs(output []byte, v interface{}) error {
+	outputs := map[string]struct {
+		Value json.RawMessage `json:"value"`
+	}{}
+	if err := json.Unmarshal(output, &outputs); err != nil {
+		return fmt.Errorf("failed to parse terraform outputs: %w", err)
+	}
+	if len(outputs) == 0 {
+		return ErrNoOutputs
+	}
+
+	values := map[string]json.RawMessage{}
+	for name, output := range outputs {
+		values[name] = output.Value
+	}
+	valuesJSON, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(valuesJSON, v); err != nil {
+		return fmt.Errorf("failed to parse terraform outputs: %w", err)
+	}
+	return nil
+}
+
+// getTerraformZipName returns the name of the Terraform release zip for a platform
+func getTerraformZipName(goos, goarch string) (string, error) {
+	platform := fmt.Sprintf("%s_%s", goos, goarch)
+	for _, supported := range supportedPlatforms {
+		if platform == supported {
+			return fmt.Sprintf("terraform_%s_%s.zip", Version, platform), nil
+		}
+	}
+	return "", fmt.Errorf("terraform %s is not published for %s/%s - use --terraform-binary with a terraform binary "+
+		"built for this platform: %w", Version, goos, goarch, ErrUnsupportedPlatform)
+}
+
+// checkBinary checks that a preinstalled Terraform binary exists and is a supported version
+func checkBinary(binaryFile string) (string, error) {
+	binaryFile, err := absPath(binaryFile)
+	if err != nil {
+		return "", err
+	}
+
+	output, err := exec.Command(binaryFile, "version").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to run terraform binary %v: %w", binaryFile, err)
+	}
+	binaryVersion, err := parseVersion(output)
+	if err != nil {
+		return "", err
+	}
+	if version.Compare(binaryVersion, minimumVersion) < 0 {
+		return "", fmt.Errorf("terraform binary %v is version %v but at least %v is required: %w", binaryFile,
+			binaryVersion, minimumVersion, ErrUnsupportedVersion)
+	}
+	if version.Compare(binaryVersion, Version) != 0 {
+		log.Warnf("Using terraform binary %v with version %v - only version %v is tested", binaryFile, binaryVersion, Version)
+	}
+	return binaryFile, nil
+}
+
+// parseVersion returns the version from the output of terraform version (e.g. 'Terraform v1.5.7')
+func parseVersion(output []byte) (string, error) {
+	fields := strings.Fields(string(output))
+	if len(fields) < 2 || fields[0] != "Terraform" || !strings.HasPrefix(fields[1], "v") {
+		return "", fmt.Errorf("failed to parse terraform version from output '%v'", strings.TrimSpace(string(output)))
+	}
+	return strings.TrimPrefix(fields[1], "v"), nil
+}
+
+func absPath(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	return filepath.Abs(path)
+}
+
+func setupBinary(outputDir, baseURL string, publicKey []byte) (string, error) {
+	terraformZipName, err := getTerraformZipName(runtime.GOOS, runtime.GOARCH)
+	if err != nil {
+		return "", err
+	}
+
+	checksums, err := getVerifiedChecksums(outputDir, baseURL, publicKey)
+	if err != nil {
+		return "", err
+	}
+	expectedChecksum, err := findChecksum(checksums, terraformZipName)
+	if err != nil {
+		return "", err
+	}
+
+	terraformZipFilename := fmt.Sprintf("terraform-%v.zip", Version)
+	terraformZipFullPathFilename := filepath.Join(outputDir, terraformZipFilename)
+
+	err = verifyChecksum(terraformZipFullPathFilename, expectedChecksum)
+	if err == nil {
+		log.Infof("Skipping download of terraform zip as it already exists %v", terraformZipFullPathFilename)
+	} else {
+		if !os.IsNotExist(err) {
+			log.Warnf("Downloading terraform zip again as existing %v is invalid: %v", terraformZipFullPathFilename, err)
+		}
+
+		url := fmt.Sprintf("%v/%v/%v", baseURL, Version, terraformZipName)
+		log.Infoln("Downloading Terraform binary from URL:", url)
+		if err := downloadFile(url, terraformZipFullPathFilename); err != nil {
 			return "", err
 		}
-		if err := fileHandler.Sync(); err != nil {
+		if err := verifyChecksum(terraformZipFullPathFilename, expectedChecksum); err != nil {
+			_ = os.Remove(terraformZipFullPathFilename)
 			return "", err
 		}
 	}
 
-	err := unzip(terraformZipFullPathFilename, outputDir)
+	err = unzip(terraformZipFullPathFilename, outputDir)
 	if err != nil {
 		return "", err
 	}
@@ -177,6 +886,171 @@ func setupBinary(outputDir string) (string, error) {
 	return terraformBinaryFullPath, nil
 }
 
+// getVerifiedChecksums returns the SHA256SUMS file for the Terraform release after checking it was signed with
+// publicKey. The checksums and signature are cached in outputDir, and downloaded again if the cached copies don't
+// pass verification.
+func getVerifiedChecksums(outputDir, baseURL string, publicKey []byte) ([]byte, error) {
+	keyID, err := signatureKeyID(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	checksumsFilename := fmt.Sprintf("terraform_%s_SHA256SUMS", Version)
+	signatureFilename := fmt.Sprintf("%s.%s.sig", checksumsFilename, keyID)
+	checksumsFile := filepath.Join(outputDir, checksumsFilename)
+	signatureFile := filepath.Join(outputDir, signatureFilename)
+
+	checksums, checksumsErr := ioutil.ReadFile(checksumsFile)
+	signature, signatureErr := ioutil.ReadFile(signatureFile)
+	if checksumsErr == nil && signatureErr == nil {
+		err := verifySignature(publicKey, checksums, signature)
+		if err == nil {
+			return checksums, nil
+		}
+		log.Warnf("Downloading terraform checksums again as existing %v is invalid: %v", checksumsFile, err)
+	}
+
+	for filename, file := range map[string]string{checksumsFilename: checksumsFile, signatureFilename: signatureFile} {
+		if err := downloadFile(fmt.Sprintf("%v/%v/%v", baseURL, Version, filename), file); err != nil {
+			return nil, err
+		}
+	}
+
+	checksums, err = ioutil.ReadFile(checksumsFile)
+	if err != nil {
+		return nil, err
+	}
+	signature, err = ioutil.ReadFile(signatureFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(publicKey, checksums, signature); err != nil {
+		_ = os.Remove(checksumsFile)
+		_ = os.Remove(signatureFile)
+		return nil, err
+	}
+	return checksums, nil
+}
+
+// signatureKeyID returns the short id of the first key in armoredKeyRing, which HashiCorp uses in the names of the
+// signature files made with it
+func signatureKeyID(armoredKeyRing []byte) (string, error) {
+	keyRing, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(armoredKeyRing))
+	if err != nil {
+		return "", fmt.Errorf("failed to read public key: %w", err)
+	}
+	if len(keyRing) == 0 {
+		return "", errors.New("failed to read public key: no keys found")
+	}
+	return keyRing[0].PrimaryKey.KeyIdShortString(), nil
+}
+
+// verifySignature checks that signature is a valid detached signature of data by a key in armoredKeyRing. As in
+// OpenPGP, the key has to be valid when the signature was made, so releases signed before a key expired can still be
+// verified. Signatures dated in the future and signatures by revoked keys are invalid.
+func verifySignature(armoredKeyRing, data, signature []byte) error {
+	keyRing, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(armoredKeyRing))
+	if err != nil {
+		return fmt.Errorf("failed to read public key: %w", err)
+	}
+	created, err := signatureCreationTime(signature)
+	if err != nil {
+		return fmt.Errorf("%v: %w", err, ErrInvalidSignature)
+	}
+	if created.After(time.Now()) {
+		return fmt.Errorf("signature created in the future at %v: %w", created, ErrInvalidSignature)
+	}
+
+	config := &packet.Config{Time: func() time.Time { return created }}
+	signer, err := openpgp.CheckDetachedSignature(keyRing, bytes.NewReader(data), bytes.NewReader(signature), config)
+	if err != nil {
+		return fmt.Errorf("%v: %w", err, ErrInvalidSignature)
+	}
+	if signer.Revoked(time.Now()) {
+		return fmt.Errorf("key %v is revoked: %w", signer.PrimaryKey.KeyIdShortString(), ErrInvalidSignature)
+	}
+	return nil
+}
+
+// signatureCreationTime returns when the detached signature was made
+func signatureCreationTime(signature []byte) (time.Time, error) {
+	p, err := packet.Read(bytes.NewReader(signature))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read signature: %w", err)
+	}
+	sig, ok := p.(*packet.Signature)
+	if !ok {
+		return time.Time{}, errors.New("failed to read signature: not a signature packet")
+	}
+	return sig.CreationTime, nil
+}
+
+// findChecksum returns the checksum for filename from a SHA256SUMS file
+func findChecksum(checksums []byte, filename string) (string, error) {
+	for _, line := range strings.Split(string(checksums), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[1] == filename {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", fmt.Errorf("no checksum for %v: %w", filename, ErrChecksumNotFound)
+}
+
+// verifyChecksum checks that the SHA256 checksum of file matches expected
+func verifyChecksum(file, expected string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != expected {
+		return fmt.Errorf("expected checksum %v for %v but got %v: %w", expected, file, actual, ErrChecksumMismatch)
+	}
+	return nil
+}
+
+// downloadFile downloads url to file. The download is written to a temporary file first, so an interrupted
+// download doesn't leave a partial file behind.
+func downloadFile(url, file string) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download %v: unexpected status %v", url, resp.Status)
+	}
+
+	tmpFile := file + ".tmp"
+	fileHandler, err := os.Create(tmpFile)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = fileHandler.Close()
+		_ = os.Remove(tmpFile)
+	}()
+
+	if _, err := io.Copy(fileHandler, resp.Body); err != nil {
+		return err
+	}
+	if err := fileHandler.Sync(); err != nil {
+		return err
+	}
+	if err := fileHandler.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, file)
+}
+
 func unzip(src, dest string) error {
 	r, err := zip.OpenReader(src)
 	if err != nil {
@@ -187,12 +1061,16 @@ func unzip(src, dest string) error {
 	}()
 
 	for _, f := range r.File {
+		fpath := filepath.Join(dest, f.Name)
+		if rel, err := filepath.Rel(dest, fpath); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+			return fmt.Errorf("zip entry %v escapes %v: %w", f.Name, dest, ErrUnsafeZipEntry)
+		}
+
 		rc, err := f.Open()
 		if err != nil {
 			return err
 		}
 
-		fpath := filepath.Join(dest, f.Name)
 		if f.FileInfo().IsDir() {
 			err := os.MkdirAll(fpath, f.Mode())
 			if err != nil {
@@ -224,3 +1102,88 @@ func unzip(src, dest string) error {
 	}
 	return nil
 }
+
+// stateFile contains the fields of terraform state needed to detect state written by Terraform 0.11. Version 3 is
+// the format written by 0.11 and version 4 is the format used since 0.12.
+type stateFile struct {
+	Version   int `json:"version"`
+	Resources []struct {
+		Mode     string `json:"mode"`
+		Type     string `json:"type"`
+		Name     string `json:"name"`
+		Provider string `json:"provider"`
+	} `json:"resources"`
+	Modules []struct {
+		Resources map[string]interface{} `json:"resources"`
+	} `json:"modules"`
+}
+
+func parseState(state []byte) (*stateFile, error) {
+	parsed := &stateFile{}
+	if len(bytes.TrimSpace(state)) == 0 {
+		return parsed, nil
+	}
+	if err := json.Unmarshal(state, parsed); err != nil {
+		return nil, fmt.Errorf("failed to parse state: %w", err)
+	}
+	return parsed, nil
+}
+
+// isLegacyState returns whether state was written by Terraform 0.11 and still references the legacy aws provider
+func isLegacyState(state []byte) (bool, error) {
+	parsed, err := parseState(state)
+	if err != nil {
+		return false, err
+	}
+	if parsed.Version > 0 && parsed.Version < 4 {
+		return true, nil
+	}
+	for _, resource := range parsed.Resources {
+		if strings.Contains(resource.Provider, legacyAWSProvider) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// stateResources returns the addresses of the managed resources in state
+func stateResources(state []byte) ([]string, error) {
+	parsed, err := parseState(state)
+	if err != nil {
+		return nil, err
+	}
+	var addresses []string
+	for _, resource := range parsed.Resources {
+		if resource.Mode == "managed" {
+			addresses = append(addresses, fmt.Sprintf("%v.%v", resource.Type, resource.Name))
+		}
+	}
+	for _, module := range parsed.Modules {
+		for address := range module.Resources {
+			if !strings.HasPrefix(address, "data.") {
+				addresses = append(addresses, address)
+			}
+		}
+	}
+	sort.Strings(addresses)
+	return addresses, nil
+}
+
+// hasStateResource returns whether state contains a managed resource with address
+func hasStateResource(state []byte, address string) (bool, error) {
+	parsed, err := parseState(state)
+	if err != nil {
+		return false, err
+	}
+	for _, resource := range parsed.Resources {
+		if resource.Mode == "managed" && fmt.Sprintf("%v.%v", resource.Type, resource.Name) == address {
+			return true, nil
+		}
+	}
+	for _, module := range parsed.Modules {
+		if _, ok := module.Resources[address]; ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,714 @@
+package terraform
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	legacyState = `{
+	"version": 3,
+	"terraform_version": "0.11.15",
+	"modules": [{
+		"path": ["root"],
+		"resources": {
+			"aws_s3_bucket.rattlesnake_s3_script": {"type": "aws_s3_bucket"},
+			"aws_s3_bucket_object.rattlesnake_s3_script_file": {"type": "aws_s3_bucket_object"}
+		}
+	}]
+}`
+	pulledLegacyState = `{
+	"version": 4,
+	"terraform_version": "1.5.7",
+	"resources": [
+		{"mode": "managed", "type": "aws_s3_bucket", "name": "rattlesnake_s3_script", "provider": "provider[\"registry.terraform.io/-/aws\"]"},
+		{"mode": "managed", "type": "aws_s3_bucket_object", "name": "rattlesnake_s3_script_file", "provider": "provider[\"registry.terraform.io/-/aws\"]"}
+	]
+}`
+	currentState = `{
+	"version": 4,
+	"terraform_version": "1.5.7",
+	"resources": [
+		{"mode": "managed", "type": "aws_s3_bucket", "name": "rattlesnake_s3_script", "provider": "provider[\"registry.terraform.io/hashicorp/aws\"]"},
+		{"mode": "managed", "type": "aws_s3_object", "name": "rattlesnake_s3_script_file", "provider": "provider[\"registry.terraform.io/hashicorp/aws\"]"}
+	]
+}`
+)
+
+// TestMain lets the test binary act as a fake terraform binary when run by tests
+func TestMain(m *testing.M) {
+	if exitCode := os.Getenv("FAKE_TERRAFORM_EXIT_CODE"); exitCode != "" {
+		fmt.Fprintln(os.Stdout, "fake terraform "+strings.Join(os.Args[1:], " "))
+		fmt.Fprintln(os.Stderr, "fake terraform stderr")
+		code, _ := strconv.Atoi(exitCode)
+		os.Exit(code)
+	}
+	os.Exit(m.Run())
+}
+
+func TestIsLegacyState(t *testing.T) {
+	tests := map[string]struct {
+		state       string
+		expected    bool
+		expectedErr bool
+	}{
+		"terraform 0.11 state is legacy": {
+			state:    legacyState,
+			expected: true,
+		},
+		"upgraded state with legacy provider is legacy": {
+			state:    pulledLegacyState,
+			expected: true,
+		},
+		"current state is not legacy": {
+			state:    currentState,
+			expected: false,
+		},
+		"no state is not legacy": {
+			state:    "",
+			expected: false,
+		},
+		"invalid state is an error": {
+			state:       "not json",
+			expectedErr: true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			legacy, err := isLegacyState([]byte(tc.state))
+			if tc.expectedErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, legacy)
+		})
+	}
+}
+
+func TestHasStateResource(t *testing.T) {
+	tests := map[string]struct {
+		state    string
+		address  string
+		expected bool
+	}{
+		"resource in terraform 0.11 state": {
+			state:    legacyState,
+			address:  legacyScriptObjectAddress,
+			expected: true,
+		},
+		"resource in upgraded state": {
+			state:    pulledLegacyState,
+			address:  legacyScriptObjectAddress,
+			expected: true,
+		},
+		"resource missing from current state": {
+			state:    currentState,
+			address:  legacyScriptObjectAddress,
+			expected: false,
+		},
+		"resource missing from empty state": {
+			state:    "",
+			address:  legacyScriptObjectAddress,
+			expected: false,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			found, err := hasStateResource([]byte(tc.state), tc.address)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, found)
+		})
+	}
+}
+
+func TestStateResources(t *testing.T) {
+	tests := map[string]struct {
+		state    string
+		expected []string
+	}{
+		"resources in terraform 0.11 state": {
+			state:    legacyState,
+			expected: []string{"aws_s3_bucket.rattlesnake_s3_script", "aws_s3_bucket_object.rattlesnake_s3_script_file"},
+		},
+		"resources in current state": {
+			state:    currentState,
+			expected: []string{"aws_s3_bucket.rattlesnake_s3_script", "aws_s3_object.rattlesnake_s3_script_file"},
+		},
+		"no resources in empty state": {
+			state:    "",
+			expected: nil,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			addresses, err := stateResources([]byte(tc.state))
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, addresses)
+		})
+	}
+}
+
+func TestEmbeddedPublicKey(t *testing.T) {
+	keyRing, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(hashicorpPublicKey))
+	assert.Nil(t, err)
+	assert.Len(t, keyRing, 1)
+
+	keyID, err := signatureKeyID(hashicorpPublicKey)
+	assert.Nil(t, err)
+	assert.Equal(t, "72D7468F", keyID)
+}
+
+func TestVerifySignature(t *testing.T) {
+	signer, signerKey := newTestKey(t, nil)
+	_, otherKey := newTestKey(t, nil)
+	// a key that expired a day after it was created a year ago, and a signature made while it was valid
+	created := time.Now().AddDate(-1, 0, 0)
+	expiredConfig := &packet.Config{Time: func() time.Time { return created }, KeyLifetimeSecs: 60 * 60 * 24}
+	expiredSigner, expiredKey := newTestKey(t, expiredConfig)
+
+	checksums := []byte("abc123  terraform_1.5.7_linux_amd64.zip\n")
+	signature := &bytes.Buffer{}
+	assert.Nil(t, openpgp.DetachSign(signature, signer, bytes.NewReader(checksums), nil))
+	expiredSignature := &bytes.Buffer{}
+	assert.Nil(t, openpgp.DetachSign(expiredSignature, expiredSigner, bytes.NewReader(checksums), expiredConfig))
+	signedAfterExpiry := signAt(t, expiredSigner, checksums, created.AddDate(0, 0, 2))
+	futureSignature := signAt(t, signer, checksums, time.Now().AddDate(0, 0, 1))
+
+	tests := map[string]struct {
+		key         []byte
+		data        []byte
+		signature   []byte
+		expectedErr error
+	}{
+		"valid signature": {
+			key:       signerKey,
+			data:      checksums,
+			signature: signature.Bytes(),
+		},
+		"tampered checksums": {
+			key:         signerKey,
+			data:        []byte("def456  terraform_1.5.7_linux_amd64.zip\n"),
+			signature:   signature.Bytes(),
+			expectedErr: ErrInvalidSignature,
+		},
+		"signed by another key": {
+			key:         otherKey,
+			data:        checksums,
+			signature:   signature.Bytes(),
+			expectedErr: ErrInvalidSignature,
+		},
+		"signed before key expired": {
+			key:       expiredKey,
+			data:      checksums,
+			signature: expiredSignature.Bytes(),
+		},
+		"signed after key expired": {
+			key:         expiredKey,
+			data:        checksums,
+			signature:   signedAfterExpiry,
+			expectedErr: ErrInvalidSignature,
+		},
+		"signed in the future": {
+			key:         signerKey,
+			data:        checksums,
+			signature:   futureSignature,
+			expectedErr: ErrInvalidSignature,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := verifySignature(tc.key, tc.data, tc.signature)
+			if tc.expectedErr != nil {
+				assert.True(t, errors.Is(err, tc.expectedErr))
+				return
+			}
+			assert.Nil(t, err)
+		})
+	}
+}
+
+func TestFindChecksum(t *testing.T) {
+	checksums := []byte("abc123  terraform_1.5.7_darwin_amd64.zip\nDEF456  terraform_1.5.7_linux_amd64.zip\n")
+
+	checksum, err := findChecksum(checksums, "terraform_1.5.7_linux_amd64.zip")
+	assert.Nil(t, err)
+	assert.Equal(t, "def456", checksum)
+
+	_, err = findChecksum(checksums, "terraform_1.5.7_windows_amd64.zip")
+	assert.True(t, errors.Is(err, ErrChecksumNotFound))
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "terraform.zip")
+	assert.Nil(t, ioutil.WriteFile(file, []byte("terraform"), 0600))
+	sum := sha256.Sum256([]byte("terraform"))
+
+	assert.Nil(t, verifyChecksum(file, hex.EncodeToString(sum[:])))
+	assert.True(t, errors.Is(verifyChecksum(file, "abc123"), ErrChecksumMismatch))
+	assert.True(t, os.IsNotExist(verifyChecksum(filepath.Join(t.TempDir(), "missing.zip"), "abc123")))
+}
+
+func TestUnzip(t *testing.T) {
+	tests := map[string]struct {
+		entry       string
+		expectedErr error
+	}{
+		"file in destination": {
+			entry: "terraform",
+		},
+		"file in subdirectory": {
+			entry: "bin/terraform",
+		},
+		"file outside destination": {
+			entry:       "../terraform",
+			expectedErr: ErrUnsafeZipEntry,
+		},
+		"file nested outside destination": {
+			entry:       "bin/../../terraform",
+			expectedErr: ErrUnsafeZipEntry,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			dest := filepath.Join(dir, "dest")
+			assert.Nil(t, os.Mkdir(dest, 0700))
+			src := filepath.Join(dir, "terraform.zip")
+			writeTestZip(t, src, tc.entry)
+
+			err := unzip(src, dest)
+			if tc.expectedErr != nil {
+				assert.True(t, errors.Is(err, tc.expectedErr))
+				_, statErr := os.Stat(filepath.Join(dir, "terraform"))
+				assert.True(t, os.IsNotExist(statErr))
+				return
+			}
+			assert.Nil(t, err)
+			_, statErr := os.Stat(filepath.Join(dest, tc.entry))
+			assert.Nil(t, statErr)
+		})
+	}
+}
+
+func newTestKey(t *testing.T, config *packet.Config) (*openpgp.Entity, []byte) {
+	entity, err := openpgp.NewEntity("test", "", "test@example.com", config)
+	assert.Nil(t, err)
+
+	armored := &bytes.Buffer{}
+	w, err := armor.Encode(armored, openpgp.PublicKeyType, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, entity.Serialize(w))
+	assert.Nil(t, w.Close())
+	return entity, armored.Bytes()
+}
+
+// signAt returns a detached signature of data by signer that was made at created, even if signer wasn't valid then
+func signAt(t *testing.T, signer *openpgp.Entity, data []byte, created time.Time) []byte {
+	sig := &packet.Signature{
+		Version:           signer.PrimaryKey.Version,
+		SigType:           packet.SigTypeBinary,
+		PubKeyAlgo:        signer.PrimaryKey.PubKeyAlgo,
+		Hash:              crypto.SHA256,
+		CreationTime:      created,
+		IssuerKeyId:       &signer.PrimaryKey.KeyId,
+		IssuerFingerprint: signer.PrimaryKey.Fingerprint,
+	}
+	h, err := sig.PrepareSign(nil)
+	assert.Nil(t, err)
+	_, err = h.Write(data)
+	assert.Nil(t, err)
+	assert.Nil(t, sig.Sign(h, signer.PrivateKey, nil))
+
+	signature := &bytes.Buffer{}
+	assert.Nil(t, sig.Serialize(signature))
+	return signature.Bytes()
+}
+
+func writeTestZip(t *testing.T, file, entry string) {
+	f, err := os.Create(file)
+	assert.Nil(t, err)
+	defer func() {
+		_ = f.Close()
+	}()
+
+	w := zip.NewWriter(f)
+	header := &zip.FileHeader{Name: entry, Method: zip.Deflate}
+	header.SetMode(0700)
+	fw, err := w.CreateHeader(header)
+	assert.Nil(t, err)
+	_, err = fw.Write([]byte("terraform"))
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+}
+
+func TestParseVersion(t *testing.T) {
+	tests := map[string]struct {
+		output      string
+		expected    string
+		expectedErr bool
+	}{
+		"release version": {
+			output:   "Terraform v1.5.7\non linux_amd64\n",
+			expected: "1.5.7",
+		},
+		"with provider versions": {
+			output:   "Terraform v1.6.0\non darwin_arm64\n+ provider registry.terraform.io/hashicorp/aws v5.20.0\n",
+			expected: "1.6.0",
+		},
+		"not terraform output": {
+			output:      "OpenTofu v1.6.0\n",
+			expectedErr: true,
+		},
+		"empty output": {
+			output:      "",
+			expectedErr: true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			parsed, err := parseVersion([]byte(tc.output))
+			if tc.expectedErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, parsed)
+		})
+	}
+}
+
+func TestParseOutputs(t *testing.T) {
+	type outputs struct {
+		ReleaseBucket string            `json:"release_bucket"`
+		ScheduleRules map[string]string `json:"schedule_rules"`
+	}
+
+	tests := map[string]struct {
+		output      string
+		expected    *outputs
+		expectedErr error
+	}{
+		"outputs are parsed into struct": {
+			output: `{
+				"release_bucket": {"sensitive": false, "type": "string", "value": "test-release"},
+				"schedule_rules": {"sensitive": false, "type": ["object", {"redfin": "string"}], "value": {"redfin": "test-build-schedule-redfin"}},
+				"unknown": {"sensitive": false, "type": "string", "value": "ignored"}
+			}`,
+			expected: &outputs{
+				ReleaseBucket: "test-release",
+				ScheduleRules: map[string]string{"redfin": "test-build-schedule-redfin"},
+			},
+		},
+		"no outputs returns error": {
+			output:      `{}`,
+			expected:    &outputs{},
+			expectedErr: ErrNoOutputs,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			parsed := &outputs{}
+			err := parseOutputs([]byte(tc.output), parsed)
+			assert.ErrorIs(t, err, tc.expectedErr)
+			assert.Equal(t, tc.expected, parsed)
+		})
+	}
+}
+
+func TestParsePlanChanges(t *testing.T) {
+	tests := map[string]struct {
+		output   string
+		expected []*Drift
+	}{
+		"updated attributes are returned": {
+			output: `{"resource_changes": [
+				{"address": "aws_lambda_function.rattlesnake_lambda_build", "change": {
+					"actions": ["update"],
+					"before": {"function_name": "test", "timeout": 300, "last_modified": "2021", "environment": null},
+					"after": {"function_name": "test", "timeout": 180, "environment": [{"variables": {"A": "b"}}]},
+					"after_unknown": {"last_modified": true},
+					"before_sensitive": {},
+					"after_sensitive": {}
+				}}
+			]}`,
+			expected: []*Drift{
+				{Address: "aws_lambda_function.rattlesnake_lambda_build", Action: DriftActionUpdate, Attribute: "environment", Expected: `[{"variables":{"A":"b"}}]`, Actual: ""},
+				{Address: "aws_lambda_function.rattlesnake_lambda_build", Action: DriftActionUpdate, Attribute: "timeout", Expected: "180", Actual: "300"},
+			},
+		},
+		"no-op and read changes are skipped": {
+			output: `{"resource_changes": [
+				{"address": "aws_sns_topic.rattlesnake", "change": {"actions": ["no-op"], "before": {"name": "test"}, "after": {"name": "test"}}},
+				{"address": "data.aws_caller_identity.current", "change": {"actions": ["read"], "before": null, "after": {}}}
+			]}`,
+			expected: nil,
+		},
+		"created and deleted resources have no attributes": {
+			output: `{"resource_changes": [
+				{"address": "aws_sns_topic.rattlesnake", "change": {"actions": ["create"], "before": null, "after": {"name": "test"}}},
+				{"address": "aws_cloudwatch_event_rule.build_schedule_redfin", "change": {"actions": ["delete"], "before": {"name": "test"}, "after": null}}
+			]}`,
+			expected: []*Drift{
+				{Address: "aws_sns_topic.rattlesnake", Action: DriftActionCreate},
+				{Address: "aws_cloudwatch_event_rule.build_schedule_redfin", Action: DriftActionDelete},
+			},
+		},
+		"replaced resource with sensitive attribute": {
+			output: `{"resource_changes": [
+				{"address": "aws_s3_bucket.rattlesnake_s3_keys", "change": {
+					"actions": ["delete", "create"],
+					"before": {"bucket": "old-keys", "secret": "a"},
+					"after": {"bucket": "test-keys", "secret": "b"},
+					"after_unknown": {},
+					"before_sensitive": {"secret": true},
+					"after_sensitive": {"secret": true}
+				}}
+			]}`,
+			expected: []*Drift{
+				{Address: "aws_s3_bucket.rattlesnake_s3_keys", Action: DriftActionReplace, Attribute: "bucket", Expected: "test-keys", Actual: "old-keys"},
+				{Address: "aws_s3_bucket.rattlesnake_s3_keys", Action: DriftActionReplace, Attribute: "secret", Expected: "(sensitive value)", Actual: "(sensitive value)"},
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			changes, err := parsePlanChanges([]byte(tc.output))
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, changes)
+		})
+	}
+}
+
+func TestGetTerraformZipName(t *testing.T) {
+	tests := map[string]struct {
+		goos        string
+		goarch      string
+		expected    string
+		expectedErr error
+	}{
+		"apple silicon": {
+			goos:     "darwin",
+			goarch:   "arm64",
+			expected: "terraform_" + Version + "_darwin_arm64.zip",
+		},
+		"intel mac": {
+			goos:     "darwin",
+			goarch:   "amd64",
+			expected: "terraform_" + Version + "_darwin_amd64.zip",
+		},
+		"arm64 linux": {
+			goos:     "linux",
+			goarch:   "arm64",
+			expected: "terraform_" + Version + "_linux_arm64.zip",
+		},
+		"windows": {
+			goos:     "windows",
+			goarch:   "amd64",
+			expected: "terraform_" + Version + "_windows_amd64.zip",
+		},
+		"unpublished architecture": {
+			goos:        "linux",
+			goarch:      "riscv64",
+			expectedErr: ErrUnsupportedPlatform,
+		},
+		"unpublished os": {
+			goos:        "plan9",
+			goarch:      "amd64",
+			expectedErr: ErrUnsupportedPlatform,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			zipName, err := getTerraformZipName(tc.goos, tc.goarch)
+			assert.ErrorIs(t, err, tc.expectedErr)
+			assert.Equal(t, tc.expected, zipName)
+		})
+	}
+}
+
+func TestClient_run(t *testing.T) {
+	tests := map[string]struct {
+		exitCode int
+	}{
+		"successful command":          {exitCode: 0},
+		"failed command keeps output": {exitCode: 3},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			rootDir := t.TempDir()
+			streamed := &bytes.Buffer{}
+			client := &Client{rootDir: rootDir, terraformBinaryFile: os.Args[0], output: streamed}
+
+			cmd := exec.Command(client.terraformBinaryFile, "apply", "-auto-approve")
+			cmd.Env = append(os.Environ(), fmt.Sprintf("FAKE_TERRAFORM_EXIT_CODE=%v", tc.exitCode))
+			output, err := client.run(cmd)
+
+			expectedOutput := "fake terraform apply -auto-approve\nfake terraform stderr\n"
+			assert.Equal(t, expectedOutput, string(output))
+			assert.Equal(t, expectedOutput, streamed.String())
+			if tc.exitCode == 0 {
+				assert.Nil(t, err)
+			} else {
+				var commandErr *CommandError
+				assert.True(t, errors.As(err, &commandErr))
+				assert.Equal(t, tc.exitCode, commandErr.ExitCode)
+				assert.Equal(t, []string{"apply", "-auto-approve"}, commandErr.Args)
+				assert.Equal(t, expectedOutput, string(commandErr.Output))
+			}
+
+			logFiles, err := filepath.Glob(filepath.Join(rootDir, LogDir, "terraform-*-apply.log"))
+			assert.Nil(t, err)
+			assert.Len(t, logFiles, 1)
+			logContents, err := ioutil.ReadFile(logFiles[0])
+			assert.Nil(t, err)
+			assert.Contains(t, string(logContents), "# terraform apply -auto-approve\n")
+			assert.Contains(t, string(logContents), expectedOutput)
+			assert.Contains(t, string(logContents), fmt.Sprintf("with exit code %v\n", tc.exitCode))
+		})
+	}
+}
+
+func TestClient_runFlushesOutput(t *testing.T) {
+	streamed := &flushingBuffer{}
+	client := &Client{rootDir: t.TempDir(), terraformBinaryFile: os.Args[0], output: streamed}
+
+	cmd := exec.Command(client.terraformBinaryFile, "apply", "-auto-approve")
+	cmd.Env = append(os.Environ(), "FAKE_TERRAFORM_EXIT_CODE=0")
+	_, err := client.run(cmd)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, streamed.flushes)
+}
+
+func TestClient_ApplyPlan(t *testing.T) {
+	tests := map[string]struct {
+		savedPlan      bool
+		exitCode       int
+		expectedOutput string
+		expectedErr    error
+	}{
+		"applies saved plan": {
+			savedPlan:      true,
+			expectedOutput: "fake terraform apply -input=false tfplan\nfake terraform stderr\n",
+		},
+		"failed apply removes saved plan": {
+			savedPlan:      true,
+			exitCode:       1,
+			expectedOutput: "fake terraform apply -input=false tfplan\nfake terraform stderr\n",
+		},
+		"no saved plan": {
+			expectedErr: ErrNoPlan,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("FAKE_TERRAFORM_EXIT_CODE", strconv.Itoa(tc.exitCode))
+			rootDir := t.TempDir()
+			planFile := filepath.Join(rootDir, deployPlanFile)
+			if tc.savedPlan {
+				assert.Nil(t, ioutil.WriteFile(planFile, []byte("plan"), 0600))
+			}
+			client := &Client{rootDir: rootDir, terraformBinaryFile: os.Args[0], output: ioutil.Discard}
+
+			output, err := client.ApplyPlan(context.Background())
+			assert.Equal(t, tc.expectedOutput, string(output))
+			if tc.exitCode != 0 {
+				var commandErr *CommandError
+				assert.True(t, errors.As(err, &commandErr))
+				assert.Equal(t, tc.exitCode, commandErr.ExitCode)
+			} else {
+				assert.ErrorIs(t, err, tc.expectedErr)
+			}
+			assert.NoFileExists(t, planFile)
+		})
+	}
+}
+
+func TestParseStateShow(t *testing.T) {
+	output := `# aws_lambda_function.rattlesnake_lambda_build:
+resource "aws_lambda_function" "rattlesnake_lambda_build" {
+    arn                            = "arn:aws:lambda:us-west-2:123456789012:function:test"
+    environment_variables          = (sensitive value)
+    function_name                  = "test"
+    id                             = "test"
+    memory_size                    = 128
+    publish                        = false
+    tags                           = {}
+    timeout                        = 180
+
+    tracing_config {
+        mode = "PassThrough"
+    }
+}
+`
+	expected := map[string]string{
+		"arn":           "arn:aws:lambda:us-west-2:123456789012:function:test",
+		"function_name": "test",
+		"id":            "test",
+		"memory_size":   "128",
+		"publish":       "false",
+		"timeout":       "180",
+	}
+	assert.Equal(t, expected, parseStateShow([]byte(output)))
+}
+
+func TestIsReadOnly(t *testing.T) {
+	tests := map[string]struct {
+		args     []string
+		expected bool
+	}{
+		"init":          {args: []string{"init", "-input=false"}, expected: false},
+		"apply":         {args: []string{"apply", "-input=false", "-auto-approve"}, expected: false},
+		"state list":    {args: []string{"state", "list", "-no-color"}, expected: true},
+		"state show":    {args: []string{"state", "show", "-no-color", "aws_sns_topic.rattlesnake"}, expected: true},
+		"state rm":      {args: []string{"state", "rm", "aws_sns_topic.rattlesnake"}, expected: false},
+		"output":        {args: []string{"output", "-json"}, expected: true},
+		"no arguments":  {args: []string{}, expected: false},
+		"state no args": {args: []string{"state"}, expected: false},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, isReadOnly(tc.args))
+		})
+	}
+}
+
+type flushingBuffer struct {
+	bytes.Buffer
+	flushes int
+}
+
+func (b *flushingBuffer) Flush() error {
+	b.flushes++
+	return nil
+}
@@ -0,0 +1,296 @@
+package upgrade
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dan-v/rattlesnakeos-stack/internal/version"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultCheckTimeout is the default timeout for checking if an upgrade is available
+	DefaultCheckTimeout = time.Second * 30
+	// DefaultUpgradeTimeout is the default timeout for downloading and installing an upgrade
+	DefaultUpgradeTimeout = time.Minute * 5
+)
+
+const (
+	binaryName          = "rattlesnakeos-stack"
+	checksumsFileSuffix = "checksums.txt"
+	digestPrefix        = "sha256:"
+)
+
+var (
+	// ErrReleaseFetch is returned if the latest release can't be retrieved from the releases api
+	ErrReleaseFetch = errors.New("failed to fetch latest release")
+	// ErrUnsupportedPlatform is returned if there is no release for the current platform
+	ErrUnsupportedPlatform = errors.New("no release available for platform")
+	// ErrAssetNotFound is returned if the release does not contain the asset for the current platform
+	ErrAssetNotFound = errors.New("release asset not found")
+	// ErrChecksumNotFound is returned if no checksum is published for the release asset
+	ErrChecksumNotFound = errors.New("release asset checksum not found")
+	// ErrChecksumMismatch is returned if the downloaded release asset does not match its published checksum
+	ErrChecksumMismatch = errors.New("release asset checksum mismatch")
+	// ErrBinaryNotFound is returned if the release asset does not contain the cli binary
+	ErrBinaryNotFound = errors.New("binary not found in release asset")
+)
+
+// Asset is a file attached to a GitHub release
+type Asset struct {
+	Name        string `json:"name"`
+	DownloadURL string `json:"browser_download_url"`
+	// Digest is the checksum GitHub computes for uploaded assets (e.g. sha256:<hex>). It is only used if
+	// the release does not include a checksums file.
+	Digest string `json:"digest"`
+}
+
+// Release is a subset of the GitHub releases api response
+type Release struct {
+	TagName string  `json:"tag_name"`
+	Name    string  `json:"name"`
+	HTMLURL string  `json:"html_url"`
+	Assets  []Asset `json:"assets"`
+}
+
+// Version returns the version of the release
+func (r *Release) Version() string {
+	if r.TagName != "" {
+		return strings.TrimPrefix(r.TagName, "v")
+	}
+	return strings.TrimPrefix(r.Name, "v")
+}
+
+// Client checks for and installs new releases of the cli
+type Client struct {
+	releaseURL     string
+	currentVersion string
+	goos           string
+	goarch         string
+	httpClient     *http.Client
+}
+
+// New returns an initialized Client for the current platform. The releaseURL should point at the GitHub
+// releases api for the latest release.
+func New(releaseURL, currentVersion string) *Client {
+	return &Client{
+		releaseURL:     releaseURL,
+		currentVersion: strings.TrimSpace(currentVersion),
+		goos:           runtime.GOOS,
+		goarch:         runtime.GOARCH,
+		httpClient:     http.DefaultClient,
+	}
+}
+
+// Latest fetches the latest release from the releases api
+func (c *Client) Latest(ctx context.Context) (*Release, error) {
+	body, err := c.get(ctx, c.releaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", err, ErrReleaseFetch)
+	}
+
+	release := &Release{}
+	if err := json.Unmarshal(body, release); err != nil {
+		return nil, fmt.Errorf("failed to parse %v: %v: %w", c.releaseURL, err, ErrReleaseFetch)
+	}
+	if release.Version() == "" {
+		return nil, fmt.Errorf("no version found in %v: %w", c.releaseURL, ErrReleaseFetch)
+	}
+	return release, nil
+}
+
+// UpdateAvailable returns whether release is newer than the current version
+func (c *Client) UpdateAvailable(release *Release) bool {
+	return version.Compare(c.currentVersion, release.Version()) < 0
+}
+
+// Upgrade downloads the release asset for the current platform, checks its integrity against the checksum published
+// with the release, and atomically replaces the binary at executablePath with the one from the release. The checksum
+// comes from the same release as the asset, so it detects corrupted downloads but not a tampered release.
+func (c *Client) Upgrade(ctx context.Context, release *Release, executablePath string) error {
+	asset, err := c.findAsset(release)
+	if err != nil {
+		return err
+	}
+
+	expectedChecksum, err := c.getChecksum(ctx, release, asset)
+	if err != nil {
+		return err
+	}
+
+	archive, err := c.get(ctx, asset.DownloadURL)
+	if err != nil {
+		return fmt.Errorf("failed to download %v: %w", asset.Name, err)
+	}
+	checksum := sha256.Sum256(archive)
+	if actual := hex.EncodeToString(checksum[:]); actual != expectedChecksum {
+		return fmt.Errorf("%v: expected %v got %v: %w", asset.Name, expectedChecksum, actual, ErrChecksumMismatch)
+	}
+
+	binary, err := extractBinary(archive)
+	if err != nil {
+		return fmt.Errorf("%v: %w", asset.Name, err)
+	}
+
+	return replaceFile(executablePath, binary, c.goos == "windows")
+}
+
+// assetName returns the name of the release zip for the current platform. amd64 zips have no architecture in their
+// name, as that's all that older releases were published for.
+func (c *Client) assetName(releaseVersion string) (string, error) {
+	platform := c.goos
+	switch c.goos {
+	case "darwin":
+		platform = "osx"
+	case "linux", "windows":
+	default:
+		return "", fmt.Errorf("%v/%v: %w", c.goos, c.goarch, ErrUnsupportedPlatform)
+	}
+	switch {
+	case c.goarch == "amd64":
+	case c.goarch == "arm64" && c.goos != "windows":
+		platform = fmt.Sprintf("%v-%v", platform, c.goarch)
+	default:
+		return "", fmt.Errorf("%v/%v: %w", c.goos, c.goarch, ErrUnsupportedPlatform)
+	}
+	return fmt.Sprintf("%v-%v-%v.zip", binaryName, platform, releaseVersion), nil
+}
+
+func (c *Client) findAsset(release *Release) (*Asset, error) {
+	name, err := c.assetName(release.Version())
+	if err != nil {
+		return nil, err
+	}
+	for i := range release.Assets {
+		if release.Assets[i].Name == name {
+			return &release.Assets[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%v: %w", name, ErrAssetNotFound)
+}
+
+// getChecksum returns the expected sha256 checksum of asset from the checksums file attached to the
+// release, falling back to the digest GitHub reports for the asset
+func (c *Client) getChecksum(ctx context.Context, release *Release, asset *Asset) (string, error) {
+	for _, a := range release.Assets {
+		if !strings.HasSuffix(a.Name, checksumsFileSuffix) {
+			continue
+		}
+		checksums, err := c.get(ctx, a.DownloadURL)
+		if err != nil {
+			return "", fmt.Errorf("failed to download %v: %w", a.Name, err)
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(checksums))
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == asset.Name {
+				return strings.ToLower(fields[0]), nil
+			}
+		}
+		return "", fmt.Errorf("%v not listed in %v: %w", asset.Name, a.Name, ErrChecksumNotFound)
+	}
+
+	if strings.HasPrefix(asset.Digest, digestPrefix) {
+		return strings.ToLower(strings.TrimPrefix(asset.Digest, digestPrefix)), nil
+	}
+	return "", fmt.Errorf("%v: %w", asset.Name, ErrChecksumNotFound)
+}
+
+func (c *Client) get(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %v from %v", resp.StatusCode, url)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func extractBinary(archive []byte) ([]byte, error) {
+	reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range reader.File {
+		base := filepath.Base(f.Name)
+		if f.FileInfo().IsDir() || (base != binaryName && base != binaryName+".exe") {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			_ = rc.Close()
+		}()
+		return ioutil.ReadAll(rc)
+	}
+	return nil, ErrBinaryNotFound
+}
+
+// replaceFile writes contents to a temporary file next to path and renames it over path, so path is either
+// the old or new binary and never partially written. Windows does not allow replacing a running executable,
+// so it is moved aside first.
+func replaceFile(path string, contents []byte, moveAside bool) error {
+	mode := os.FileMode(0755)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), fmt.Sprintf(".%v-upgrade-*", filepath.Base(path)))
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	tmpPath := tmpFile.Name()
+	defer func() {
+		_ = os.Remove(tmpPath)
+	}()
+
+	if _, err := io.Copy(tmpFile, bytes.NewReader(contents)); err != nil {
+		_ = tmpFile.Close()
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	if err := tmpFile.Sync(); err != nil {
+		_ = tmpFile.Close()
+		return fmt.Errorf("failed to sync temporary file: %w", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary file: %w", err)
+	}
+	if err := os.Chmod(tmpPath, mode); err != nil {
+		return fmt.Errorf("failed to set permissions on temporary file: %w", err)
+	}
+
+	if moveAside {
+		oldPath := path + ".old"
+		_ = os.Remove(oldPath)
+		if err := os.Rename(path, oldPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to move existing binary aside: %w", err)
+		}
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace %v: %w", path, err)
+	}
+	return nil
+}
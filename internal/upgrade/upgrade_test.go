@@ -0,0 +1,263 @@
+package upgrade
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	testAssetName     = "rattlesnakeos-stack-linux-12.0.6.zip"
+	testChecksumsName = "rattlesnakeos-stack-12.0.6-checksums.txt"
+)
+
+func TestClient_Latest(t *testing.T) {
+	tests := map[string]struct {
+		statusCode      int
+		body            string
+		expectedVersion string
+		expectedErr     error
+	}{
+		"happy path tag name is used as version": {
+			statusCode:      http.StatusOK,
+			body:            `{"tag_name": "v12.0.6", "name": "12.0.6"}`,
+			expectedVersion: "12.0.6",
+			expectedErr:     nil,
+		},
+		"name is used if tag name is missing": {
+			statusCode:      http.StatusOK,
+			body:            `{"name": "12.0.6"}`,
+			expectedVersion: "12.0.6",
+			expectedErr:     nil,
+		},
+		"missing version returns error": {
+			statusCode:  http.StatusOK,
+			body:        `{}`,
+			expectedErr: ErrReleaseFetch,
+		},
+		"non 200 status code returns error": {
+			statusCode:  http.StatusForbidden,
+			body:        `{"message": "API rate limit exceeded"}`,
+			expectedErr: ErrReleaseFetch,
+		},
+		"invalid json returns error": {
+			statusCode:  http.StatusOK,
+			body:        "{",
+			expectedErr: ErrReleaseFetch,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.statusCode)
+				_, _ = fmt.Fprint(w, tc.body)
+			}))
+			defer server.Close()
+
+			release, err := New(server.URL, "12.0.5").Latest(context.Background())
+			assert.ErrorIs(t, err, tc.expectedErr)
+			if tc.expectedErr == nil {
+				assert.Equal(t, tc.expectedVersion, release.Version())
+			}
+		})
+	}
+}
+
+func TestClient_UpdateAvailable(t *testing.T) {
+	tests := map[string]struct {
+		currentVersion string
+		latestVersion  string
+		expected       bool
+	}{
+		"newer release":           {currentVersion: "12.0.5", latestVersion: "12.0.10", expected: true},
+		"same release":            {currentVersion: "12.0.5\n", latestVersion: "v12.0.5", expected: false},
+		"older release":           {currentVersion: "12.0.5", latestVersion: "11.0.9", expected: false},
+		"newer major release":     {currentVersion: "11.0.9", latestVersion: "12.0.0", expected: true},
+		"development build ahead": {currentVersion: "12.1.0", latestVersion: "12.0.9", expected: false},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			client := New("", tc.currentVersion)
+			assert.Equal(t, tc.expected, client.UpdateAvailable(&Release{TagName: tc.latestVersion}))
+		})
+	}
+}
+
+func TestClient_Upgrade(t *testing.T) {
+	newBinary := []byte("new binary")
+	archive := testZip(t, map[string][]byte{"rattlesnakeos-stack": newBinary})
+	archiveChecksum := sha256.Sum256(archive)
+	validChecksum := hex.EncodeToString(archiveChecksum[:])
+	archiveWithoutBinary := testZip(t, map[string][]byte{"README.md": []byte("readme")})
+	archiveWithoutBinaryChecksum := sha256.Sum256(archiveWithoutBinary)
+
+	tests := map[string]struct {
+		goarch         string
+		archive        []byte
+		checksums      string
+		digest         string
+		expectedBinary []byte
+		expectedErr    error
+	}{
+		"happy path binary is replaced": {
+			archive:        archive,
+			checksums:      fmt.Sprintf("%v  %v\n", validChecksum, testAssetName),
+			expectedBinary: newBinary,
+			expectedErr:    nil,
+		},
+		"asset digest is used without checksums file": {
+			archive:        archive,
+			digest:         "sha256:" + validChecksum,
+			expectedBinary: newBinary,
+			expectedErr:    nil,
+		},
+		"checksum mismatch leaves binary untouched": {
+			archive:     archive,
+			checksums:   fmt.Sprintf("%v  %v\n", hex.EncodeToString(make([]byte, sha256.Size)), testAssetName),
+			expectedErr: ErrChecksumMismatch,
+		},
+		"asset missing from checksums file returns error": {
+			archive:     archive,
+			checksums:   fmt.Sprintf("%v  %v\n", validChecksum, "rattlesnakeos-stack-osx-12.0.6.zip"),
+			expectedErr: ErrChecksumNotFound,
+		},
+		"missing checksum returns error": {
+			archive:     archive,
+			expectedErr: ErrChecksumNotFound,
+		},
+		"archive without binary returns error": {
+			archive:     archiveWithoutBinary,
+			checksums:   fmt.Sprintf("%v  %v\n", hex.EncodeToString(archiveWithoutBinaryChecksum[:]), testAssetName),
+			expectedErr: ErrBinaryNotFound,
+		},
+		"unsupported platform returns error": {
+			goarch:      "mips",
+			archive:     archive,
+			expectedErr: ErrUnsupportedPlatform,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			server := testReleasesServer(t, tc.archive, tc.checksums, tc.digest)
+			defer server.Close()
+
+			executablePath := filepath.Join(t.TempDir(), "rattlesnakeos-stack")
+			assert.Nil(t, ioutil.WriteFile(executablePath, []byte("old binary"), 0755))
+
+			client := New(server.URL+"/releases/latest", "12.0.5")
+			client.goos = "linux"
+			client.goarch = "amd64"
+			if tc.goarch != "" {
+				client.goarch = tc.goarch
+			}
+
+			release, err := client.Latest(context.Background())
+			assert.Nil(t, err)
+
+			err = client.Upgrade(context.Background(), release, executablePath)
+			assert.ErrorIs(t, err, tc.expectedErr)
+
+			expectedBinary := tc.expectedBinary
+			if tc.expectedErr != nil {
+				expectedBinary = []byte("old binary")
+			}
+			binary, err := ioutil.ReadFile(executablePath)
+			assert.Nil(t, err)
+			assert.Equal(t, expectedBinary, binary)
+
+			info, err := os.Stat(executablePath)
+			assert.Nil(t, err)
+			assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+
+			entries, err := ioutil.ReadDir(filepath.Dir(executablePath))
+			assert.Nil(t, err)
+			assert.Len(t, entries, 1, "temporary files should be cleaned up")
+		})
+	}
+}
+
+// testReleasesServer serves a GitHub releases api stand-in for release 12.0.6 with the linux asset
+func testReleasesServer(t *testing.T, archive []byte, checksums, digest string) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+
+	mux.HandleFunc("/releases/latest", func(w http.ResponseWriter, r *http.Request) {
+		release := Release{
+			TagName: "12.0.6",
+			Assets: []Asset{
+				{Name: testAssetName, DownloadURL: server.URL + "/download/" + testAssetName, Digest: digest},
+			},
+		}
+		if checksums != "" {
+			release.Assets = append(release.Assets,
+				Asset{Name: testChecksumsName, DownloadURL: server.URL + "/download/" + testChecksumsName})
+		}
+		_ = json.NewEncoder(w).Encode(release)
+	})
+	mux.HandleFunc("/download/"+testAssetName, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(archive)
+	})
+	mux.HandleFunc("/download/"+testChecksumsName, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, checksums)
+	})
+	return server
+}
+
+func testZip(t *testing.T, files map[string][]byte) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	writer := zip.NewWriter(buf)
+	for name, contents := range files {
+		f, err := writer.Create(name)
+		assert.Nil(t, err)
+		_, err = f.Write(contents)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, writer.Close())
+	return buf.Bytes()
+}
+
+func TestClient_assetName(t *testing.T) {
+	tests := map[string]struct {
+		goos        string
+		goarch      string
+		expected    string
+		expectedErr error
+	}{
+		"intel mac":        {goos: "darwin", goarch: "amd64", expected: "rattlesnakeos-stack-osx-12.0.6.zip"},
+		"apple silicon":    {goos: "darwin", goarch: "arm64", expected: "rattlesnakeos-stack-osx-arm64-12.0.6.zip"},
+		"amd64 linux":      {goos: "linux", goarch: "amd64", expected: "rattlesnakeos-stack-linux-12.0.6.zip"},
+		"arm64 linux":      {goos: "linux", goarch: "arm64", expected: "rattlesnakeos-stack-linux-arm64-12.0.6.zip"},
+		"amd64 windows":    {goos: "windows", goarch: "amd64", expected: "rattlesnakeos-stack-windows-12.0.6.zip"},
+		"arm64 windows":    {goos: "windows", goarch: "arm64", expectedErr: ErrUnsupportedPlatform},
+		"unsupported os":   {goos: "freebsd", goarch: "amd64", expectedErr: ErrUnsupportedPlatform},
+		"unsupported arch": {goos: "linux", goarch: "386", expectedErr: ErrUnsupportedPlatform},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			client := New("", "12.0.5")
+			client.goos = tc.goos
+			client.goarch = tc.goarch
+
+			assetName, err := client.assetName("12.0.6")
+			assert.ErrorIs(t, err, tc.expectedErr)
+			assert.Equal(t, tc.expected, assetName)
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package version
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Compare compares dot separated versions (e.g. 12.0.5) numerically and returns -1, 0, or 1. Missing parts are
+// treated as zero and parts that are not numeric are compared as text. As in semver, a pre-release (e.g. 12.0.0-beta)
+// is older than the same version without one, and build metadata (e.g. +build.1) is ignored.
+func Compare(a, b string) int {
+	aRelease, aPreRelease := split(a)
+	bRelease, bPreRelease := split(b)
+	for i := 0; i < len(aRelease) || i < len(bRelease); i++ {
+		aPart, bPart := "0", "0"
+		if i < len(aRelease) {
+			aPart = aRelease[i]
+		}
+		if i < len(bRelease) {
+			bPart = bRelease[i]
+		}
+		if result := compareIdentifiers(aPart, bPart); result != 0 {
+			return result
+		}
+	}
+
+	switch {
+	case aPreRelease == nil && bPreRelease == nil:
+		return 0
+	case aPreRelease == nil:
+		return 1
+	case bPreRelease == nil:
+		return -1
+	}
+	// a pre-release with fewer identifiers is older if all of its identifiers are equal (e.g. beta < beta.1)
+	for i := 0; i < len(aPreRelease) && i < len(bPreRelease); i++ {
+		if result := compareIdentifiers(aPreRelease[i], bPreRelease[i]); result != 0 {
+			return result
+		}
+	}
+	return compareInts(len(aPreRelease), len(bPreRelease))
+}
+
+// split returns the dot separated parts of the release and pre-release of version, with a nil pre-release if there is
+// none
+func split(version string) ([]string, []string) {
+	version, _, _ = strings.Cut(strings.TrimPrefix(strings.TrimSpace(version), "v"), "+")
+	release, preRelease, found := strings.Cut(version, "-")
+	if !found {
+		return strings.Split(release, "."), nil
+	}
+	return strings.Split(release, "."), strings.Split(preRelease, ".")
+}
+
+// compareIdentifiers compares numeric identifiers numerically and others as text. Numeric identifiers are older than
+// text ones.
+func compareIdentifiers(a, b string) int {
+	aNum, aErr := strconv.Atoi(a)
+	bNum, bErr := strconv.Atoi(b)
+	switch {
+	case aErr == nil && bErr == nil:
+		return compareInts(aNum, bNum)
+	case aErr == nil && b != "":
+		return -1
+	case bErr == nil && a != "":
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,38 @@
+package version
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	tests := map[string]struct {
+		a, b     string
+		expected int
+	}{
+		"equal versions":                     {a: "12.0.5", b: "12.0.5", expected: 0},
+		"numeric comparison":                 {a: "12.0.5", b: "12.0.10", expected: -1},
+		"newer major version":                {a: "12.0.0", b: "11.0.9", expected: 1},
+		"missing parts are treated as zero":  {a: "12.0", b: "12.0.0", expected: 0},
+		"v prefix is ignored":                {a: "v12.0.5", b: "12.0.5", expected: 0},
+		"surrounding whitespace is ignored":  {a: "12.0.5\n", b: "12.0.5", expected: 0},
+		"non numeric parts compare as text":  {a: "12.0.0-beta", b: "12.0.0-rc", expected: -1},
+		"older version with more parts":      {a: "11.0.9.1", b: "12.0", expected: -1},
+		"newer version with fewer parts":     {a: "12.1", b: "12.0.9", expected: 1},
+		"empty version is older than others": {a: "", b: "1", expected: -1},
+		"pre-release is older than release":  {a: "12.0.0-beta", b: "12.0.0", expected: -1},
+		"release is newer than pre-release":  {a: "12.0.0", b: "12.0.0-rc.1", expected: 1},
+		"pre-release of newer version":       {a: "12.0.1-beta", b: "12.0.0", expected: 1},
+		"numeric pre-release identifiers":    {a: "12.0.0-rc.2", b: "12.0.0-rc.10", expected: -1},
+		"numeric identifiers are older":      {a: "12.0.0-1", b: "12.0.0-alpha", expected: -1},
+		"fewer pre-release identifiers":      {a: "12.0.0-beta", b: "12.0.0-beta.1", expected: -1},
+		"equal pre-releases":                 {a: "v12.0.0-beta.1", b: "12.0.0-beta.1", expected: 0},
+		"build metadata is ignored":          {a: "12.0.0+build.5", b: "12.0.0", expected: 0},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, Compare(tc.a, tc.b))
+		})
+	}
+}
@@ -21,6 +21,8 @@ var (
 	lambdaTemplate string
 	//go:embed templates/terraform.tf
 	terraformTemplate string
+	//go:embed templates/local_build.sh
+	localBuildTemplate string
 )
 
 var allDevices = []*devices.Device{
@@ -97,9 +99,10 @@ func main() {
 	}
 
 	cmd.Execute(supportedDevices, aospVersion, stackVersion, &templates.TemplateFiles{
-		BuildScript:       buildScript,
-		BuildScriptVars:   buildScriptVars,
-		LambdaTemplate:    lambdaTemplate,
-		TerraformTemplate: terraformTemplate,
+		BuildScript:        buildScript,
+		BuildScriptVars:    buildScriptVars,
+		LambdaTemplate:     lambdaTemplate,
+		TerraformTemplate:  terraformTemplate,
+		LocalBuildTemplate: localBuildTemplate,
 	})
 }
@@ -1,4 +1,5 @@
 #!/usr/bin/env bash
+# rattlesnakeos-stack template version: 3
 
 ########################################
 ######## BUILD ARGS ####################
@@ -15,6 +16,8 @@ CHROMIUM_FORCE_BUILD=$5
 echo "CHROMIUM_FORCE_BUILD=${CHROMIUM_FORCE_BUILD}"
 LOCAL_MANIFEST_REVISIONS=$6
 echo "LOCAL_MANIFEST_REVISIONS=${LOCAL_MANIFEST_REVISIONS}"
+DEVICE=$7
+echo "DEVICE=${DEVICE}"
 
 #### <generated_vars_and_funcs.sh> ####
 
@@ -27,6 +30,10 @@ AOSP_BUILD_DIR="${ROOT_DIR}/aosp"
 CORE_DIR="${ROOT_DIR}/core"
 CUSTOM_DIR="${ROOT_DIR}/custom"
 KEYS_DIR="${ROOT_DIR}/keys"
+# set by import_keys if the keys of the device were generated by this build
+KEYS_GENERATED="false"
+# chromium is signed with a per device key, so built artifacts can't be shared between devices
+CHROMIUM_ARTIFACTS_DIR="chromium/${DEVICE}"
 MISC_DIR="${ROOT_DIR}/misc"
 RELEASE_TOOLS_DIR="${MISC_DIR}/releasetools"
 PRODUCT_MAKEFILE="${AOSP_BUILD_DIR}/device/google/${DEVICE_FAMILY}/aosp_${DEVICE}.mk"
@@ -74,7 +81,9 @@ setup_env() {
   git config --global color.ui true
 
   # mount /tmp filesystem as tmpfs
-  sudo mount -t tmpfs tmpfs /tmp || true
+  if [ "${MOUNT_TMP_AS_TMPFS}" == "true" ]; then
+    sudo mount -t tmpfs tmpfs /tmp || true
+  fi
 
   # setup base directories
   mkdir -p "${AOSP_BUILD_DIR}"
@@ -371,10 +380,10 @@ checkpoint_versions() {
   run_hook_if_exists "checkpoint_versions_pre"
 
   set_current_metadata "${DEVICE}-vendor" "${AOSP_BUILD_ID}" "public"
-  set_current_metadata "release" "${RELEASE}"
+  set_current_metadata "${DEVICE}-release" "${RELEASE}"
   set_current_metadata "rattlesnakeos-stack/revision" "${STACK_VERSION}"
   if [ "${CHROMIUM_BUILD_DISABLED}" == "false" ]; then
-      set_current_metadata "chromium/included" "yes"
+      set_current_metadata "${CHROMIUM_ARTIFACTS_DIR}/included" "yes"
   fi
 
   run_hook_if_exists "checkpoint_versions_post"
@@ -486,7 +495,9 @@ chromium_build_if_required() {
     return
   fi
 
-  current=$(get_current_metadata "chromium/revision")
+  chromium_migrate_legacy_artifacts
+
+  current=$(get_current_metadata "${CHROMIUM_ARTIFACTS_DIR}/revision")
   log "Chromium current: ${current}"
 
   log "Chromium requested: ${CHROMIUM_VERSION}"
@@ -501,6 +512,30 @@ chromium_build_if_required() {
   rm -rf "${CHROMIUM_BUILD_DIR}"
 }
 
+# stacks that only supported a single device kept chromium in chromium/ rather than chromium/<device>. the first build
+# of a device with existing keys copies the legacy artifacts, as they were signed with its key, so chromium isn't
+# rebuilt. devices that just had keys generated can't have signed them, so they build chromium instead.
+chromium_migrate_legacy_artifacts() {
+  if [ -n "$(get_current_metadata "${CHROMIUM_ARTIFACTS_DIR}/revision")" ] || [ "${KEYS_GENERATED}" == "true" ]; then
+    return
+  fi
+  legacy_revision=$(get_current_metadata "chromium/revision")
+  if [ -z "${legacy_revision}" ]; then
+    return
+  fi
+
+  log "Copying legacy chromium ${legacy_revision} artifacts to ${CHROMIUM_ARTIFACTS_DIR}"
+  legacy_dir="${MISC_DIR}/chromium-legacy"
+  rm -rf "${legacy_dir}"
+  mkdir -p "${legacy_dir}"
+  for app in TrichromeLibrary TrichromeWebView TrichromeChrome; do
+    download_build_artifact "chromium/${app}.apk" "${legacy_dir}/"
+    upload_build_artifact "${legacy_dir}/${app}.apk" "${CHROMIUM_ARTIFACTS_DIR}/${app}.apk"
+  done
+  set_current_metadata "${CHROMIUM_ARTIFACTS_DIR}/revision" "${legacy_revision}"
+  rm -rf "${legacy_dir}"
+}
+
 build_chromium() {
   log_header "${FUNCNAME[0]}"
   CHROMIUM_REVISION="$1"
@@ -579,10 +614,10 @@ EOF
     done
 
     log "Uploading trichrome apks"
-    upload_build_artifact "TrichromeLibrary.apk" "chromium/TrichromeLibrary.apk"
-    upload_build_artifact "TrichromeWebView.apk" "chromium/TrichromeWebView.apk"
-    upload_build_artifact "TrichromeChrome.apk" "chromium/TrichromeChrome.apk"
-    set_current_metadata "chromium/revision" "${CHROMIUM_REVISION}"
+    upload_build_artifact "TrichromeLibrary.apk" "${CHROMIUM_ARTIFACTS_DIR}/TrichromeLibrary.apk"
+    upload_build_artifact "TrichromeWebView.apk" "${CHROMIUM_ARTIFACTS_DIR}/TrichromeWebView.apk"
+    upload_build_artifact "TrichromeChrome.apk" "${CHROMIUM_ARTIFACTS_DIR}/TrichromeChrome.apk"
+    set_current_metadata "${CHROMIUM_ARTIFACTS_DIR}/revision" "${CHROMIUM_REVISION}"
 
     run_hook_if_exists "build_chromium_post"
   )
@@ -597,9 +632,9 @@ chromium_copy_to_build_tree_if_required() {
   fi
 
   # add latest built chromium to external/chromium
-  download_build_artifact "chromium/TrichromeLibrary.apk" "${AOSP_BUILD_DIR}/external/chromium/prebuilt/arm64/"
-  download_build_artifact "chromium/TrichromeWebView.apk" "${AOSP_BUILD_DIR}/external/chromium/prebuilt/arm64/"
-  download_build_artifact "chromium/TrichromeChrome.apk" "${AOSP_BUILD_DIR}/external/chromium/prebuilt/arm64/"
+  download_build_artifact "${CHROMIUM_ARTIFACTS_DIR}/TrichromeLibrary.apk" "${AOSP_BUILD_DIR}/external/chromium/prebuilt/arm64/"
+  download_build_artifact "${CHROMIUM_ARTIFACTS_DIR}/TrichromeWebView.apk" "${AOSP_BUILD_DIR}/external/chromium/prebuilt/arm64/"
+  download_build_artifact "${CHROMIUM_ARTIFACTS_DIR}/TrichromeChrome.apk" "${AOSP_BUILD_DIR}/external/chromium/prebuilt/arm64/"
 }
 
 trap cleanup 0
@@ -1,48 +1,114 @@
+# rattlesnakeos-stack template version: 5
 ########################################
 ######## STACK CONFIG VARS #############
 ########################################
-DEVICE="<% .Device %>"
-DEVICE_FRIENDLY="<% .DeviceDetails.Friendly %>"
-DEVICE_FAMILY="<% .DeviceDetails.Family %>"
-DEVICE_AVB_MODE="<% .DeviceDetails.AVBMode %>"
-DEVICE_EXTRA_OTA=<% .DeviceDetails.ExtraOTA %>
-STACK_NAME="<% .Name %>"
-STACK_VERSION="<% .Version %>"
-CHROMIUM_BUILD_DISABLED="<% .ChromiumBuildDisabled %>"
-CORE_CONFIG_REPO="<% .CoreConfigRepo %>"
-CORE_CONFIG_REPO_BRANCH="<% .CoreConfigRepoBranch %>"
-CUSTOM_CONFIG_REPO="<% .CustomConfigRepo %>"
-CUSTOM_CONFIG_REPO_BRANCH="<% .CustomConfigRepoBranch %>"
+case "${DEVICE}" in
+<%- range .Devices %>
+  "<% shellquote .Name %>")
+    DEVICE_FRIENDLY="<% shellquote .Friendly %>"
+    DEVICE_FAMILY="<% shellquote .Family %>"
+    DEVICE_AVB_MODE="<% shellquote .AVBMode %>"
+    DEVICE_EXTRA_OTA=<% .ExtraOTA %>
+    ;;
+<%- end %>
+  *)
+    echo "device '${DEVICE}' is not configured for this stack"
+    exit 1
+    ;;
+esac
+STACK_NAME="<% shellquote .Name %>"
+STACK_VERSION="<% shellquote .Version %>"
+CHROMIUM_BUILD_DISABLED="<% shellquote .ChromiumBuildDisabled %>"
+CORE_CONFIG_REPO="<% shellquote .CoreConfigRepo %>"
+CORE_CONFIG_REPO_BRANCH="<% shellquote .CoreConfigRepoBranch %>"
+CUSTOM_CONFIG_REPO="<% shellquote .CustomConfigRepo %>"
+CUSTOM_CONFIG_REPO_BRANCH="<% shellquote .CustomConfigRepoBranch %>"
 #TODO: apv workaround - remove once alternative is built
-APV_REMOTE="<% .ApvRemote %>"
-APV_BRANCH="<% .ApvBranch %>"
-APV_REVISION="<% .ApvRevision %>"
+APV_REMOTE="<% shellquote .ApvRemote %>"
+APV_BRANCH="<% shellquote .ApvBranch %>"
+APV_REVISION="<% shellquote .ApvRevision %>"
 
 ##########################################
 ###### CLOUD SPECIFIC VARS AND FUNCS #####
 ##########################################
 <% if eq .Cloud "aws" -%>
-REGION="<% .Region %>"
+REGION="<% shellquote .Region %>"
 AWS_KEYS_BUCKET="${STACK_NAME}-keys"
 AWS_RELEASE_BUCKET="${STACK_NAME}-release"
-RELEASE_URL="https://${AWS_RELEASE_BUCKET}.s3.amazonaws.com"
+RELEASE_URL="<% shellquote (.Storage.ReleaseURL .Name) %>"
+STORAGE_ENDPOINT="<% shellquote .Storage.Endpoint %>"
+STORAGE_PATH_STYLE="<% shellquote .Storage.PathStyle %>"
+STORAGE_CREDENTIALS_PARAMETER="<% shellquote .Storage.CredentialsParameter %>"
+MOUNT_TMP_AS_TMPFS="true"
+<%- else if eq .Cloud "local" %>
+LOCAL_DIR="<% shellquote .LocalDir %>"
+LOCAL_DIR="${LOCAL_DIR:-${HOME}/${STACK_NAME}}"
+LOCAL_KEYS_DIR="${LOCAL_DIR}/keys"
+LOCAL_RELEASE_DIR="${LOCAL_DIR}/release"
+LOCAL_NOTIFY_WEBHOOK="<% shellquote .LocalNotifyWebhook %>"
+RELEASE_URL="<% shellquote .LocalReleaseURL %>"
+MOUNT_TMP_AS_TMPFS="false"
+LOCAL_LOG_FILE="${LOCAL_DIR}/logs/${DEVICE}/$(date +%s).log"
+mkdir -p "$(dirname "${LOCAL_LOG_FILE}")"
+exec > >(tee -a "${LOCAL_LOG_FILE}") 2>&1
+<%- end %>
+<%- if eq .Cloud "aws" %>
+
+# storage_s3 runs an aws s3 command against the keys, logs and release buckets, which are in AWS S3 unless a storage
+# endpoint is configured. credentials for the storage endpoint are read from an SSM parameter into a separate aws config.
+storage_s3() {
+  if [ -z "${STORAGE_ENDPOINT}" ]; then
+    aws s3 "$@"
+    return
+  fi
+
+  local storage_config="${HOME}/.aws/rattlesnakeos-storage"
+  if [ ! -f "${storage_config}" ]; then
+    local credentials addressing_style="virtual"
+    credentials=$(aws --region "${REGION}" ssm get-parameter --name "${STORAGE_CREDENTIALS_PARAMETER}" \
+      --with-decryption --query Parameter.Value --output text)
+    if [ "${STORAGE_PATH_STYLE}" == "true" ]; then
+      addressing_style="path"
+    fi
+    mkdir -p "$(dirname "${storage_config}")"
+    (
+      umask 077
+      printf "[default]\nregion = %s\naws_access_key_id = %s\naws_secret_access_key = %s\ns3 =\n  addressing_style = %s\n" \
+        "${REGION}" "${credentials%%:*}" "${credentials#*:}" "${addressing_style}" > "${storage_config}"
+    )
+  fi
+  AWS_CONFIG_FILE="${storage_config}" AWS_SHARED_CREDENTIALS_FILE=/dev/null aws --endpoint-url "${STORAGE_ENDPOINT}" s3 "$@"
+}
 <%- end %>
 
 import_keys() {
   log_header "${FUNCNAME[0]}"
 
   <% if eq .Cloud "aws" -%>
-  if [ "$(aws s3 ls "s3://${AWS_KEYS_BUCKET}/${DEVICE}" | wc -l)" == '0' ]; then
+  if [ "$(storage_s3 ls "s3://${AWS_KEYS_BUCKET}/${DEVICE}/" | wc -l)" == '0' ]; then
     log "No keys were found - generating keys"
     gen_keys
-    log "Syncing keys to S3 s3://${AWS_KEYS_BUCKET}"
-    aws s3 sync "${KEYS_DIR}" "s3://${AWS_KEYS_BUCKET}"
+    KEYS_GENERATED="true"
+    log "Syncing keys to S3 s3://${AWS_KEYS_BUCKET}/${DEVICE}"
+    storage_s3 sync "${KEYS_DIR}/${DEVICE}" "s3://${AWS_KEYS_BUCKET}/${DEVICE}"
   else
     log "Keys already exist for ${DEVICE} - syncing them from S3"
-    aws s3 sync "s3://${AWS_KEYS_BUCKET}" "${KEYS_DIR}"
+    storage_s3 sync "s3://${AWS_KEYS_BUCKET}/${DEVICE}" "${KEYS_DIR}/${DEVICE}"
+  fi
+  <%- else if eq .Cloud "local" %>
+  if [ -z "$(ls -A "${LOCAL_KEYS_DIR}/${DEVICE}" 2>/dev/null)" ]; then
+    log "No keys were found - generating keys"
+    gen_keys
+    KEYS_GENERATED="true"
+    log "Copying keys to ${LOCAL_KEYS_DIR}/${DEVICE}"
+    mkdir -p "${LOCAL_KEYS_DIR}/${DEVICE}"
+    chmod 700 "${LOCAL_KEYS_DIR}"
+    cp -a "${KEYS_DIR}/${DEVICE}/." "${LOCAL_KEYS_DIR}/${DEVICE}/"
+  else
+    log "Keys already exist for ${DEVICE} - copying them from ${LOCAL_KEYS_DIR}/${DEVICE}"
+    mkdir -p "${KEYS_DIR}/${DEVICE}"
+    cp -a "${LOCAL_KEYS_DIR}/${DEVICE}/." "${KEYS_DIR}/${DEVICE}/"
   fi
-  <%- else %>
-  echo "todo"
   <%- end %>
 }
 
@@ -63,8 +129,20 @@ notify() {
   aws sns publish --region ${REGION} --topic-arn "${AWS_SNS_ARN}" \
     --message="$(printf "$1\n  Stack Name: %s\n  Device: %s\n  Stack Version: %s\n  Stack Region: %s\n  Instance Type: %s\n  Instance Region: %s\n  Instance IP: %s\n  Elapsed Time: %s\n  Release: %s\n  Tag: %s\n  Build ID: %s\n  %s" \
       "${STACK_NAME}" "${DEVICE}" "${STACK_VERSION}" "${REGION}" "${INSTANCE_TYPE}" "${INSTANCE_REGION}" "${INSTANCE_IP}" "${ELAPSED}" "${RELEASE}" "${AOSP_TAG}" "${AOSP_BUILD_ID}" "${LOGOUTPUT}")" || true
-  <%- else %>
-  echo "todo"
+  <%- else if eq .Cloud "local" %>
+  LOGOUTPUT=
+  if [ -n "$2" ]; then
+    LOGOUTPUT=$(tail -c 20000 "${LOCAL_LOG_FILE}")
+  fi
+
+  ELAPSED="$((SECONDS / 3600))hrs $(((SECONDS / 60) % 60))min $((SECONDS % 60))sec"
+  MESSAGE="$(printf "$1\n  Stack Name: %s\n  Device: %s\n  Stack Version: %s\n  Host: %s\n  Elapsed Time: %s\n  Release: %s\n  Tag: %s\n  Build ID: %s\n  %s" \
+    "${STACK_NAME}" "${DEVICE}" "${STACK_VERSION}" "$(hostname)" "${ELAPSED}" "${RELEASE}" "${AOSP_TAG}" "${AOSP_BUILD_ID}" "${LOGOUTPUT}")"
+  printf "%s: %s\n" "$(date "+%Y-%m-%d %H:%M:%S")" "${MESSAGE}" >> "${LOCAL_DIR}/notifications.log" || true
+  if [ -n "${LOCAL_NOTIFY_WEBHOOK}" ]; then
+    jq -n --arg subject "$1" --arg message "${MESSAGE}" '{subject: $subject, message: $message}' | \
+      curl --fail -s -X POST -H "Content-Type: application/json" --data-binary @- "${LOCAL_NOTIFY_WEBHOOK}" || true
+  fi
   <%- end %>
 }
 
@@ -75,7 +153,7 @@ cleanup() {
   du -chs "${AOSP_BUILD_DIR}" || true
   uptime
   AWS_LOGS_BUCKET="${STACK_NAME}-logs"
-  aws s3 cp /var/log/cloud-init-output.log "s3://${AWS_LOGS_BUCKET}/${DEVICE}/$(date +%s)" || true
+  storage_s3 cp /var/log/cloud-init-output.log "s3://${AWS_LOGS_BUCKET}/${DEVICE}/$(date +%s)" || true
   if [ $rv -ne 0 ]; then
     notify "RattlesnakeOS Build FAILED" 1
   fi
@@ -85,18 +163,24 @@ cleanup() {
   done
   <%- end %>
   sudo shutdown -h now
-  <%- else %>
-  echo "todo"
+  <%- else if eq .Cloud "local" %>
+  rv=$?
+  df -h
+  du -chs "${AOSP_BUILD_DIR}" || true
+  uptime
+  if [ $rv -ne 0 ]; then
+    notify "RattlesnakeOS Build FAILED" 1
+  fi
   <%- end %>
 }
 
 get_current_metadata() {
   <% if eq .Cloud "aws" -%>
     local metadata_location="${1}"
-    local current=$(aws s3 cp "s3://${AWS_RELEASE_BUCKET}/${1}" - 2>/dev/null || true)
+    local current=$(storage_s3 cp "s3://${AWS_RELEASE_BUCKET}/${1}" - 2>/dev/null || true)
     echo "${current}"
-  <%- else %>
-  echo "todo"
+  <%- else if eq .Cloud "local" %>
+  cat "${LOCAL_RELEASE_DIR}/${1}" 2>/dev/null || true
   <%- end %>
 }
 
@@ -105,13 +189,15 @@ set_current_metadata() {
   local metadata_value="${2}"
   local public="${3}"
   <% if eq .Cloud "aws" -%>
-  if [ -z "${public}" ]; then
-    echo "${metadata_value}" | aws s3 cp - "s3://${AWS_RELEASE_BUCKET}/${metadata_location}"
+  # S3 compatible services make the release bucket public with a bucket policy rather than object ACLs
+  if [ -z "${public}" ] || [ -n "${STORAGE_ENDPOINT}" ]; then
+    echo "${metadata_value}" | storage_s3 cp - "s3://${AWS_RELEASE_BUCKET}/${metadata_location}"
   else
-    echo "${metadata_value}" | aws s3 cp - "s3://${AWS_RELEASE_BUCKET}/${metadata_location}" --acl public-read
+    echo "${metadata_value}" | storage_s3 cp - "s3://${AWS_RELEASE_BUCKET}/${metadata_location}" --acl public-read
   fi
-  <%- else %>
-  echo "todo"
+  <%- else if eq .Cloud "local" %>
+  mkdir -p "$(dirname "${LOCAL_RELEASE_DIR}/${metadata_location}")"
+  echo "${metadata_value}" > "${LOCAL_RELEASE_DIR}/${metadata_location}"
   <%- end %>
 }
 
@@ -120,13 +206,14 @@ upload_build_artifact() {
   local dest_file="${2}"
   local public="${3}"
   <% if eq .Cloud "aws" -%>
-  if [ -z "${public}" ]; then
-    retry aws s3 cp "${src_file}" "s3://${AWS_RELEASE_BUCKET}/${dest_file}"
+  if [ -z "${public}" ] || [ -n "${STORAGE_ENDPOINT}" ]; then
+    retry storage_s3 cp "${src_file}" "s3://${AWS_RELEASE_BUCKET}/${dest_file}"
   else
-    retry aws s3 cp "${src_file}" "s3://${AWS_RELEASE_BUCKET}/${dest_file}" --acl public-read
+    retry storage_s3 cp "${src_file}" "s3://${AWS_RELEASE_BUCKET}/${dest_file}" --acl public-read
   fi
-  <%- else %>
-  echo "todo"
+  <%- else if eq .Cloud "local" %>
+  mkdir -p "$(dirname "${LOCAL_RELEASE_DIR}/${dest_file}")"
+  cp "${src_file}" "${LOCAL_RELEASE_DIR}/${dest_file}"
   <%- end %>
 }
 
@@ -134,17 +221,20 @@ download_build_artifact() {
   local src_file="${1}"
   local dest_file="${2}"
   <% if eq .Cloud "aws" -%>
-  retry aws s3 cp "s3://${AWS_RELEASE_BUCKET}/${src_file}" "${dest_file}"
-  <%- else %>
-  echo "todo"
+  retry storage_s3 cp "s3://${AWS_RELEASE_BUCKET}/${src_file}" "${dest_file}"
+  <%- else if eq .Cloud "local" %>
+  if [[ "${dest_file}" == */ ]]; then
+    mkdir -p "${dest_file}"
+  fi
+  cp "${LOCAL_RELEASE_DIR}/${src_file}" "${dest_file}"
   <%- end %>
 }
 
 delete_build_artifact() {
   local dest_file="${1}"
   <% if eq .Cloud "aws" -%>
-  aws s3 rm "s3://${AWS_RELEASE_BUCKET}/${dest_file}" || true
-  <%- else %>
-  echo "todo"
+  storage_s3 rm "s3://${AWS_RELEASE_BUCKET}/${dest_file}" || true
+  <%- else if eq .Cloud "local" %>
+  rm -f "${LOCAL_RELEASE_DIR}/${dest_file}"
   <%- end %>
 }
@@ -1,34 +1,53 @@
 #!/usr/bin/env python3
+# rattlesnakeos-stack template version: 4
 import boto3
 import base64
 import json
 import time
+from botocore.config import Config
 from urllib.request import urlopen
 from datetime import datetime, timedelta
 from pkg_resources import packaging
 
-STACK_VERSION = '<% .Config.Version %>'
-NAME = '<% .Config.Name %>'
-LATEST_JSON_URL = "<% .Config.ReleasesURL %>"
-STACK_VERSION_LATEST_URL = "<% .RattlesnakeOSStackReleasesURL %>"
-BUILD_SCRIPT_S3_LOCATION = 's3://<% .Config.Name %>-script/build.sh'
-RELEASE_BUCKET = '<% .Config.Name %>-release'
+STACK_VERSION = '<% pyquote .Config.Version %>'
+NAME = '<% pyquote .Config.Name %>'
+LATEST_JSON_URL = "<% pyquote .Config.ReleasesURL %>"
+STACK_VERSION_LATEST_URL = "<% pyquote .RattlesnakeOSStackReleasesURL %>"
+BUILD_SCRIPT_S3_LOCATION = 's3://<% pyquote .Config.Name %>-script/build.sh'
+RELEASE_BUCKET = '<% pyquote .Config.Name %>-release'
 FLEET_ROLE = 'arn:aws:iam::{0}:role/aws-service-role/spotfleet.amazonaws.com/AWSServiceRoleForEC2SpotFleet'
-IAM_PROFILE = 'arn:aws:iam::{0}:instance-profile/<% .Config.Name %>-ec2'
-SNS_ARN = 'arn:aws:sns:<% .Config.Region %>:{}:<% .Config.Name %>'
-INSTANCE_TYPE = '<% .Config.InstanceType %>'
-DEVICE = '<% .Config.Device %>'
-SSH_KEY_NAME = '<% .Config.SSHKey %>'
-MAX_PRICE = '<% .Config.MaxPrice %>'
-SKIP_PRICE = '<% .Config.SkipPrice %>'
-STACK_REGION = '<% .Config.Region %>'
-INSTANCE_REGIONS = '<% .Config.InstanceRegions %>'
-REGION_AMIS = json.loads('<% .RegionAMIs %>')
-CHROMIUM_BUILD_DISABLED = '<% .Config.ChromiumBuildDisabled %>'
-CHROMIUM_PINNED_VERSION = '<% .Config.ChromiumVersion %>'
+IAM_PROFILE = 'arn:aws:iam::{0}:instance-profile/<% pyquote .Config.Name %>-ec2'
+SNS_ARN = 'arn:aws:sns:<% pyquote .Config.Region %>:{}:<% pyquote .Config.Name %>'
+INSTANCE_TYPE = '<% pyquote .Config.InstanceType %>'
+DEVICES = json.loads('<% pyquote .Devices %>')
+SSH_KEY_NAME = '<% pyquote .Config.SSHKey %>'
+MAX_PRICE = '<% pyquote .Config.MaxPrice %>'
+SKIP_PRICE = '<% pyquote .Config.SkipPrice %>'
+STACK_REGION = '<% pyquote .Config.Region %>'
+INSTANCE_REGIONS = '<% pyquote .Config.InstanceRegions %>'
+REGION_AMIS = json.loads('<% pyquote .RegionAMIs %>')
+CHROMIUM_BUILD_DISABLED = '<% pyquote .Config.ChromiumBuildDisabled %>'
+CHROMIUM_PINNED_VERSION = '<% pyquote .Config.ChromiumVersion %>'
+STORAGE_ENDPOINT = '<% pyquote .Config.Storage.Endpoint %>'
+STORAGE_PATH_STYLE = '<% pyquote .Config.Storage.PathStyle %>'
+STORAGE_CREDENTIALS_PARAMETER = '<% pyquote .Config.Storage.CredentialsParameter %>'
 
 
 def lambda_handler(event, context):
+    # determine which device to build
+    device = event.get('device')
+    if not device:
+        if len(DEVICES) != 1:
+            message = "RattlesnakeOS build was cancelled. A device must be specified for stacks with multiple devices: {}".format(", ".join(DEVICES))
+            send_sns_message("RattlesnakeOS Build Cancelled", message)
+            return message
+        device = DEVICES[0]
+    if device not in DEVICES:
+        message = "RattlesnakeOS build was cancelled. Device {} is not configured for this stack: {}".format(device, ", ".join(DEVICES))
+        send_sns_message("RattlesnakeOS Build Cancelled", message)
+        return message
+    print("device", device)
+
     # get latest
     latest_stack_json = json.loads(urlopen(STACK_VERSION_LATEST_URL).read().decode())
     latest_stack_version = latest_stack_json.get('name')
@@ -38,9 +57,9 @@ def lambda_handler(event, context):
     print("latest_release", latest_release)
     latest_chromium_version = latest_json.get('chromium')
     print("latest_chromium_version", latest_chromium_version)
-    latest_aosp_build_id = latest_json.get('devices').get(DEVICE).get('build_id')
+    latest_aosp_build_id = latest_json.get('devices').get(device).get('build_id')
     print("latest_aosp_build_id", latest_aosp_build_id)
-    latest_aosp_tag = latest_json.get('devices').get(DEVICE).get('aosp_tag')
+    latest_aosp_tag = latest_json.get('devices').get(device).get('aosp_tag')
     print("latest_aosp_tag", latest_aosp_tag)
     minimum_stack_version = latest_json.get('minimum_stack_version')
     print("minimum_stack_version", minimum_stack_version)
@@ -73,9 +92,9 @@ def lambda_handler(event, context):
     print("chromium_version", chromium_version)
 
     # check if build is required
-    needs_build, build_reason = is_build_required(latest_release)
+    needs_build, build_reason = is_build_required(device, latest_release)
     if not needs_build and not force_build:
-        message = "RattlesnakeOS build is already up to date."
+        message = f"RattlesnakeOS build for {device} is already up to date."
         send_sns_message("RattlesnakeOS Build Not Required", message)
         return message
     if not needs_build and force_build:
@@ -107,8 +126,8 @@ def lambda_handler(event, context):
 
     # userdata to deploy with spot instance
     copy_build_command = f"sudo -u ubuntu aws s3 --region {STACK_REGION} cp {BUILD_SCRIPT_S3_LOCATION} /home/ubuntu/build.sh"
-    build_args_command = f"echo \\\"/home/ubuntu/build.sh {latest_release} {aosp_build_id} {aosp_tag} {chromium_version} {force_chromium_build_string} {revisions_string}\\\" > /home/ubuntu/build_cmd"
-    build_start_command = f"sudo -u ubuntu bash /home/ubuntu/build.sh \\\"{latest_release}\\\" \\\"{aosp_build_id}\\\" \\\"{aosp_tag}\\\" \\\"{chromium_version}\\\" \\\"{force_chromium_build_string}\\\" \\\"{revisions_string}\\\""
+    build_args_command = f"echo \\\"/home/ubuntu/build.sh {latest_release} {aosp_build_id} {aosp_tag} {chromium_version} {force_chromium_build_string} {revisions_string} {device}\\\" > /home/ubuntu/build_cmd"
+    build_start_command = f"sudo -u ubuntu bash /home/ubuntu/build.sh \\\"{latest_release}\\\" \\\"{aosp_build_id}\\\" \\\"{aosp_tag}\\\" \\\"{chromium_version}\\\" \\\"{force_chromium_build_string}\\\" \\\"{revisions_string}\\\" \\\"{device}\\\""
     userdata = base64.b64encode(f"""
 #cloud-config
 output : {{ all : '| tee -a /var/log/cloud-init-output.log' }}
@@ -208,22 +227,28 @@ runcmd:
         chromium_message = f"Chromium Version: {latest_chromium_version}\n "
 
     subject = "RattlesnakeOS Spot Instance LAUNCHED"
-    message = f"Successfully launched a spot instance.\n\n Stack Name: {NAME}\n Stack Version: {STACK_VERSION}\n Device: {DEVICE}\n Release: {latest_release}\n Tag: {latest_aosp_tag}\n Build ID: {latest_aosp_build_id}\n {chromium_message}Instance Type: {INSTANCE_TYPE}\n Cheapest Region: {cheapest_region}\n Cheapest Hourly Price: ${cheapest_price}\n Build Reason: {build_reason} "
+    message = f"Successfully launched a spot instance.\n\n Stack Name: {NAME}\n Stack Version: {STACK_VERSION}\n Device: {device}\n Release: {latest_release}\n Tag: {latest_aosp_tag}\n Build ID: {latest_aosp_build_id}\n {chromium_message}Instance Type: {INSTANCE_TYPE}\n Cheapest Region: {cheapest_region}\n Cheapest Hourly Price: ${cheapest_price}\n Build Reason: {build_reason} "
     send_sns_message(subject, message)
     return message.replace('\n', ' ')
 
 
-def is_build_required(latest_release):
-    s3 = boto3.resource('s3')
+def is_build_required(device, latest_release):
+    s3 = storage_s3_resource()
     needs_update = False
     reason = ""
 
     existing_release_version = ""
-    try:
-        existing_release_version = s3.Object(RELEASE_BUCKET, "release").get()['Body'].read().decode().strip("\n")
-    except Exception as e:
-        print("failed to get existing_release_version: {}".format(e))
-        pass
+    release_keys = ["{}-release".format(device)]
+    # stacks that only supported a single device stored release without a device prefix. it only belongs to the
+    # original device, so devices added since then are built instead of picking it up.
+    if len(DEVICES) == 1:
+        release_keys.append("release")
+    for release_key in release_keys:
+        try:
+            existing_release_version = s3.Object(RELEASE_BUCKET, release_key).get()['Body'].read().decode().strip("\n")
+            break
+        except Exception as e:
+            print("failed to get existing_release_version from {}: {}".format(release_key, e))
     if latest_release > existing_release_version:
         needs_update = True
         reason = "New release '{}'".format(latest_release)
@@ -233,6 +258,16 @@ def is_build_required(latest_release):
     return needs_update, reason
 
 
+def storage_s3_resource():
+    if not STORAGE_ENDPOINT:
+        return boto3.resource('s3')
+    credentials = boto3.client('ssm').get_parameter(Name=STORAGE_CREDENTIALS_PARAMETER, WithDecryption=True)
+    access_key_id, secret_access_key = credentials['Parameter']['Value'].split(':', 1)
+    addressing_style = 'path' if STORAGE_PATH_STYLE == 'true' else 'virtual'
+    return boto3.resource('s3', endpoint_url=STORAGE_ENDPOINT, aws_access_key_id=access_key_id,
+                          aws_secret_access_key=secret_access_key, config=Config(s3={'addressing_style': addressing_style}))
+
+
 def find_cheapest_region():
     cheapest_price = 0
     cheapest_region = ""
@@ -0,0 +1,97 @@
+#!/usr/bin/env bash
+# rattlesnakeos-stack template version: 2
+#
+# Starts a build of this stack on the local machine. It does what the lambda function does for aws stacks: checks the
+# latest release, skips the build if it is already up to date and otherwise runs build.sh with the build arguments.
+#
+# usage: run_build.sh [device]
+#   FORCE_BUILD=true           build even if the device is already up to date
+#   FORCE_CHROMIUM_BUILD=true  build chromium even if it is already up to date
+#   AOSP_BUILD_ID, AOSP_TAG    build a specific aosp build id and tag instead of the latest
+set -euo pipefail
+
+STACK_NAME="<% shellquote .Name %>"
+STACK_VERSION="<% shellquote .Version %>"
+LATEST_JSON_URL="<% shellquote .ReleasesURL %>"
+CHROMIUM_PINNED_VERSION="<% shellquote .ChromiumVersion %>"
+DEVICES=(<% range $i, $device := .Devices %><% if $i %> <% end %>"<% shellquote $device.Name %>"<% end %>)
+LOCAL_DIR="<% shellquote .LocalDir %>"
+LOCAL_DIR="${LOCAL_DIR:-${HOME}/${STACK_NAME}}"
+BUILD_SCRIPT="$(dirname "$(readlink -f "${BASH_SOURCE[0]}")")/build.sh"
+
+log() {
+  echo "$(date "+%Y-%m-%d %H:%M:%S"): $1"
+}
+
+device="${1:-}"
+if [ -z "${device}" ]; then
+  if [ "${#DEVICES[@]}" -ne 1 ]; then
+    log "A device must be specified for stacks with multiple devices: ${DEVICES[*]}"
+    exit 1
+  fi
+  device="${DEVICES[0]}"
+fi
+if [[ ! " ${DEVICES[*]} " == *" ${device} "* ]]; then
+  log "Device ${device} is not configured for this stack: ${DEVICES[*]}"
+  exit 1
+fi
+log "device ${device}"
+
+for command in curl jq; do
+  if ! command -v "${command}" > /dev/null; then
+    log "${command} is required to run builds"
+    exit 1
+  fi
+done
+
+# get latest
+latest_json=$(curl --fail -s "${LATEST_JSON_URL}")
+latest_release=$(jq -r '.release' <<< "${latest_json}")
+latest_chromium_version=$(jq -r '.chromium' <<< "${latest_json}")
+latest_aosp_build_id=$(jq -r --arg device "${device}" '.devices[$device].build_id' <<< "${latest_json}")
+latest_aosp_tag=$(jq -r --arg device "${device}" '.devices[$device].aosp_tag' <<< "${latest_json}")
+minimum_stack_version=$(jq -r '.minimum_stack_version' <<< "${latest_json}")
+log "latest_release ${latest_release}, latest_aosp_build_id ${latest_aosp_build_id}, latest_aosp_tag ${latest_aosp_tag}"
+
+# only build if minimum stack version requirement is met
+if [ "$(printf "%s\n%s\n" "${minimum_stack_version}" "${STACK_VERSION}" | sort -V | head -n 1)" != "${minimum_stack_version}" ]; then
+  log "Existing stack version ${STACK_VERSION} needs to be updated to at least ${minimum_stack_version}"
+  exit 1
+fi
+
+# gather revisions for passing to build script
+revisions=$(jq -r '[.revisions | to_entries[] | "\(.key)=\(.value)"] | join(",")' <<< "${latest_json}")
+
+# build time overrides
+force_build="${FORCE_BUILD:-false}"
+force_chromium_build="${FORCE_CHROMIUM_BUILD:-false}"
+if [ "${force_chromium_build}" == "true" ]; then
+  force_build="true"
+fi
+aosp_build_id="${AOSP_BUILD_ID:-${latest_aosp_build_id}}"
+aosp_tag="${AOSP_TAG:-${latest_aosp_tag}}"
+chromium_version="${CHROMIUM_PINNED_VERSION:-${latest_chromium_version}}"
+
+# check if build is required. stacks that only supported a single device stored release without a device prefix,
+# which only belongs to the original device, so devices added since then are built instead of picking it up.
+release_files=("${device}-release")
+if [ "${#DEVICES[@]}" -eq 1 ]; then
+  release_files+=("release")
+fi
+existing_release=""
+for release_file in "${release_files[@]}"; do
+  if [ -f "${LOCAL_DIR}/release/${release_file}" ]; then
+    existing_release=$(< "${LOCAL_DIR}/release/${release_file}")
+    break
+  fi
+done
+if [[ ! "${latest_release}" > "${existing_release}" ]]; then
+  if [ "${force_build}" != "true" ]; then
+    log "RattlesnakeOS build for ${device} is already up to date."
+    exit 0
+  fi
+  log "Build not required - but force build was specified."
+fi
+
+exec bash "${BUILD_SCRIPT}" "${latest_release}" "${aosp_build_id}" "${aosp_tag}" "${chromium_version}" \
+  "${force_chromium_build}" "${revisions}" "${device}"
@@ -1,12 +1,35 @@
-######################
-# S3 Terraform Backend
-######################
+# rattlesnakeos-stack template version: 4
+###################
+# Terraform Backend
+###################
 terraform {
+  required_version = ">= 1.0"
+
+  required_providers {
+    aws = {
+      source  = "hashicorp/aws"
+      version = "~> 5.0"
+    }
+  }
+<% if eq .StateBackend.Type "local" %>
+  backend "local" {
+    path = "terraform.tfstate"
+  }
+<%- else %>
   backend "s3" {
-    bucket = "<% .Config.Name %>"
-    key    = "terraform.state"
-    region = "<% .Config.Region %>"
+    bucket = "<% hclquote .StateBackend.Bucket %>"
+    key    = "<% hclquote .StateBackend.Key %>"
+    region = "<% hclquote .StateBackend.Region %>"
+<%- if .StateBackend.Endpoint %>
+
+    endpoint                    = "<% hclquote .StateBackend.Endpoint %>"
+    force_path_style            = true
+    skip_credentials_validation = true
+    skip_region_validation      = true
+    skip_metadata_api_check     = true
+<%- end %>
   }
+<%- end %>
 }
 
 ###################
@@ -14,35 +37,47 @@ terraform {
 ###################
 variable "name" {
   description = "Name to be used on all AWS resources as identifier"
-  default     = "<% .Config.Name %>"
+  type        = string
+  default     = "<% hclquote .Config.Name %>"
 }
 
 variable "region" {
   description = "The AWS region to deploy"
-  default     = "<% .Config.Region %>"
-}
-
-variable "device" {
-  description = "Device type"
-  default     = "<% .Config.Device %>"
+  type        = string
+  default     = "<% hclquote .Config.Region %>"
 }
 
 variable "lambda_build_zip_file" {
   description = "Lambda build zip file"
-  default     = "<% .LambdaZipFileLocation %>"
+  type        = string
+  default     = "<% hclquote .LambdaZipFileLocation %>"
 }
 
 variable "shell_script_file" {
   description = "Shell script file"
-  default     = "<% .BuildScriptFileLocation %>"
+  type        = string
+  default     = "<% hclquote .BuildScriptFileLocation %>"
 }
 
 ###################
 # Provider
 ###################
 provider "aws" {
-  region = "${var.region}"
+  region = var.region
 }
+<%- if not .Config.Storage.IsAWS %>
+
+###################
+# Storage
+###################
+# the keys, logs and release buckets are in an S3 compatible service and created by setup. build instances and the
+# lambda function read the credentials for it from an SSM parameter.
+data "aws_caller_identity" "current" {}
+
+locals {
+  storage_credentials_parameter_arn = "arn:aws:ssm:${var.region}:${data.aws_caller_identity.current.account_id}:parameter/${trimprefix("<% hclquote .Config.Storage.CredentialsParameter %>", "/")}"
+}
+<%- end %>
 
 ###################
 # IAM
@@ -68,11 +103,20 @@ EOF
 
 resource "aws_iam_role_policy" "rattlesnake_ec2_policy" {
   name = "${var.name}-ec2-policy"
-  role = "${aws_iam_instance_profile.rattlesnake_ec2_role.id}"
+  role = aws_iam_role.rattlesnake_ec2_role.id
   policy = <<EOF
 {
 "Version": "2012-10-17",
 "Statement": [
+<%- if not .Config.Storage.IsAWS %>
+    {
+        "Effect": "Allow",
+        "Action": [
+            "ssm:GetParameter"
+        ],
+        "Resource": "${local.storage_credentials_parameter_arn}"
+    },
+<%- end %>
     {
         "Effect": "Allow",
         "Action": [
@@ -175,7 +219,7 @@ EOF
 
 resource "aws_iam_instance_profile" "rattlesnake_ec2_role" {
   name = "${var.name}-ec2"
-  role = "${aws_iam_role.rattlesnake_ec2_role.name}"
+  role = aws_iam_role.rattlesnake_ec2_role.name
 }
 
 resource "aws_iam_role" "rattlesnake_lambda_role" {
@@ -199,11 +243,20 @@ EOF
 
 resource "aws_iam_role_policy" "rattlesnake_lambda_policy" {
   name = "${var.name}-lambda-policy"
-  role = "${aws_iam_role.rattlesnake_lambda_role.id}"
+  role = aws_iam_role.rattlesnake_lambda_role.id
   policy = <<EOF
 {
 "Version": "2012-10-17",
 "Statement": [
+<%- if not .Config.Storage.IsAWS %>
+    {
+        "Effect": "Allow",
+        "Action": [
+            "ssm:GetParameter"
+        ],
+        "Resource": "${local.storage_credentials_parameter_arn}"
+    },
+<%- end %>
     {
         "Effect": "Allow",
         "Action": [
@@ -245,126 +298,276 @@ EOF
 ###################
 # S3
 ###################
+<%- if .Config.Storage.IsAWS %>
 resource "aws_s3_bucket" "rattlesnake_s3_keys" {
   bucket        = "${var.name}-keys"
   force_destroy = true
-  acl           = "private"
 
-  server_side_encryption_configuration {
-    rule {
-      apply_server_side_encryption_by_default {
-        sse_algorithm = "AES256"
-      }
+  # losing the signing keys means devices can't be updated without a data wipe, so only remove allows destroying them
+  lifecycle {
+    prevent_destroy = <% if .Config.AllowKeysDestroy %>false<% else %>true<% end %>
+  }
+}
+
+resource "aws_s3_bucket_server_side_encryption_configuration" "rattlesnake_s3_keys" {
+  bucket = aws_s3_bucket.rattlesnake_s3_keys.id
+
+  rule {
+    apply_server_side_encryption_by_default {
+      sse_algorithm = "AES256"
     }
   }
 }
 
+resource "aws_s3_bucket_public_access_block" "rattlesnake_s3_keys" {
+  bucket = aws_s3_bucket.rattlesnake_s3_keys.id
+
+  block_public_acls       = true
+  ignore_public_acls      = true
+  block_public_policy     = true
+  restrict_public_buckets = true
+}
+
+<%- end %>
+
 resource "aws_s3_bucket" "rattlesnake_s3_keys_enc" {
   bucket        = "${var.name}-keys-encrypted"
   force_destroy = true
-  acl           = "private"
+}
+
+resource "aws_s3_bucket_server_side_encryption_configuration" "rattlesnake_s3_keys_enc" {
+  bucket = aws_s3_bucket.rattlesnake_s3_keys_enc.id
 
-  server_side_encryption_configuration {
-    rule {
-      apply_server_side_encryption_by_default {
-        sse_algorithm = "AES256"
-      }
+  rule {
+    apply_server_side_encryption_by_default {
+      sse_algorithm = "AES256"
     }
   }
 }
 
+resource "aws_s3_bucket_public_access_block" "rattlesnake_s3_keys_enc" {
+  bucket = aws_s3_bucket.rattlesnake_s3_keys_enc.id
+
+  block_public_acls       = true
+  ignore_public_acls      = true
+  block_public_policy     = true
+  restrict_public_buckets = true
+}
+<%- if .Config.Storage.IsAWS %>
+
 resource "aws_s3_bucket" "rattlesnake_s3_logs" {
   bucket        = "${var.name}-logs"
   force_destroy = true
-  acl           = "private"
+}
+
+resource "aws_s3_bucket_server_side_encryption_configuration" "rattlesnake_s3_logs" {
+  bucket = aws_s3_bucket.rattlesnake_s3_logs.id
 
-  server_side_encryption_configuration {
-    rule {
-      apply_server_side_encryption_by_default {
-        sse_algorithm = "AES256"
-      }
+  rule {
+    apply_server_side_encryption_by_default {
+      sse_algorithm = "AES256"
     }
   }
 }
 
+resource "aws_s3_bucket_public_access_block" "rattlesnake_s3_logs" {
+  bucket = aws_s3_bucket.rattlesnake_s3_logs.id
+
+  block_public_acls       = true
+  ignore_public_acls      = true
+  block_public_policy     = true
+  restrict_public_buckets = true
+}
+
 resource "aws_s3_bucket" "rattlesnake_s3_release" {
   bucket        = "${var.name}-release"
   force_destroy = true
-  acl           = "private"
+}
+
+resource "aws_s3_bucket_server_side_encryption_configuration" "rattlesnake_s3_release" {
+  bucket = aws_s3_bucket.rattlesnake_s3_release.id
 
-  server_side_encryption_configuration {
-    rule {
-      apply_server_side_encryption_by_default {
-        sse_algorithm = "AES256"
-      }
+  rule {
+    apply_server_side_encryption_by_default {
+      sse_algorithm = "AES256"
     }
   }
 }
 
+# builds upload OTA updates and release metadata with a public-read acl so devices can fetch them
+resource "aws_s3_bucket_ownership_controls" "rattlesnake_s3_release" {
+  bucket = aws_s3_bucket.rattlesnake_s3_release.id
+
+  rule {
+    object_ownership = "ObjectWriter"
+  }
+}
+
+resource "aws_s3_bucket_public_access_block" "rattlesnake_s3_release" {
+  bucket = aws_s3_bucket.rattlesnake_s3_release.id
+
+  block_public_acls       = false
+  ignore_public_acls      = false
+  block_public_policy     = true
+  restrict_public_buckets = true
+}
+
+<%- end %>
+
 resource "aws_s3_bucket" "rattlesnake_s3_script" {
   bucket        = "${var.name}-script"
   force_destroy = true
-  acl           = "private"
+}
+
+resource "aws_s3_bucket_server_side_encryption_configuration" "rattlesnake_s3_script" {
+  bucket = aws_s3_bucket.rattlesnake_s3_script.id
 
-  server_side_encryption_configuration {
-    rule {
-      apply_server_side_encryption_by_default {
-        sse_algorithm = "AES256"
-      }
+  rule {
+    apply_server_side_encryption_by_default {
+      sse_algorithm = "AES256"
     }
   }
 }
 
-resource "aws_s3_bucket_object" "rattlesnake_s3_script_file" {
-  bucket = "${var.name}-script"
-  key    = "build.sh"
-  source = "${var.shell_script_file}"
-  etag   = "${md5(file("${var.shell_script_file}"))}"
+resource "aws_s3_bucket_public_access_block" "rattlesnake_s3_script" {
+  bucket = aws_s3_bucket.rattlesnake_s3_script.id
+
+  block_public_acls       = true
+  ignore_public_acls      = true
+  block_public_policy     = true
+  restrict_public_buckets = true
+}
 
-  depends_on = ["aws_s3_bucket.rattlesnake_s3_script"]
+resource "aws_s3_object" "rattlesnake_s3_script_file" {
+  bucket = aws_s3_bucket.rattlesnake_s3_script.id
+  key    = "build.sh"
+  source = var.shell_script_file
+  etag   = filemd5(var.shell_script_file)
 }
 
 ###################
 # SNS
 ###################
 resource "aws_sns_topic" "rattlesnake" {
-  name = "${var.name}"
+  name = var.name
 }
 
 ###################
 # Lambda
 ###################
 resource "aws_lambda_function" "rattlesnake_lambda_build" {
-  filename         = "${var.lambda_build_zip_file}"
-  function_name    = "${var.name}"
-  role             = "${aws_iam_role.rattlesnake_lambda_role.arn}"
+  filename         = var.lambda_build_zip_file
+  function_name    = var.name
+  role             = aws_iam_role.rattlesnake_lambda_role.arn
   handler          = "lambda_spot_function.lambda_handler"
-  source_code_hash = "${base64sha256(file("${var.lambda_build_zip_file}"))}"
-  runtime          = "python3.6"
-  timeout          = "180"
+  source_code_hash = filebase64sha256(var.lambda_build_zip_file)
+  runtime          = "python3.11"
+  timeout          = 180
 }
 
 <% if .Config.Schedule -%>
 ###################
 # Cloudwatch Event
 ###################
-resource "aws_cloudwatch_event_rule" "build_schedule" {
-  name                = "${var.name}-build-schedule"
-  description         = "RattlesnakeOS build"
-  schedule_expression = "<% .Config.Schedule %>"
+<%- range .Config.Devices %>
+resource "aws_cloudwatch_event_rule" "build_schedule_<% hclident .Name %>" {
+  name                = "${var.name}-build-schedule-<% hclquote .Name %>"
+  description         = "RattlesnakeOS <% hclquote .Name %> build"
+  schedule_expression = "<% hclquote $.Config.Schedule %>"
+}
+
+resource "aws_cloudwatch_event_target" "check_build_schedule_<% hclident .Name %>" {
+  rule      = aws_cloudwatch_event_rule.build_schedule_<% hclident .Name %>.name
+  target_id = "${var.name}-<% hclquote .Name %>"
+  arn       = aws_lambda_function.rattlesnake_lambda_build.arn
+  input     = jsonencode({ device = "<% hclquote .Name %>" })
 }
 
-resource "aws_cloudwatch_event_target" "check_build_schedule" {
-  rule = "${aws_cloudwatch_event_rule.build_schedule.name}"
-  target_id = "${var.name}"
-  arn = "${aws_lambda_function.rattlesnake_lambda_build.arn}"
+resource "aws_lambda_permission" "allow_cloudwatch_to_call_build_schedule_<% hclident .Name %>" {
+  statement_id  = "AllowExecutionFromCloudWatch-<% hclquote .Name %>"
+  action        = "lambda:InvokeFunction"
+  function_name = aws_lambda_function.rattlesnake_lambda_build.function_name
+  principal     = "events.amazonaws.com"
+  source_arn    = aws_cloudwatch_event_rule.build_schedule_<% hclident .Name %>.arn
+}
+<%- end %>
+<%- end %>
+###################
+# Outputs
+###################
+output "keys_bucket" {
+  description = "Bucket that holds the signing keys"
+<%- if .Config.Storage.IsAWS %>
+  value       = aws_s3_bucket.rattlesnake_s3_keys.id
+<%- else %>
+  value       = "${var.name}-keys"
+<%- end %>
+}
+
+output "keys_encrypted_bucket" {
+  description = "Bucket that holds encrypted signing keys"
+  value       = aws_s3_bucket.rattlesnake_s3_keys_enc.id
+}
+
+output "logs_bucket" {
+  description = "Bucket that holds build logs"
+<%- if .Config.Storage.IsAWS %>
+  value       = aws_s3_bucket.rattlesnake_s3_logs.id
+<%- else %>
+  value       = "${var.name}-logs"
+<%- end %>
+}
+
+output "release_bucket" {
+  description = "Bucket that holds OTA updates and release metadata"
+<%- if .Config.Storage.IsAWS %>
+  value       = aws_s3_bucket.rattlesnake_s3_release.id
+<%- else %>
+  value       = "${var.name}-release"
+<%- end %>
+}
+
+output "script_bucket" {
+  description = "Bucket that holds the build script"
+  value       = aws_s3_bucket.rattlesnake_s3_script.id
+}
+
+output "ec2_instance_profile" {
+  description = "Instance profile of build instances"
+  value       = aws_iam_instance_profile.rattlesnake_ec2_role.name
+}
+
+output "lambda_function_name" {
+  description = "Name of the Lambda function that starts builds"
+  value       = aws_lambda_function.rattlesnake_lambda_build.function_name
+}
+
+output "lambda_function_arn" {
+  description = "ARN of the Lambda function that starts builds"
+  value       = aws_lambda_function.rattlesnake_lambda_build.arn
+}
+
+output "sns_topic_arn" {
+  description = "ARN of the SNS topic for build notifications"
+  value       = aws_sns_topic.rattlesnake.arn
+}
+
+output "schedule_rules" {
+  description = "Names of the scheduled build rules by device"
+  value = {
+<%- if .Config.Schedule %>
+<%- range .Config.Devices %>
+    "<% hclquote .Name %>" = aws_cloudwatch_event_rule.build_schedule_<% hclident .Name %>.name
+<%- end %>
+<%- end %>
+  }
 }
 
-resource "aws_lambda_permission" "allow_cloudwatch_to_call_build_schedule" {
-  statement_id = "AllowExecutionFromCloudWatch"
-  action = "lambda:InvokeFunction"
-  function_name = "${aws_lambda_function.rattlesnake_lambda_build.function_name}"
-  principal = "events.amazonaws.com"
-  source_arn = "${aws_cloudwatch_event_rule.build_schedule.arn}"
+output "ota_base_url" {
+  description = "Base URL that devices download OTA updates from"
+<%- if .Config.Storage.IsAWS %>
+  value       = "https://${aws_s3_bucket.rattlesnake_s3_release.bucket_domain_name}"
+<%- else %>
+  value       = "<% hclquote (.Config.Storage.ReleaseURL .Config.Name) %>"
+<%- end %>
 }
-<%- end %>
\ No newline at end of file